@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/azukaar/cosmos-server/src/proxy"
 	// "github.com/azukaar/cosmos-server/src/docker"
 	"os"
 	"path/filepath"
@@ -64,9 +65,18 @@ func checkVersion() {
 	}
 }
 
+var cronStopped chan bool
+
 func CRON() {
-	go func() {
-		gocron.Every(1).Day().At("00:00").Do(checkVersion)
-		<-gocron.Start()
-	}()
+	gocron.Every(1).Day().At("00:00").Do(checkVersion)
+	gocron.Every(1).Minute().Do(proxy.CleanUpSmartShield)
+	gocron.Every(5).Minutes().Do(proxy.SaveSmartShield)
+	cronStopped = gocron.Start()
+}
+
+func StopCRON() {
+	if cronStopped != nil {
+		cronStopped <- true
+	}
+	gocron.Clear()
 }
\ No newline at end of file
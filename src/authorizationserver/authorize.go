@@ -0,0 +1,152 @@
+package authorizationserver
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/azukaar/cosmos-server/src/user"
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// redirectError sends an error back to the client, once its redirect URI is trusted
+func redirectError(w http.ResponseWriter, req *http.Request, redirectURI string, state string, code string, description string) {
+	utils.ReqLog(req).Error("OAuth2Authorize: " + code + ": " + description, nil)
+
+	target, _ := url.Parse(redirectURI)
+	query := target.Query()
+	query.Set("error", code)
+	query.Set("error_description", description)
+	if state != "" {
+		query.Set("state", state)
+	}
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, req, target.String(), http.StatusFound)
+}
+
+// AuthorizeRoute is the authorization endpoint. The Cosmos session of the user
+// is the login, users who are not logged in go through the login page first
+func AuthorizeRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET" && req.Method != "POST") {
+		utils.ReqLog(req).Error("OAuth2Authorize: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		utils.ReqLog(req).Error("OAuth2Authorize: Invalid request", err)
+		utils.HTTPError(w, "Invalid authorization request", http.StatusBadRequest, "OA001")
+		return
+	}
+
+	clientID := req.Form.Get("client_id")
+	redirectURI := req.Form.Get("redirect_uri")
+	state := req.Form.Get("state")
+
+	client, err := getClient(clientID)
+	if err != nil {
+		utils.ReqLog(req).Error("OAuth2Authorize: Unknown client " + clientID, err)
+		utils.HTTPError(w, "Unknown client", http.StatusBadRequest, "OA002")
+		return
+	}
+
+	// the redirect URI can be left out when the client has only one
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+
+	trusted := false
+	for _, uri := range client.RedirectURIs {
+		if uri == redirectURI {
+			trusted = true
+		}
+	}
+
+	if !trusted {
+		utils.ReqLog(req).Error("OAuth2Authorize: Redirect URI not registered for " + client.Name + ": " + redirectURI, nil)
+		utils.HTTPError(w, "Redirect URI not registered for this client", http.StatusBadRequest, "OA003")
+		return
+	}
+
+	if req.Form.Get("response_type") != "code" {
+		redirectError(w, req, redirectURI, state, "unsupported_response_type", "only the code flow is supported")
+		return
+	}
+
+	scope := splitScope(req.Form.Get("scope"))
+	if !hasScope(scope, "openid") {
+		redirectError(w, req, redirectURI, state, "invalid_scope", "the openid scope is required")
+		return
+	}
+
+	codeChallenge := req.Form.Get("code_challenge")
+	if codeChallenge != "" && req.Form.Get("code_challenge_method") != "S256" {
+		redirectError(w, req, redirectURI, state, "invalid_request", "only the S256 code challenge method is supported")
+		return
+	}
+
+	if codeChallenge == "" && client.Public {
+		redirectError(w, req, redirectURI, state, "invalid_request", "public clients must use PKCE")
+		return
+	}
+
+	nickname := req.Header.Get("x-cosmos-user")
+	role, _ := strconv.Atoi(req.Header.Get("x-cosmos-role"))
+
+	if nickname == "" || role <= 0 {
+		if strings.Contains(" " + req.Form.Get("prompt") + " ", " none ") {
+			redirectError(w, req, redirectURI, state, "login_required", "the user is not logged in")
+			return
+		}
+
+		// the parameters of a POST are moved to the query to come back after the login
+		back := url.URL{Path: AuthorizePath, RawQuery: req.Form.Encode()}
+		http.Redirect(w, req, "/ui/login?notlogged=1&redirect=" + url.QueryEscape(back.String()), http.StatusFound)
+		return
+	}
+
+	u, err := user.GetUserByNickname(nickname)
+	if err != nil {
+		utils.ReqLog(req).Error("OAuth2Authorize: Error while getting user", err)
+		utils.HTTPError(w, "User not found", http.StatusInternalServerError, "OA001")
+		return
+	}
+
+	// auth_time is when the user logged in, not when the code is issued
+	session, err := user.CurrentSession(req)
+	if err != nil {
+		utils.ReqLog(req).Error("OAuth2Authorize: Error while getting session", err)
+		redirectError(w, req, redirectURI, state, "server_error", "cannot read the session of the user")
+		return
+	}
+
+	code, err := newAuthorizationCode(authorizationCode{
+		clientID: client.ClientID,
+		redirectURI: redirectURI,
+		nickname: u.Nickname,
+		passwordCycle: u.PasswordCycle,
+		scope: scope,
+		nonce: req.Form.Get("nonce"),
+		codeChallenge: codeChallenge,
+		authTime: session.CreatedAt,
+	})
+	if err != nil {
+		utils.ReqLog(req).Error("OAuth2Authorize: Error while creating code", err)
+		redirectError(w, req, redirectURI, state, "server_error", "cannot create the authorization code")
+		return
+	}
+
+	utils.ReqLog(req).Debug("OAuth2Authorize: " + u.Nickname + " authorized " + client.Name)
+
+	target, _ := url.Parse(redirectURI)
+	query := target.Query()
+	query.Set("code", code)
+	if state != "" {
+		query.Set("state", state)
+	}
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, req, target.String(), http.StatusFound)
+}
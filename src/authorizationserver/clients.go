@@ -0,0 +1,318 @@
+package authorizationserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/gorilla/mux"
+)
+
+type ClientRequestJSON struct {
+	Name string `validate:"required,max=64"`
+	RedirectURIs []string `validate:"required,min=1,max=16,dive,required,max=2048"`
+	Public bool
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func checkSecret(client utils.OpenIDClient, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(client.SecretHash)) == 1
+}
+
+// validRedirectURIs refuses fragments and plain http outside of loopback addresses
+func validRedirectURIs(uris []string) bool {
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" || parsed.Host == "" {
+			return false
+		}
+
+		if parsed.Scheme == "http" {
+			host := parsed.Hostname()
+			if host != "localhost" && host != "127.0.0.1" && host != "::1" {
+				return false
+			}
+		} else if parsed.Scheme != "https" {
+			return false
+		}
+	}
+	return true
+}
+
+func getClient(clientID string) (utils.OpenIDClient, error) {
+	client := utils.OpenIDClient{}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "oauth2clients")
+	if errCo != nil {
+		return client, errCo
+	}
+
+	err := c.FindOne(nil, map[string]interface{}{
+		"ClientID": clientID,
+	}).Decode(&client)
+
+	return client, err
+}
+
+func ClientsIdRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method == "DELETE") {
+		ClientDelete(w, req)
+	} else if (req.Method == "GET") {
+		ClientGet(w, req)
+	} else if (req.Method == "PATCH") {
+		ClientEdit(w, req)
+	} else {
+		utils.ReqLog(req).Error("OpenIDClientRoute: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func ClientsRoute(w http.ResponseWriter, req *http.Request) {
+	if (req.Method == "POST") {
+		ClientCreate(w, req)
+	} else if (req.Method == "GET") {
+		ClientList(w, req)
+	} else {
+		utils.ReqLog(req).Error("OpenIDClientRoute: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// ClientCreate registers a client, its secret is only returned here
+func ClientCreate(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	var request ClientRequestJSON
+	err1 := json.NewDecoder(req.Body).Decode(&request)
+	if err1 != nil {
+		utils.ReqLog(req).Error("OpenIDClientCreation: Invalid Client Request", err1)
+		utils.HTTPError(w, "Client Creation Error", http.StatusBadRequest, "OC001")
+		return
+	}
+
+	errV := utils.Validate.Struct(request)
+	if errV != nil || !validRedirectURIs(request.RedirectURIs) {
+		utils.ReqLog(req).Error("OpenIDClientCreation: Invalid Client Request", errV)
+		utils.HTTPError(w, "Client Creation Error: invalid name or redirect URIs", http.StatusBadRequest, "OC002")
+		return
+	}
+
+	clientID, err := randomToken()
+	if err != nil {
+		utils.ReqLog(req).Error("OpenIDClientCreation: Error while generating client id", err)
+		utils.HTTPError(w, "Client Creation Error", http.StatusInternalServerError, "OC001")
+		return
+	}
+	clientID = clientID[:24]
+
+	secret := ""
+	if !request.Public {
+		secret, err = randomToken()
+		if err != nil {
+			utils.ReqLog(req).Error("OpenIDClientCreation: Error while generating secret", err)
+			utils.HTTPError(w, "Client Creation Error", http.StatusInternalServerError, "OC001")
+			return
+		}
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "oauth2clients")
+	if errCo != nil {
+			utils.ReqLog(req).Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+	}
+
+	client := utils.OpenIDClient{
+		ClientID: clientID,
+		Name: utils.Sanitize(request.Name),
+		RedirectURIs: request.RedirectURIs,
+		Public: request.Public,
+		CreatedAt: time.Now(),
+	}
+
+	secretHash := ""
+	if secret != "" {
+		secretHash = hashSecret(secret)
+	}
+
+	_, errDB := c.InsertOne(nil, map[string]interface{}{
+		"ClientID": client.ClientID,
+		"Name": client.Name,
+		"SecretHash": secretHash,
+		"RedirectURIs": client.RedirectURIs,
+		"Public": client.Public,
+		"CreatedAt": client.CreatedAt,
+	})
+	if errDB != nil {
+		utils.ReqLog(req).Error("OpenIDClientCreation: Error while creating client", errDB)
+		utils.HTTPError(w, "Client Creation Error", http.StatusInternalServerError, "OC001")
+		return
+	}
+
+	utils.ReqLog(req).Log("OpenID: client " + client.Name + " registered by " + req.Header.Get("x-cosmos-user"))
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+		"data": map[string]interface{}{
+			"client": client,
+			"clientSecret": secret,
+		},
+	})
+}
+
+func ClientList(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "oauth2clients")
+	if errCo != nil {
+			utils.ReqLog(req).Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+	}
+
+	cursor, errDB := c.Find(nil, map[string]interface{}{})
+	if errDB != nil {
+		utils.ReqLog(req).Error("OpenIDClientList: Error while getting clients", errDB)
+		utils.HTTPError(w, "Client Get Error", http.StatusInternalServerError, "OC003")
+		return
+	}
+	defer cursor.Close(nil)
+
+	clients := []utils.OpenIDClient{}
+	if errDec := cursor.All(nil, &clients); errDec != nil {
+		utils.ReqLog(req).Error("OpenIDClientList: Error while decoding clients", errDec)
+		utils.HTTPError(w, "Client Get Error", http.StatusInternalServerError, "OC003")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+		"data": clients,
+	})
+}
+
+func ClientGet(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	client, err := getClient(mux.Vars(req)["clientId"])
+	if err != nil {
+		utils.ReqLog(req).Error("OpenIDClientGet: Error while getting client", err)
+		utils.HTTPError(w, "Client not found", http.StatusNotFound, "OC004")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+		"data": client,
+	})
+}
+
+// ClientEdit changes the name and redirect URIs, the secret and type are kept
+func ClientEdit(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	clientID := mux.Vars(req)["clientId"]
+
+	var request ClientRequestJSON
+	err1 := json.NewDecoder(req.Body).Decode(&request)
+	if err1 != nil {
+		utils.ReqLog(req).Error("OpenIDClientEdit: Invalid Client Request", err1)
+		utils.HTTPError(w, "Client Edit Error", http.StatusBadRequest, "OC001")
+		return
+	}
+
+	errV := utils.Validate.Struct(request)
+	if errV != nil || !validRedirectURIs(request.RedirectURIs) {
+		utils.ReqLog(req).Error("OpenIDClientEdit: Invalid Client Request", errV)
+		utils.HTTPError(w, "Client Edit Error: invalid name or redirect URIs", http.StatusBadRequest, "OC002")
+		return
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "oauth2clients")
+	if errCo != nil {
+			utils.ReqLog(req).Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+	}
+
+	result, errDB := c.UpdateOne(nil, map[string]interface{}{
+		"ClientID": clientID,
+	}, map[string]interface{}{
+		"$set": map[string]interface{}{
+			"Name": utils.Sanitize(request.Name),
+			"RedirectURIs": request.RedirectURIs,
+		},
+	})
+	if errDB != nil {
+		utils.ReqLog(req).Error("OpenIDClientEdit: Error while editing client", errDB)
+		utils.HTTPError(w, "Client Edit Error", http.StatusInternalServerError, "OC001")
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		utils.ReqLog(req).Error("OpenIDClientEdit: Client not found " + clientID, nil)
+		utils.HTTPError(w, "Client not found", http.StatusNotFound, "OC004")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+	})
+}
+
+func ClientDelete(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	clientID := mux.Vars(req)["clientId"]
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "oauth2clients")
+	if errCo != nil {
+			utils.ReqLog(req).Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+	}
+
+	result, errDB := c.DeleteOne(nil, map[string]interface{}{
+		"ClientID": clientID,
+	})
+	if errDB != nil {
+		utils.ReqLog(req).Error("OpenIDClientDeletion: Error while deleting client", errDB)
+		utils.HTTPError(w, "Client Deletion Error", http.StatusInternalServerError, "OC001")
+		return
+	}
+
+	if result.DeletedCount == 0 {
+		utils.ReqLog(req).Error("OpenIDClientDeletion: Client not found " + clientID, nil)
+		utils.HTTPError(w, "Client not found", http.StatusNotFound, "OC004")
+		return
+	}
+
+	utils.ReqLog(req).Log("OpenID: client " + clientID + " deleted by " + req.Header.Get("x-cosmos-user"))
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+	})
+}
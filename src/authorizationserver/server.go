@@ -0,0 +1,217 @@
+package authorizationserver
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/user"
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/golang-jwt/jwt"
+)
+
+// Cosmos as an OpenID Connect provider: authorization code flow with PKCE,
+// tokens signed with the Ed25519 auth key
+
+const codeLifetime = time.Minute
+const tokenLifetime = time.Hour
+const maxPendingCodes = 10000
+
+const (
+	AuthorizePath = "/cosmos/api/oauth2/auth"
+	TokenPath = "/cosmos/api/oauth2/token"
+	UserInfoPath = "/cosmos/api/oauth2/userinfo"
+	JWKSPath = "/cosmos/api/jwks"
+)
+
+var SupportedScopes = []string{"openid", "profile", "email", "groups"}
+
+type authorizationCode struct {
+	clientID string
+	redirectURI string
+	nickname string
+	passwordCycle int
+	scope []string
+	nonce string
+	codeChallenge string
+	authTime time.Time
+	expires time.Time
+}
+
+var codesLock sync.Mutex
+var codes = map[string]authorizationCode{}
+
+func randomToken() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+func newAuthorizationCode(code authorizationCode) (string, error) {
+	value, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	codesLock.Lock()
+	defer codesLock.Unlock()
+
+	if len(codes) >= maxPendingCodes {
+		for key, pending := range codes {
+			if time.Now().After(pending.expires) {
+				delete(codes, key)
+			}
+		}
+		if len(codes) >= maxPendingCodes {
+			return "", errors.New("Too many pending authorization codes")
+		}
+	}
+
+	code.expires = time.Now().Add(codeLifetime)
+	codes[value] = code
+
+	return value, nil
+}
+
+// takeAuthorizationCode returns a code once, it can't be exchanged twice
+func takeAuthorizationCode(value string) (authorizationCode, bool) {
+	codesLock.Lock()
+	defer codesLock.Unlock()
+
+	code, ok := codes[value]
+	delete(codes, value)
+
+	if !ok || time.Now().After(code.expires) {
+		return authorizationCode{}, false
+	}
+
+	return code, true
+}
+
+func hasScope(scope []string, name string) bool {
+	for _, s := range scope {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// signToken signs claims with the auth key, typ tells access tokens from ID tokens
+func signToken(claims jwt.MapClaims, typ string) (string, error) {
+	jwk, err := user.GetAuthJWK()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := jwt.ParseEdPrivateKeyFromPEM([]byte(utils.GetPrivateAuthKey()))
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = jwk["kid"]
+	if typ != "" {
+		token.Header["typ"] = typ
+	}
+
+	return token.SignedString(key)
+}
+
+// userClaims are the claims of the user allowed by the scope
+func userClaims(u utils.User, scope []string) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"sub": u.Nickname,
+	}
+
+	if hasScope(scope, "profile") {
+		claims["name"] = u.Nickname
+		claims["nickname"] = u.Nickname
+		claims["preferred_username"] = u.Nickname
+		claims["role"] = utils.RoleNames[u.Role]
+	}
+
+	if hasScope(scope, "email") && u.Email != "" {
+		claims["email"] = u.Email
+	}
+
+	if hasScope(scope, "groups") {
+		groups := u.Groups
+		if groups == nil {
+			groups = []string{}
+		}
+		claims["groups"] = groups
+	}
+
+	return claims
+}
+
+// oauthError answers the token and userinfo endpoints with an RFC 6749 error
+func oauthError(w http.ResponseWriter, status int, code string, description string) {
+	utils.Error("OAuth2: " + code + ": " + description, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer error="` + code + `"`)
+	}
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": code,
+		"error_description": description,
+	})
+}
+
+// DiscoveryRoute serves /.well-known/openid-configuration
+func DiscoveryRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method == "GET") {
+		issuer := user.GetIssuer()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer": issuer,
+			"authorization_endpoint": issuer + AuthorizePath,
+			"token_endpoint": issuer + TokenPath,
+			"userinfo_endpoint": issuer + UserInfoPath,
+			"jwks_uri": issuer + JWKSPath,
+			"scopes_supported": SupportedScopes,
+			"response_types_supported": []string{"code"},
+			"response_modes_supported": []string{"query"},
+			"grant_types_supported": []string{"authorization_code"},
+			"subject_types_supported": []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"EdDSA"},
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+			"code_challenge_methods_supported": []string{"S256"},
+			"claims_supported": []string{
+				"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce",
+				"name", "nickname", "preferred_username", "email", "groups", "role",
+			},
+		})
+	} else {
+		utils.ReqLog(req).Error("OpenIDDiscovery: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func splitScope(scope string) []string {
+	scopes := []string{}
+	for _, s := range strings.Fields(scope) {
+		for _, supported := range SupportedScopes {
+			if s == supported && !hasScope(scopes, s) {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return scopes
+}
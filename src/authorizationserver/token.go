@@ -0,0 +1,150 @@
+package authorizationserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/user"
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/golang-jwt/jwt"
+)
+
+// authenticateClient reads client_secret_basic or client_secret_post credentials.
+// Public clients only send their client_id, they are checked with PKCE
+func authenticateClient(req *http.Request) (utils.OpenIDClient, bool) {
+	clientID, secret, basic := req.BasicAuth()
+	if basic {
+		// RFC 6749 form-encodes the credentials before the Basic encoding
+		if unescaped, err := url.QueryUnescape(clientID); err == nil {
+			clientID = unescaped
+		}
+		if unescaped, err := url.QueryUnescape(secret); err == nil {
+			secret = unescaped
+		}
+	} else {
+		clientID = req.PostForm.Get("client_id")
+		secret = req.PostForm.Get("client_secret")
+	}
+
+	client, err := getClient(clientID)
+	if err != nil {
+		return client, false
+	}
+
+	if client.Public {
+		return client, secret == ""
+	}
+
+	return client, secret != "" && checkSecret(client, secret)
+}
+
+func checkCodeVerifier(challenge string, verifier string) bool {
+	if challenge == "" {
+		return verifier == ""
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return len(verifier) >= 43 && len(verifier) <= 128 &&
+		subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// TokenRoute exchanges an authorization code for an ID token and an access token
+func TokenRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method != "POST") {
+		utils.ReqLog(req).Error("OAuth2Token: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "cannot read the request")
+		return
+	}
+
+	client, ok := authenticateClient(req)
+	if !ok {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+
+	if req.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	code, ok := takeAuthorizationCode(req.PostForm.Get("code"))
+	if !ok || code.clientID != client.ClientID || code.redirectURI != req.PostForm.Get("redirect_uri") {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "invalid or expired code")
+		return
+	}
+
+	if !checkCodeVerifier(code.codeChallenge, req.PostForm.Get("code_verifier")) {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "code verifier does not match")
+		return
+	}
+
+	u, err := user.GetUserByNickname(code.nickname)
+	if err != nil || u.PasswordCycle != code.passwordCycle {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "the user changed since the code was issued")
+		return
+	}
+
+	issuer := user.GetIssuer()
+	now := time.Now()
+
+	idClaims := userClaims(u, code.scope)
+	idClaims["iss"] = issuer
+	idClaims["aud"] = client.ClientID
+	idClaims["azp"] = client.ClientID
+	idClaims["exp"] = now.Add(tokenLifetime).Unix()
+	idClaims["iat"] = now.Unix()
+	idClaims["auth_time"] = code.authTime.Unix()
+	if code.nonce != "" {
+		idClaims["nonce"] = code.nonce
+	}
+
+	idToken, err := signToken(idClaims, "")
+	if err != nil {
+		utils.ReqLog(req).Error("OAuth2Token: Error while signing ID token", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "cannot sign the token")
+		return
+	}
+
+	accessToken, err := signToken(jwt.MapClaims{
+		"iss": issuer,
+		"sub": u.Nickname,
+		"aud": client.ClientID,
+		"client_id": client.ClientID,
+		"scope": strings.Join(code.scope, " "),
+		"passwordCycle": u.PasswordCycle,
+		"exp": now.Add(tokenLifetime).Unix(),
+		"iat": now.Unix(),
+	}, "at+jwt")
+	if err != nil {
+		utils.ReqLog(req).Error("OAuth2Token: Error while signing access token", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "cannot sign the token")
+		return
+	}
+
+	utils.ReqLog(req).Debug("OAuth2Token: tokens issued to " + client.Name + " for " + u.Nickname)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type": "Bearer",
+		"expires_in": int(tokenLifetime.Seconds()),
+		"id_token": idToken,
+		"scope": strings.Join(code.scope, " "),
+	})
+}
@@ -0,0 +1,80 @@
+package authorizationserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/azukaar/cosmos-server/src/user"
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/golang-jwt/jwt"
+)
+
+// parseAccessToken checks an access token minted by TokenRoute. The at+jwt
+// type keeps ID tokens and app tokens, signed with the same key, from being used
+func parseAccessToken(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, errors.New("Unexpected signing method")
+		}
+		return jwt.ParseEdPublicKeyFromPEM([]byte(utils.GetPublicAuthKey()))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if typ, _ := token.Header["typ"].(string); typ != "at+jwt" {
+		return nil, errors.New("Not an access token")
+	}
+
+	if !claims.VerifyIssuer(user.GetIssuer(), true) {
+		return nil, errors.New("Token of another issuer")
+	}
+
+	return claims, nil
+}
+
+// UserInfoRoute returns the claims of the user allowed by the scope of the access token
+func UserInfoRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET" && req.Method != "POST") {
+		utils.ReqLog(req).Error("OAuth2UserInfo: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+
+	tokenString := ""
+	if authorization := req.Header.Get("Authorization"); len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		tokenString = strings.TrimSpace(authorization[7:])
+	} else if req.Method == "POST" {
+		tokenString = req.PostFormValue("access_token")
+	}
+
+	if tokenString == "" {
+		oauthError(w, http.StatusUnauthorized, "invalid_token", "missing access token")
+		return
+	}
+
+	claims, err := parseAccessToken(tokenString)
+	if err != nil {
+		oauthError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+		return
+	}
+
+	nickname, _ := claims["sub"].(string)
+	passwordCycle, _ := claims["passwordCycle"].(float64)
+	scope, _ := claims["scope"].(string)
+
+	u, err := user.GetUserByNickname(nickname)
+	if err != nil || u.PasswordCycle != int(passwordCycle) {
+		oauthError(w, http.StatusUnauthorized, "invalid_token", "the user changed since the token was issued")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	json.NewEncoder(w).Encode(userClaims(u, strings.Fields(scope)))
+}
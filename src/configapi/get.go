@@ -23,7 +23,7 @@ func ConfigApiGet(w http.ResponseWriter, req *http.Request) {
 			"data": config,
 		})
 	} else {
-		utils.Error("SettingGet: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("SettingGet: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -3,7 +3,6 @@ package configapi
 import (
 	"encoding/json"
 	"net/http"
-	"sync"
 
 	"github.com/azukaar/cosmos-server/src/utils"
 )
@@ -14,20 +13,18 @@ type UpdateRouteRequest struct {
 	NewRoute  *utils.ProxyRouteConfig `json:"newRoute,omitempty"`
 }
 
-var configLock sync.Mutex
-
 func ConfigApiPatch(w http.ResponseWriter, req *http.Request) {
 	if utils.AdminOnly(w, req) != nil {
 		return
 	}
 
-	configLock.Lock()
-	defer configLock.Unlock()
+	utils.ConfigUpdateLock.Lock()
+	defer utils.ConfigUpdateLock.Unlock()
 
 	var updateReq UpdateRouteRequest
 	err := json.NewDecoder(req.Body).Decode(&updateReq)
 	if err != nil {
-		utils.Error("SettingsUpdate: Invalid Update Request", err)
+		utils.ReqLog(req).Error("SettingsUpdate: Invalid Update Request", err)
 		utils.HTTPError(w, "Invalid Update Request", http.StatusBadRequest, "UR001")
 		return
 	}
@@ -38,7 +35,7 @@ func ConfigApiPatch(w http.ResponseWriter, req *http.Request) {
 
 	if updateReq.Operation != "add" {
 		if updateReq.RouteName == "" {
-			utils.Error("SettingsUpdate: RouteName must be provided", nil)
+			utils.ReqLog(req).Error("SettingsUpdate: RouteName must be provided", nil)
 			utils.HTTPError(w, "RouteName must be provided", http.StatusBadRequest, "UR002")
 			return
 		}
@@ -51,7 +48,7 @@ func ConfigApiPatch(w http.ResponseWriter, req *http.Request) {
 		}
 	
 		if routeIndex == -1 {
-			utils.Error("SettingsUpdate: Route not found: "+updateReq.RouteName, nil)
+			utils.ReqLog(req).Error("SettingsUpdate: Route not found: "+updateReq.RouteName, nil)
 			utils.HTTPError(w, "Route not found", http.StatusNotFound, "UR002")
 			return
 		}
@@ -60,7 +57,7 @@ func ConfigApiPatch(w http.ResponseWriter, req *http.Request) {
 	switch updateReq.Operation {
 		case "replace":
 			if updateReq.NewRoute == nil {
-				utils.Error("SettingsUpdate: NewRoute must be provided for replace operation", nil)
+				utils.ReqLog(req).Error("SettingsUpdate: NewRoute must be provided for replace operation", nil)
 				utils.HTTPError(w, "NewRoute must be provided for replace operation", http.StatusBadRequest, "UR003")
 				return
 			}
@@ -77,20 +74,20 @@ func ConfigApiPatch(w http.ResponseWriter, req *http.Request) {
 			routes = append(routes[:routeIndex], routes[routeIndex+1:]...)
 		case "add":
 			if updateReq.NewRoute == nil {
-				utils.Error("SettingsUpdate: NewRoute must be provided for add operation", nil)
+				utils.ReqLog(req).Error("SettingsUpdate: NewRoute must be provided for add operation", nil)
 				utils.HTTPError(w, "NewRoute must be provided for add operation", http.StatusBadRequest, "UR003")
 				return
 			}
 			routes = append([]utils.ProxyRouteConfig{*updateReq.NewRoute}, routes...)
 		default:
-			utils.Error("SettingsUpdate: Unsupported operation: "+updateReq.Operation, nil)
+			utils.ReqLog(req).Error("SettingsUpdate: Unsupported operation: "+updateReq.Operation, nil)
 			utils.HTTPError(w, "Unsupported operation", http.StatusBadRequest, "UR004")
 			return
 		}
 
 	config.HTTPConfig.ProxyConfig.Routes = routes
 	utils.SaveConfigTofile(config)
-	utils.NeedsRestart = true
+	applyRoutes(config)
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status": "OK",
@@ -0,0 +1,35 @@
+package configapi
+
+import (
+	"reflect"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// applyRoutes loads the routes and shield settings of a freshly saved config
+// in memory and swaps the router, so route edits no longer need a restart.
+// The caller holds utils.ConfigUpdateLock
+func applyRoutes(config utils.Config) {
+	hostnames := utils.GetAllHostnames()
+
+	baseConfig := utils.GetBaseMainConfig()
+	baseConfig.HTTPConfig.ProxyConfig = config.HTTPConfig.ProxyConfig
+	baseConfig.SmartShieldConfig = config.SmartShieldConfig
+	utils.LoadBaseMainConfig(baseConfig)
+
+	// Let's Encrypt only requests certificates for new hostnames at startup
+	if utils.GetMainConfig().HTTPConfig.HTTPSCertificateMode == utils.HTTPSCertModeList["LETSENCRYPT"] &&
+		 !reflect.DeepEqual(hostnames, utils.GetAllHostnames()) {
+		utils.NeedsRestart = true
+	}
+
+	utils.ReloadRoutes()
+}
+
+// onlyRoutesChanged returns true if the two configs only differ by
+// what applyRoutes can reload
+func onlyRoutesChanged(oldConfig utils.Config, newConfig utils.Config) bool {
+	newConfig.HTTPConfig.ProxyConfig = oldConfig.HTTPConfig.ProxyConfig
+	newConfig.SmartShieldConfig = oldConfig.SmartShieldConfig
+	return reflect.DeepEqual(oldConfig, newConfig)
+}
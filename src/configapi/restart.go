@@ -17,7 +17,7 @@ func ConfigApiRestart(w http.ResponseWriter, req *http.Request) {
 		})
 		utils.RestartServer()
 	} else {
-		utils.Error("Restart: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("Restart: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -13,7 +13,7 @@ func ConfigRoute(w http.ResponseWriter, req *http.Request) {
 	}  else if (req.Method == "PATCH") {
 		ConfigApiPatch(w, req)
 	} else {
-		utils.Error("UserRoute: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserRoute: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -15,7 +15,7 @@ func ConfigApiSet(w http.ResponseWriter, req *http.Request) {
 		var request utils.Config
 		err1 := json.NewDecoder(req.Body).Decode(&request)
 		if err1 != nil {
-			utils.Error("SettingsUpdate: Invalid User Request", err1)
+			utils.ReqLog(req).Error("SettingsUpdate: Invalid User Request", err1)
 			utils.HTTPError(w, "User Creation Error", 
 				http.StatusInternalServerError, "UC001")
 			return 
@@ -23,12 +23,15 @@ func ConfigApiSet(w http.ResponseWriter, req *http.Request) {
 
 		errV := utils.Validate.Struct(request)
 		if errV != nil {
-			utils.Error("SettingsUpdate: Invalid User Request", errV)
+			utils.ReqLog(req).Error("SettingsUpdate: Invalid User Request", errV)
 			utils.HTTPError(w, "User Creation Error: " + errV.Error(),
 				http.StatusInternalServerError, "UC003")
 			return 
 		}
 
+		utils.ConfigUpdateLock.Lock()
+		defer utils.ConfigUpdateLock.Unlock()
+
 		// restore AuthPrivateKey and TLSKey
 		config := utils.ReadConfigFromFile()
 		request.HTTPConfig.AuthPrivateKey = config.HTTPConfig.AuthPrivateKey
@@ -36,13 +39,18 @@ func ConfigApiSet(w http.ResponseWriter, req *http.Request) {
 		request.NewInstall = config.NewInstall
 
 		utils.SaveConfigTofile(request)
-		utils.NeedsRestart = true
+
+		if !onlyRoutesChanged(config, request) {
+			utils.NeedsRestart = true
+		}
+
+		applyRoutes(request)
 
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "OK",
 		})
 	} else {
-		utils.Error("SettingsUpdate: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("SettingsUpdate: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
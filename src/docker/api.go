@@ -9,7 +9,7 @@ func ContainersIdRoute(w http.ResponseWriter, req *http.Request) {
 	if (req.Method == "GET") {
 		// ContainerGet(w, req)
 	} else {
-		utils.Error("UserRoute: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserRoute: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -21,7 +21,7 @@ func ContainersRoute(w http.ResponseWriter, req *http.Request) {
 	} else if (req.Method == "GET") {
 		ListContainersRoute(w, req)
 	} else {
-		utils.Error("UserRoute: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserRoute: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -26,7 +26,7 @@ func ListContainersRoute(w http.ResponseWriter, req *http.Request) {
 		containers, err := ListContainers()
 
 		if err != nil {
-			utils.Error("ListContainersRoute: Error while getting containers", err)
+			utils.ReqLog(req).Error("ListContainersRoute: Error while getting containers", err)
 			utils.HTTPError(w, "Containers Get Error", http.StatusInternalServerError, "DL001")
 			return	
 		}
@@ -36,7 +36,7 @@ func ListContainersRoute(w http.ResponseWriter, req *http.Request) {
 			"data": containers,
 		})
 	} else {
-		utils.Error("UserList: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserList: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -3,17 +3,10 @@ package docker
 import (
 	"net/http"
 	"encoding/json"
-	"time"
-	"os"
 
 	"github.com/azukaar/cosmos-server/src/utils" 
 )
 
-func restart() {
-	time.Sleep(3 * time.Second)
-	os.Exit(0)
-}
-
 func NewDBRoute(w http.ResponseWriter, req *http.Request) {
 	if utils.AdminOnly(w, req) != nil {
 		return
@@ -23,22 +16,24 @@ func NewDBRoute(w http.ResponseWriter, req *http.Request) {
 		costr, err := NewDB()
 
 		if err != nil {
-			utils.Error("NewDB: Error while creating new DB", err)
+			utils.ReqLog(req).Error("NewDB: Error while creating new DB", err)
 			utils.HTTPError(w, "Error while creating new DB", http.StatusInternalServerError, "DB001")
 			return
 		}
 
+		utils.ConfigUpdateLock.Lock()
 		config := utils.GetBaseMainConfig()
 		config.MongoDB = costr
 		utils.SaveConfigTofile(config)
+		utils.ConfigUpdateLock.Unlock()
 		
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "OK",
 		})
 
-		go restart()
+		utils.RestartServer()
 	} else {
-		utils.Error("UserList: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserList: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
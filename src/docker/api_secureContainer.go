@@ -21,7 +21,7 @@ func SecureContainerRoute(w http.ResponseWriter, req *http.Request) {
 	if(req.Method == "GET") {
 		container, err := DockerClient.ContainerInspect(DockerContext, containerName)
 		if err != nil {
-			utils.Error("ContainerSecureInscpect", err)
+			utils.ReqLog(req).Error("ContainerSecureInscpect", err)
 			utils.HTTPError(w, "Internal server error: " + err.Error(), http.StatusInternalServerError, "DS002")
 			return
 		}
@@ -30,11 +30,11 @@ func SecureContainerRoute(w http.ResponseWriter, req *http.Request) {
 			"cosmos-force-network-secured": status,
 		});
 
-		utils.Log("API: Set Force network secured "+status+" : " + containerName)
+		utils.ReqLog(req).Log("API: Set Force network secured "+status+" : " + containerName)
 
 		_, errEdit := EditContainer(container.ID, container)
 		if errEdit != nil {
-			utils.Error("ContainerSecureEdit", errEdit)
+			utils.ReqLog(req).Error("ContainerSecureEdit", errEdit)
 			utils.HTTPError(w, "Internal server error: " + err.Error(), http.StatusInternalServerError, "DS003")
 			return
 		}
@@ -43,7 +43,7 @@ func SecureContainerRoute(w http.ResponseWriter, req *http.Request) {
 			"status": "OK",
 		})
 	} else {
-		utils.Error("UserList: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserList: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
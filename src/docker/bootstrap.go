@@ -6,6 +6,9 @@ import (
 	"os"
 )
 
+var metricBootstraps = utils.NewCounter("cosmos_docker_bootstrap_total",
+	"Containers bootstrapped from their cosmos labels, by result", "result")
+
 func BootstrapAllContainersFromTags() []error {
 	errD := Connect()
 	if errD != nil {
@@ -32,6 +35,16 @@ func BootstrapAllContainersFromTags() []error {
 }
 
 func BootstrapContainerFromTags(containerID string) error {
+	err := bootstrapContainerFromTags(containerID)
+	if err != nil {
+		metricBootstraps.Inc("error")
+	} else {
+		metricBootstraps.Inc("success")
+	}
+	return err
+}
+
+func bootstrapContainerFromTags(containerID string) error {
 	errD := Connect()
 	if errD != nil {
 		return errD
@@ -3,6 +3,7 @@ package docker
 import (
 	"context"
 	"errors"
+	"strings"
 	"time"
 	"github.com/azukaar/cosmos-server/src/utils" 
 
@@ -10,6 +11,7 @@ import (
 	// natting "github.com/docker/go-connections/nat"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 )
 
 var DockerClient *client.Client
@@ -79,7 +81,20 @@ func Connect() error {
 	return nil
 }
 
+var metricRecreations = utils.NewCounter("cosmos_docker_container_recreations_total",
+	"Containers recreated by EditContainer, by result", "result")
+
 func EditContainer(containerID string, newConfig types.ContainerJSON) (string, error) {
+	id, err := editContainer(containerID, newConfig)
+	if err != nil {
+		metricRecreations.Inc("error")
+	} else {
+		metricRecreations.Inc("success")
+	}
+	return id, err
+}
+
+func editContainer(containerID string, newConfig types.ContainerJSON) (string, error) {
 	DockerNetworkLock <- true
 	defer func() { 
 		<-DockerNetworkLock 
@@ -177,6 +192,30 @@ func EditContainer(containerID string, newConfig types.ContainerJSON) (string, e
 	return createResponse.ID, nil
 }
 
+// ListContainerNamesByLabel returns the names of the running containers with the label (key or key=value)
+func ListContainerNamesByLabel(label string) ([]string, error) {
+	errD := Connect()
+	if errD != nil {
+		return nil, errD
+	}
+
+	containers, err := DockerClient.ContainerList(DockerContext, types.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", label)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, container := range containers {
+		if len(container.Names) > 0 {
+			names = append(names, strings.TrimPrefix(container.Names[0], "/"))
+		}
+	}
+
+	return names, nil
+}
+
 func ListContainers() ([]types.Container, error) {
 	errD := Connect()
 	if errD != nil {
@@ -8,20 +8,29 @@ import (
 	"github.com/docker/docker/api/types"
 )
 
+var stopListeningEvents context.CancelFunc
+
 func DockerListenEvents() error {
 	errD := Connect()
 	if errD != nil {
 		utils.Error("Docker did not connect. Not listening", errD)
 		return errD
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopListeningEvents = cancel
 	
 	go func() {
-		msgs, errs := DockerClient.Events(context.Background(), types.EventsOptions{})
+		msgs, errs := DockerClient.Events(ctx, types.EventsOptions{})
 
 		for {
 			select {
+				case <-ctx.Done():
+					utils.Log("Docker: Stopped listening to events")
+					return
+
 				case err := <-errs:
-					if err == nil {
+					if err == nil || ctx.Err() != nil {
 						return
 					}
 					utils.Error("Docker Event Error", err)
@@ -30,7 +39,7 @@ func DockerListenEvents() error {
 					if errD != nil {
 						utils.Fatal("Docker connection died, couldn't recover... Restarting", errD)
 					}
-					msgs, errs = DockerClient.Events(context.Background(), types.EventsOptions{})
+					msgs, errs = DockerClient.Events(ctx, types.EventsOptions{})
 
 				case msg := <-msgs:
 					utils.Debug("Docker Event: " + msg.Type + " " + msg.Action + " " + msg.Actor.ID)
@@ -51,6 +60,12 @@ func DockerListenEvents() error {
 	return nil
 }
 
+func StopListeningEvents() {
+	if stopListeningEvents != nil {
+		stopListeningEvents()
+	}
+}
+
 func onDockerCreated(containerID string) {
 	utils.Debug("onDockerCreated: " + containerID)
 	BootstrapContainerFromTags(containerID)
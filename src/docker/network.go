@@ -244,10 +244,17 @@ func _debounceNetworkCleanUp() func(string) {
 
 var DebouncedNetworkCleanUp = _debounceNetworkCleanUp()
 
+var metricNetworkCleanUps = utils.NewCounter("cosmos_docker_network_cleanups_total",
+	"Runs of the orphan network clean up")
+var metricNetworksRemoved = utils.NewCounter("cosmos_docker_networks_removed_total",
+	"Orphan and zombie networks removed by the clean up")
+
 func NetworkCleanUp() {
 	DockerNetworkLock <- true
 	defer func() { <-DockerNetworkLock }()
 
+	metricNetworkCleanUps.Inc()
+
 	config := utils.GetMainConfig()
 	
 	utils.Log("Cleaning up orphan networks...")
@@ -290,6 +297,8 @@ func NetworkCleanUp() {
 			err := DockerClient.NetworkRemove(DockerContext, network.ID)
 			if err != nil {
 				utils.Error("DockerNetworkCleanupRemove", err)
+			} else {
+				metricNetworksRemoved.Inc()
 			}
 			continue
 		}
@@ -320,6 +329,8 @@ func NetworkCleanUp() {
 			err = DockerClient.NetworkRemove(DockerContext, network.ID)
 			if err != nil {
 				utils.Error("DockerNetworkCleanupRemove", err)
+			} else {
+				metricNetworksRemoved.Inc()
 			}
 		}
 	}
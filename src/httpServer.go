@@ -1,9 +1,11 @@
 package main
 
 import (
+    "net"
     "net/http"
 		"github.com/azukaar/cosmos-server/src/utils"
 		"github.com/azukaar/cosmos-server/src/user"
+		"github.com/azukaar/cosmos-server/src/authorizationserver"
 		"github.com/azukaar/cosmos-server/src/configapi"
 		"github.com/azukaar/cosmos-server/src/proxy"
 		"github.com/azukaar/cosmos-server/src/docker"
@@ -12,28 +14,73 @@ import (
 		"time"
 		"os"
 		"strings"
-		"github.com/go-chi/chi/middleware"
 		"github.com/go-chi/httprate"
 		"crypto/tls"
 		spa "github.com/roberthodgen/spa-server"
 		"github.com/foomo/simplecert"
 		"github.com/foomo/tlsconfig"
+		"github.com/pires/go-proxyproto"
 )
 
 var serverPortHTTP = ""
 var serverPortHTTPS = ""
 
-func startHTTPServer(router *mux.Router) {
+var HTTPRouter = &proxy.HotRouter{}
+
+// HTTPServer is either the main server or the HTTP to HTTPS redirection
+var HTTPServer *http.Server
+var HTTPSServer *http.Server
+
+// listen opens a TCP listener, which reads the PROXY protocol header of
+// connections coming from trusted proxies when HTTPConfig.ProxyProtocol is set
+func listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !utils.GetMainConfig().HTTPConfig.ProxyProtocol {
+		return listener, nil
+	}
+
+	utils.Log("Accepting PROXY protocol on " + addr)
+
+	return &proxyproto.Listener{
+		Listener: listener,
+		ReadHeaderTimeout: 10 * time.Second,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			ip, _, err := net.SplitHostPort(upstream.String())
+			if err == nil && utils.IsTrustedProxy(ip) {
+				return proxyproto.USE, nil
+			}
+			return proxyproto.REJECT, nil
+		},
+	}, nil
+}
+
+func startHTTPServer(router http.Handler) {
 	utils.Log("Listening to HTTP on :" + serverPortHTTP)
 
-	err := http.ListenAndServe("0.0.0.0:" + serverPortHTTP, router)
+	HTTPServer = &http.Server{
+		Addr: "0.0.0.0:" + serverPortHTTP,
+		Handler: router,
+	}
 
+	listener, err := listen(HTTPServer.Addr)
 	if err != nil {
 		utils.Fatal("Listening to HTTP", err)
 	}
+
+	go (func () {
+		err := HTTPServer.Serve(listener)
+
+		if err != nil && err != http.ErrServerClosed {
+			utils.Fatal("Listening to HTTP", err)
+		}
+	})()
 }
 
-func startHTTPSServer(router *mux.Router, tlsCert string, tlsKey string) {
+func startHTTPSServer(router http.Handler, tlsCert string, tlsKey string) {
 	config  := utils.GetMainConfig()
 	serverHostname := "0.0.0.0"
 
@@ -59,9 +106,9 @@ func startHTTPSServer(router *mux.Router, tlsCert string, tlsKey string) {
 	}
 		
 	// redirect http to https
-	go (func () {
-		// err := http.ListenAndServe("0.0.0.0:" + serverPortHTTP, http.HandlerFunc(simplecert.Redirect))
-		err := http.ListenAndServe("0.0.0.0:" + serverPortHTTP, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	HTTPServer = &http.Server{
+		Addr: "0.0.0.0:" + serverPortHTTP,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// change port in host
 			if strings.HasSuffix(r.Host, ":" + serverPortHTTP) {
 				if serverPortHTTPS != "443" {
@@ -72,9 +119,19 @@ func startHTTPSServer(router *mux.Router, tlsCert string, tlsKey string) {
 			}
 			
 			http.Redirect(w, r, "https://"+r.Host+r.URL.String(), http.StatusMovedPermanently)
-		}))
+		}),
+	}
+
+	listener, err := listen(HTTPServer.Addr)
+	if err != nil {
+		utils.Fatal("Listening to HTTP (Redirecting to HTTPS)", err)
+	}
+
+	go (func () {
+		// err := http.ListenAndServe("0.0.0.0:" + serverPortHTTP, http.HandlerFunc(simplecert.Redirect))
+		err := HTTPServer.Serve(listener)
 		
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			utils.Fatal("Listening to HTTP (Redirecting to HTTPS)", err)
 		}
 	})()
@@ -97,7 +154,7 @@ func startHTTPSServer(router *mux.Router, tlsCert string, tlsKey string) {
 		tlsConf.Certificates = []tls.Certificate{cert}
 	}
 	
-	server := http.Server{
+	HTTPSServer = &http.Server{
 		TLSConfig: tlsConf,
 		Addr: serverHostname + ":" + serverPortHTTPS,
 		ReadTimeout: 0,
@@ -108,12 +165,19 @@ func startHTTPSServer(router *mux.Router, tlsCert string, tlsKey string) {
 		DisableGeneralOptionsHandler: true,
 	}
 
+	tlsListener, err := listen(HTTPSServer.Addr)
+	if err != nil {
+		utils.Fatal("Listening to HTTPS", err)
+	}
+
 	// start https server
-	errServ := server.ListenAndServeTLS("", "")
+	go (func () {
+		errServ := HTTPSServer.ServeTLS(tlsListener, "", "")
 
-	if errServ != nil {
-		utils.Fatal("Listening to HTTPS", errServ)
-	}
+		if errServ != nil && errServ != http.ErrServerClosed {
+			utils.Fatal("Listening to HTTPS", errServ)
+		}
+	})()
 }
 
 func tokenMiddleware(next http.Handler) http.Handler {
@@ -121,6 +185,7 @@ func tokenMiddleware(next http.Handler) http.Handler {
 		//Header.Del
 		r.Header.Set("x-cosmos-user", "")
 		r.Header.Set("x-cosmos-role", "")
+		r.Header.Del("x-cosmos-groups")
 
 		u, err := user.RefreshUserToken(w, r)
 
@@ -130,13 +195,15 @@ func tokenMiddleware(next http.Handler) http.Handler {
 
 		r.Header.Set("x-cosmos-user", u.Nickname)
 		r.Header.Set("x-cosmos-role", strconv.Itoa((int)(u.Role)))
+		if len(u.Groups) > 0 {
+			r.Header.Set("x-cosmos-groups", strings.Join(u.Groups, ","))
+		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
 func StartServer() {
-	baseMainConfig := utils.GetBaseMainConfig()
 	config := utils.GetMainConfig().HTTPConfig
 	serverPortHTTP = config.HTTPPort
 	serverPortHTTPS = config.HTTPSPort
@@ -148,9 +215,10 @@ func StartServer() {
 		utils.Log("Generating new TLS certificate")
 		pub, priv := utils.GenerateRSAWebCertificates()
 		
-		baseMainConfig.HTTPConfig.TLSCert = pub
-		baseMainConfig.HTTPConfig.TLSKey = priv
-		utils.SetBaseMainConfig(baseMainConfig)
+		utils.UpdateBaseMainConfig(func(baseMainConfig *utils.Config) {
+			baseMainConfig.HTTPConfig.TLSCert = pub
+			baseMainConfig.HTTPConfig.TLSKey = priv
+		})
 
 		utils.Log("Saved new TLS certificate")
 
@@ -162,21 +230,85 @@ func StartServer() {
 		utils.Log("Generating new Auth ED25519 certificate")
 		pub, priv := utils.GenerateEd25519Certificates()
 		
-		baseMainConfig.HTTPConfig.AuthPublicKey = pub
-		baseMainConfig.HTTPConfig.AuthPrivateKey = priv
-		utils.SetBaseMainConfig(baseMainConfig)
+		utils.UpdateBaseMainConfig(func(baseMainConfig *utils.Config) {
+			baseMainConfig.HTTPConfig.AuthPublicKey = pub
+			baseMainConfig.HTTPConfig.AuthPrivateKey = priv
+		})
 
 		utils.Log("Saved new Auth ED25519 certificate")
 	}
 
+	pwd,_ := os.Getwd()
+	utils.Log("Starting in " + pwd)
+	if _, err := os.Stat(pwd + "/static"); os.IsNotExist(err) {
+		utils.Fatal("Static folder not found at " + pwd + "/static", err)
+	}
+
+	HTTPRouter.Swap(buildRouter())
+	utils.ReloadRoutesHandler = reloadRouter
+
+	if ((config.HTTPSCertificateMode == utils.HTTPSCertModeList["SELFSIGNED"] || config.HTTPSCertificateMode == utils.HTTPSCertModeList["PROVIDED"]) &&
+			 tlsCert != "" && tlsKey != "") || (config.HTTPSCertificateMode == utils.HTTPSCertModeList["LETSENCRYPT"]) {
+		utils.Log("TLS certificate exist, starting HTTPS servers and redirecting HTTP to HTTPS")
+		startHTTPSServer(HTTPRouter, tlsCert, tlsKey)
+	} else {
+		utils.Log("TLS certificates do not exists or are disabled, starting HTTP server only")
+		startHTTPServer(HTTPRouter)
+	}
+}
+
+// reloadRouter rebuilds every route from the current config and swaps it
+// behind the running servers, without dropping open connections
+func reloadRouter() {
+	HTTPRouter.Swap(buildRouter())
+	utils.Log("Router reloaded")
+}
+
+// useAPIMiddlewares puts the API behind the SmartShield and its rate limit
+func useAPIMiddlewares(r *mux.Router) {
+	r.Use(utils.MetricsMiddleware("cosmos"))
+	r.Use(tokenMiddleware)
+	r.Use(proxy.SmartShieldMiddleware(
+		utils.SmartShieldPolicy{
+			Enabled: true,
+		},
+	))
+	r.Use(utils.MiddlewareTimeout(20 * time.Second))
+	r.Use(httprate.Limit(60, 1*time.Minute, 
+		httprate.WithKeyFuncs(proxy.KeyByClientID),
+    httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
+			utils.ReqLog(r).Error("Too many requests. Throttling", nil)
+			utils.MetricHTTPThrottled.Inc(utils.GetRouteName(r))
+			utils.HTTPError(w, "Too many requests", 
+				http.StatusTooManyRequests, "HTTP003")
+			return 
+		}),
+	))
+}
+
+func buildRouter() *mux.Router {
+	config := utils.GetMainConfig().HTTPConfig
+
 	router := mux.NewRouter().StrictSlash(true)
 
 	// need rewrite bc it catches too many things and prevent
 	// client to be notified of the error
 	// router.Use(middleware.Recoverer)
-	router.Use(middleware.Logger)
+	router.Use(utils.RequestIDMiddleware)
+	router.Use(utils.LogRequests)
 	router.Use(utils.SetSecurityHeaders)
 	
+	// called by other reverse proxies on every request, so it is kept out of the API rate limits
+	router.Handle("/cosmos/api/auth", utils.MetricsMiddleware("cosmos-auth")(
+		tokenMiddleware(http.HandlerFunc(proxy.ForwardAuthRoute))))
+
+	// OpenID Connect provider, the backends exchange codes and read the user info server to server
+	router.Host(config.Hostname).Path("/.well-known/openid-configuration").HandlerFunc(authorizationserver.DiscoveryRoute)
+	sroauth := router.NewRoute().Subrouter()
+	sroauth.HandleFunc(authorizationserver.TokenPath, authorizationserver.TokenRoute)
+	sroauth.HandleFunc(authorizationserver.UserInfoPath, authorizationserver.UserInfoRoute)
+	useAPIMiddlewares(sroauth)
+
 	srapi := router.PathPrefix("/cosmos").Subrouter()
 
 	srapi.HandleFunc("/api/status", StatusRoute)
@@ -184,44 +316,56 @@ func StartServer() {
 	srapi.HandleFunc("/api/ping", PingURL)
 	srapi.HandleFunc("/api/newInstall", NewInstallRoute)
 	srapi.HandleFunc("/api/login", user.UserLogin)
+	srapi.HandleFunc("/api/mfa/login", user.MFALoginRoute)
+	srapi.HandleFunc("/api/mfa", user.MFARoute)
+	srapi.HandleFunc("/api/webauthn/register/begin", user.WebAuthnRegisterBeginRoute)
+	srapi.HandleFunc("/api/webauthn/register/finish", user.WebAuthnRegisterFinishRoute)
+	srapi.HandleFunc("/api/webauthn/login/begin", user.WebAuthnLoginBeginRoute)
+	srapi.HandleFunc("/api/webauthn/login/finish", user.WebAuthnLoginFinishRoute)
+	srapi.HandleFunc("/api/webauthn/credentials/{id}", user.WebAuthnCredentialIdRoute)
+	srapi.HandleFunc("/api/webauthn/credentials", user.WebAuthnCredentialsRoute)
+	srapi.HandleFunc("/api/oidc/providers", user.OpenIDProvidersRoute)
+	srapi.HandleFunc("/api/oidc/{provider}/login", user.OpenIDLoginRoute)
+	srapi.HandleFunc("/api/oidc/{provider}/callback", user.OpenIDCallbackRoute)
 	srapi.HandleFunc("/api/logout", user.UserLogout)
 	srapi.HandleFunc("/api/register", user.UserRegister)
 	srapi.HandleFunc("/api/invite", user.UserResendInviteLink)
 	srapi.HandleFunc("/api/me", user.Me)
 	srapi.HandleFunc("/api/config", configapi.ConfigRoute)
 	srapi.HandleFunc("/api/restart", configapi.ConfigApiRestart)
-
+	srapi.HandleFunc("/api/metrics", MetricsRoute)
+	srapi.HandleFunc("/api/logs/access", proxy.AccessLogRoute)
+	srapi.HandleFunc("/api/routes/health", proxy.RoutesHealthRoute)
+	srapi.HandleFunc("/api/cache/purge", proxy.CachePurgeRoute)
+	srapi.HandleFunc("/api/jwks", user.JWKSRoute)
+
+	srapi.HandleFunc("/api/users/{nickname}/mfa", user.MFAResetRoute)
+	srapi.HandleFunc("/api/users/{nickname}/sessions/{id}", user.SessionsIdRoute)
+	srapi.HandleFunc("/api/users/{nickname}/sessions", user.SessionsRoute)
+	srapi.HandleFunc("/api/sessions/{id}", user.SessionsIdRoute)
+	srapi.HandleFunc("/api/sessions", user.SessionsRoute)
 	srapi.HandleFunc("/api/users/{nickname}", user.UsersIdRoute)
 	srapi.HandleFunc("/api/users", user.UsersRoute)
+	srapi.HandleFunc("/api/groups/{name}", user.GroupsIdRoute)
+	srapi.HandleFunc("/api/groups", user.GroupsRoute)
+	srapi.HandleFunc("/api/oauth2/auth", authorizationserver.AuthorizeRoute)
+	srapi.HandleFunc("/api/oauth2/clients/{clientId}", authorizationserver.ClientsIdRoute)
+	srapi.HandleFunc("/api/oauth2/clients", authorizationserver.ClientsRoute)
+	
+	srapi.HandleFunc("/api/shield/clients", proxy.ShieldClientsRoute)
+	srapi.HandleFunc("/api/shield/bans/{clientId}", proxy.ShieldBanIdRoute)
+	srapi.HandleFunc("/api/shield/bans", proxy.ShieldBansRoute)
 	
 	srapi.HandleFunc("/api/servapps/{containerId}/secure/{status}", docker.SecureContainerRoute)
 	srapi.HandleFunc("/api/servapps", docker.ContainersRoute)
 
-	srapi.Use(tokenMiddleware)
-	srapi.Use(proxy.SmartShieldMiddleware(
-		utils.SmartShieldPolicy{
-			Enabled: true,
-		},
-	))
-	srapi.Use(utils.MiddlewareTimeout(20 * time.Second))
-	srapi.Use(httprate.Limit(60, 1*time.Minute, 
-		httprate.WithKeyFuncs(httprate.KeyByIP),
-    httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
-			utils.Error("Too many requests. Throttling", nil)
-			utils.HTTPError(w, "Too many requests", 
-				http.StatusTooManyRequests, "HTTP003")
-			return 
-		}),
-	))
+	useAPIMiddlewares(srapi)
 	
 	pwd,_ := os.Getwd()
-	utils.Log("Starting in " + pwd)
-	if _, err := os.Stat(pwd + "/static"); os.IsNotExist(err) {
-		utils.Fatal("Static folder not found at " + pwd + "/static", err)
-	}
-
 	fs  := spa.SpaHandler(pwd + "/static", "index.html")
-	router.PathPrefix("/ui").Handler(http.StripPrefix("/ui", fs))
+	router.PathPrefix("/ui").Handler(utils.CompressionMiddleware(utils.CompressionConfig{
+		Enabled: true,
+	})(http.StripPrefix("/ui", fs)))
 
 	router = proxy.BuildFromConfig(router, config.ProxyConfig)
 	
@@ -229,12 +373,5 @@ func StartServer() {
     http.Redirect(w, r, "/ui", http.StatusMovedPermanently)
 	}))
 
-	if ((config.HTTPSCertificateMode == utils.HTTPSCertModeList["SELFSIGNED"] || config.HTTPSCertificateMode == utils.HTTPSCertModeList["PROVIDED"]) &&
-			 tlsCert != "" && tlsKey != "") || (config.HTTPSCertificateMode == utils.HTTPSCertModeList["LETSENCRYPT"]) {
-		utils.Log("TLS certificate exist, starting HTTPS servers and redirecting HTTP to HTTPS")
-		startHTTPSServer(router, tlsCert, tlsKey)
-	} else {
-		utils.Log("TLS certificates do not exists or are disabled, starting HTTP server only")
-		startHTTPServer(router)
-	}
+	return router
 }
@@ -58,33 +58,33 @@ func GetFavicon(w http.ResponseWriter, req *http.Request) {
 	// URL decode
 	siteurl, err := url.QueryUnescape(escsiteurl)
 	if err != nil {
-		utils.Error("Favicon: URL decode", err)
+		utils.ReqLog(req).Error("Favicon: URL decode", err)
 		utils.HTTPError(w, "URL decode", http.StatusInternalServerError, "FA002")
 		return
 	}
 
 	
 	if(req.Method == "GET") { 
-		utils.Log("Fetch favicon for " + siteurl)
+		utils.ReqLog(req).Log("Fetch favicon for " + siteurl)
 
 		// Check if we have the favicon in cache
 		if _, ok := cache[siteurl]; ok {
-			utils.Debug("Favicon in cache")
+			utils.ReqLog(req).Debug("Favicon in cache")
 			resp := cache[siteurl]
 			sendImage(w, resp)
 			return
 		}
 
 		icons, err := favicon.Find(siteurl)
-		utils.Debug("Found Favicon: " + strconv.Itoa(len(icons)))
+		utils.ReqLog(req).Debug("Found Favicon: " + strconv.Itoa(len(icons)))
 		if err != nil {
-			utils.Error("FaviconFetch", err)
+			utils.ReqLog(req).Error("FaviconFetch", err)
 			sendFallback(w)
 			return
 		}
 		
 		if len(icons) == 0 {
-			utils.Error("FaviconFetch", err)
+			utils.ReqLog(req).Error("FaviconFetch", err)
 			sendFallback(w)
 			return
 		}
@@ -93,7 +93,7 @@ func GetFavicon(w http.ResponseWriter, req *http.Request) {
 		iconChanged := false
 
 		for i, icon := range icons {
-			utils.Debug("Favicon Width: " + icon.URL + " " + strconv.Itoa(icon.Width))
+			utils.ReqLog(req).Debug("Favicon Width: " + icon.URL + " " + strconv.Itoa(icon.Width))
 			if icon.Width <= 256 {
 				iconIndex = i
 				iconChanged = true
@@ -105,12 +105,12 @@ func GetFavicon(w http.ResponseWriter, req *http.Request) {
 		}
 		icon := icons[iconIndex]
 
-		utils.Log("Favicon: " + icon.URL)
+		utils.ReqLog(req).Log("Favicon: " + icon.URL)
 
 		// Fetch the favicon
 		resp, err := http.Get(icon.URL)
 		if err != nil {
-			utils.Error("FaviconFetch", err)
+			utils.ReqLog(req).Error("FaviconFetch", err)
 			sendFallback(w)
 			return
 		}
@@ -118,14 +118,14 @@ func GetFavicon(w http.ResponseWriter, req *http.Request) {
 		// save the body to a file
 		// out, err := os.Create("favicon.ico")
 		// if err != nil {
-		// 	utils.Error("FaviconFetch", err)
+		// 	utils.ReqLog(req).Error("FaviconFetch", err)
 		// 	utils.HTTPError(w, "Favicon Fetch", http.StatusInternalServerError, "FA001")
 		// 	return
 		// }
 		// defer out.Close()
 		// _, err = io.Copy(out, resp.Body)
 		// if err != nil {
-		// 	utils.Error("FaviconFetch", err)
+		// 	utils.ReqLog(req).Error("FaviconFetch", err)
 		// 	utils.HTTPError(w, "Favicon Fetch", http.StatusInternalServerError, "FA001")
 		// 	return
 		// }
@@ -133,7 +133,7 @@ func GetFavicon(w http.ResponseWriter, req *http.Request) {
 		// Cache the response 
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			utils.Error("FaviconFetch", err)
+			utils.ReqLog(req).Error("FaviconFetch", err)
 			sendFallback(w)
 			return
 		}
@@ -148,7 +148,7 @@ func GetFavicon(w http.ResponseWriter, req *http.Request) {
 
 		sendImage(w, cache[siteurl])
 	} else {
-		utils.Error("Favicon: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("Favicon: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -165,24 +165,24 @@ func PingURL(w http.ResponseWriter, req *http.Request) {
 	// URL decode
 	siteurl, err := url.QueryUnescape(escsiteurl)
 	if err != nil {
-		utils.Error("Ping: URL decode", err)
+		utils.ReqLog(req).Error("Ping: URL decode", err)
 		utils.HTTPError(w, "Ping URL decode", http.StatusInternalServerError, "FA002")
 		return
 	}
 
 	
 	if(req.Method == "GET") { 
-		utils.Log("Ping for " + siteurl)
+		utils.ReqLog(req).Log("Ping for " + siteurl)
 
 		resp, err := http.Get(siteurl)
 		if err != nil {
-			utils.Error("Ping", err)
+			utils.ReqLog(req).Error("Ping", err)
 			utils.HTTPError(w, "URL decode", http.StatusInternalServerError, "PI0001")
 			return
 		}
 		
 		if resp.StatusCode >= 500 {
-			utils.Error("Ping", err)
+			utils.ReqLog(req).Error("Ping", err)
 			utils.HTTPError(w, "URL decode", http.StatusInternalServerError, "PI0002")
 			return
 		}
@@ -193,7 +193,7 @@ func PingURL(w http.ResponseWriter, req *http.Request) {
 			},
 		})
 	} else {
-		utils.Error("Favicon: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("Favicon: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/azukaar/cosmos-server/src/docker"
+	"github.com/azukaar/cosmos-server/src/proxy"
 	"github.com/azukaar/cosmos-server/src/utils"
 )
 
@@ -16,7 +17,9 @@ func main() {
 
 	LoadConfig()
 
-	go CRON()
+	proxy.LoadSmartShield()
+
+	CRON()
 
 	docker.Test()
 
@@ -25,4 +28,6 @@ func main() {
 	docker.BootstrapAllContainersFromTags()
 
 	StartServer()
+
+	waitForShutdown()
 }
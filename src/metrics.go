@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// MetricsRoute serves the metrics in the Prometheus text format, to admins
+// or to scrapers sending HTTPConfig.MetricsToken as a bearer token
+func MetricsRoute(w http.ResponseWriter, req *http.Request) {
+	token := utils.GetMainConfig().HTTPConfig.MetricsToken
+	bearer := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+	hasToken := token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+
+	if !hasToken && utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		utils.WriteMetrics(w)
+	} else {
+		utils.ReqLog(req).Error("Metrics: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
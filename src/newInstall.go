@@ -4,7 +4,6 @@ import (
 	"net/http"
 	"encoding/json"
 	"time"
-	"os"
 	"golang.org/x/crypto/bcrypt"	
 
 	"github.com/azukaar/cosmos-server/src/utils"
@@ -41,7 +40,7 @@ type AdminJSON struct {
 
 func NewInstallRoute(w http.ResponseWriter, req *http.Request) {
 	if !utils.GetMainConfig().NewInstall {
-		utils.Error("Status: not a new New install", nil)
+		utils.ReqLog(req).Error("Status: not a new New install", nil)
 		utils.HTTPError(w, "New install", http.StatusForbidden, "NI001")
 		return
 	}
@@ -50,7 +49,7 @@ func NewInstallRoute(w http.ResponseWriter, req *http.Request) {
 		var request NewInstallJSON
 		err1 := json.NewDecoder(req.Body).Decode(&request)
 		if err1 != nil {
-			utils.Error("NewInstall: Invalid User Request", err1)
+			utils.ReqLog(req).Error("NewInstall: Invalid User Request", err1)
 			utils.HTTPError(w, "New Install: Invalid User Request" + err1.Error(), 
 				http.StatusInternalServerError, "NI001")
 			return 
@@ -58,62 +57,59 @@ func NewInstallRoute(w http.ResponseWriter, req *http.Request) {
 
 		errV := utils.Validate.Struct(request)
 		if errV != nil {
-			utils.Error("NewInstall: Invalid User Request", errV)
+			utils.ReqLog(req).Error("NewInstall: Invalid User Request", errV)
 			utils.HTTPError(w, "New Install: Invalid User Request " + errV.Error(),
 				http.StatusInternalServerError, "NI001")
 			return 
 		}
 
-		newConfig := utils.GetBaseMainConfig()
-
 		if(request.Step == "2") {
-			utils.Log("NewInstall: Step Database")
+			utils.ReqLog(req).Log("NewInstall: Step Database")
 			// User Management & Mongo DB
 			if(request.MongoDBMode == "DisableUserManagement") {
-				utils.Log("NewInstall: Disable User Management")
-				newConfig.DisableUserManagement = true
-				utils.SaveConfigTofile(newConfig)
-				utils.LoadBaseMainConfig(newConfig)
+				utils.ReqLog(req).Log("NewInstall: Disable User Management")
+				utils.UpdateBaseMainConfig(func(newConfig *utils.Config) {
+					newConfig.DisableUserManagement = true
+				})
 			} else if (request.MongoDBMode == "Provided") {
-				utils.Log("NewInstall: DB Provided")
-				newConfig.DisableUserManagement = false
-				newConfig.MongoDB = request.MongoDB
-				utils.SaveConfigTofile(newConfig)
-				utils.LoadBaseMainConfig(newConfig)
+				utils.ReqLog(req).Log("NewInstall: DB Provided")
+				utils.UpdateBaseMainConfig(func(newConfig *utils.Config) {
+					newConfig.DisableUserManagement = false
+					newConfig.MongoDB = request.MongoDB
+				})
 			} else if (request.MongoDBMode == "Create"){
-				utils.Log("NewInstall: Create DB")
-				newConfig.DisableUserManagement = false
+				utils.ReqLog(req).Log("NewInstall: Create DB")
 				strco, err := docker.NewDB()
 				if err != nil {
-					utils.Error("NewInstall: Error creating MongoDB", err)
+					utils.ReqLog(req).Error("NewInstall: Error creating MongoDB", err)
 					utils.HTTPError(w, "New Install: Error creating MongoDB " + err.Error(),
 						http.StatusInternalServerError, "NI001")
 					return 
 				}
-				newConfig.MongoDB = strco
-				utils.SaveConfigTofile(newConfig)
-				utils.LoadBaseMainConfig(newConfig)
-				utils.Log("NewInstall: MongoDB created, waiting for it to be ready")
+				utils.UpdateBaseMainConfig(func(newConfig *utils.Config) {
+					newConfig.DisableUserManagement = false
+					newConfig.MongoDB = strco
+				})
+				utils.ReqLog(req).Log("NewInstall: MongoDB created, waiting for it to be ready")
 				waitForDB()
 			} else {
-				utils.Log("NewInstall: Invalid MongoDBMode")
-				utils.Error("NewInstall: Invalid MongoDBMode", nil)
+				utils.ReqLog(req).Log("NewInstall: Invalid MongoDBMode")
+				utils.ReqLog(req).Error("NewInstall: Invalid MongoDBMode", nil)
 				utils.HTTPError(w, "New Install: Invalid MongoDBMode",
 					http.StatusInternalServerError, "NI001")
 				return 
 			}
 		} else if (request.Step == "3") {
 			// HTTPS Certificate Mode & Certs & Let's Encrypt
-			newConfig.HTTPConfig.HTTPSCertificateMode = request.HTTPSCertificateMode
-			newConfig.HTTPConfig.SSLEmail = request.SSLEmail
-			newConfig.HTTPConfig.TLSCert = request.TLSCert
-			newConfig.HTTPConfig.TLSKey = request.TLSKey
-
-			// Hostname
-			newConfig.HTTPConfig.Hostname = request.Hostname
-
-			utils.SaveConfigTofile(newConfig)
-			utils.LoadBaseMainConfig(newConfig)
+			utils.UpdateBaseMainConfig(func(newConfig *utils.Config) {
+				newConfig.HTTPConfig.HTTPSCertificateMode = request.HTTPSCertificateMode
+				newConfig.HTTPConfig.SSLEmail = request.SSLEmail
+				newConfig.HTTPConfig.TLSCert = request.TLSCert
+				newConfig.HTTPConfig.TLSKey = request.TLSKey
+
+				// Hostname
+				newConfig.HTTPConfig.Hostname = request.Hostname
+			})
 		} else if (request.Step == "4") {
 			
 			adminObj := AdminJSON{
@@ -123,7 +119,7 @@ func NewInstallRoute(w http.ResponseWriter, req *http.Request) {
 
 			errV2 := utils.Validate.Struct(adminObj)
 			if errV2 != nil {
-				utils.Error("NewInstall: Invalid User Request", errV2)
+				utils.ReqLog(req).Error("NewInstall: Invalid User Request", errV2)
 				utils.HTTPError(w, errV2.Error(), http.StatusInternalServerError, "UL001")
 				return
 			}
@@ -131,7 +127,7 @@ func NewInstallRoute(w http.ResponseWriter, req *http.Request) {
 			// Admin User
 			c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
 			if errCo != nil {
-				utils.Error("Database Connect", errCo)
+				utils.ReqLog(req).Error("Database Connect", errCo)
 				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
 				return
 			}
@@ -140,7 +136,7 @@ func NewInstallRoute(w http.ResponseWriter, req *http.Request) {
 			hashedPassword, err2 := bcrypt.GenerateFromPassword([]byte(request.Password), 14)
 
 			if err2 != nil {
-				utils.Error("NewInstall: Error hashing password", err2)
+				utils.ReqLog(req).Error("NewInstall: Error hashing password", err2)
 				utils.HTTPError(w, "New Install: Error hashing password " + err2.Error(),
 					http.StatusInternalServerError, "NI001")
 				return
@@ -149,7 +145,7 @@ func NewInstallRoute(w http.ResponseWriter, req *http.Request) {
 			// pre-remove every users
 			_, err4 := c.DeleteMany(nil, map[string]interface{}{})
 			if err4 != nil {
-				utils.Error("NewInstall: Error deleting users", err4)
+				utils.ReqLog(req).Error("NewInstall: Error deleting users", err4)
 				utils.HTTPError(w, "New Install: Error deleting users " + err4.Error(),
 					http.StatusInternalServerError, "NI001")
 				return
@@ -166,22 +162,27 @@ func NewInstallRoute(w http.ResponseWriter, req *http.Request) {
 			})
 
 			if err3 != nil {
-				utils.Error("NewInstall: Error creating admin user", err3)
+				utils.ReqLog(req).Error("NewInstall: Error creating admin user", err3)
 				utils.HTTPError(w, "New Install: Error creating admin user " + err3.Error(),
 					http.StatusInternalServerError, "NI001")
 				return
 			}
 		} else if (request.Step == "5") {
+			// only saved, the restart loads it
+			utils.ConfigUpdateLock.Lock()
+			newConfig := utils.GetBaseMainConfig()
 			newConfig.NewInstall = false
 			utils.SaveConfigTofile(newConfig)
-			os.Exit(0)
+			utils.ConfigUpdateLock.Unlock()
+
+			utils.RestartServer()
 		}
 
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "OK",
 		})
 	} else {
-		utils.Error("UserList: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserList: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -20,41 +20,34 @@ type SmartResponseWriterWrapper struct {
 	TimeEnded time.Time
 	RequestCost int
 	Method string
-	shield smartShieldState
+	client *clientState
 	policy utils.SmartShieldPolicy
 	isOver bool
+	// set when the connection is upgraded (websockets)
+	TimeHijacked time.Time
 }
 
 func (w *SmartResponseWriterWrapper) IsOver() bool {
 	return w.isOver
 }
 
-func (w *SmartResponseWriterWrapper) IsOld() bool {
-	if !w.IsOver() {
-		return false
-	}
-	oneHourAgo := time.Now().Add(-time.Hour)
-	if w.TimeEnded.Before(oneHourAgo) {
-		return true
-	}
-	return false
-}
-
 func (w *SmartResponseWriterWrapper) WriteHeader(status int) {
 	w.Status = status
-	w.RequestCost = 1
+	cost := 1
 	if w.Method != "GET" {
-		w.RequestCost = 5
+		cost = 5
 	}
 	if w.Status >= 400 {
-		w.RequestCost *= 30
+		cost *= 30
 	}
+	w.client.addCost(cost - w.RequestCost)
+	w.RequestCost = cost
 	w.ResponseWriter.WriteHeader(status)
 }
 
 func (w *SmartResponseWriterWrapper) Write(p []byte) (int, error) {
-	userConsumed := shield.GetUserUsedBudgets(w.ClientID)
-	if !shield.isAllowedToReqest(w.policy, userConsumed) {
+	userConsumed, allowed := w.client.checkRequest(w.policy)
+	if !allowed {
 		utils.Log(fmt.Sprintf("SmartShield: %s is banned", w.ClientID))
 		w.isOver = true
 		w.TimeEnded = time.Now()
@@ -62,7 +55,7 @@ func (w *SmartResponseWriterWrapper) Write(p []byte) (int, error) {
 		w.ResponseWriter.(http.Flusher).Flush()
 		return 0, errors.New("Pending request cancelled due to SmartShield")
 	}
-	thro := shield.computeThrottle(w.policy, userConsumed)
+	thro := computeThrottle(w.policy, userConsumed)
 
 	w.ThrottleNext = 0
 	if thro > 0 {
@@ -70,6 +63,7 @@ func (w *SmartResponseWriterWrapper) Write(p []byte) (int, error) {
 	}
 	n, err := w.ResponseWriter.Write(p)
 	w.Bytes += int64(n)
+	w.client.addBytes(int64(n))
 	return n, err
 }
 
@@ -78,7 +72,18 @@ func (w *SmartResponseWriterWrapper) Hijack() (net.Conn, *bufio.ReadWriter, erro
 	if !ok {
 		return nil, nil, http.ErrNotSupported
 	}
-	return hijacker.Hijack()
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		// an open websocket is idle most of the time, only the handshake
+		// counts against the time budget
+		w.TimeHijacked = time.Now()
+		w.client.endRequest(w.TimeStarted, w.TimeHijacked)
+	}
+	return conn, rw, err
+}
+
+func (w *SmartResponseWriterWrapper) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 func (w *SmartResponseWriterWrapper) Flush() {
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Stored without bson tags, so the keys in the database are the lowercased
+// field names (time, route, status...)
+type AccessLogEntry struct {
+	Time time.Time `json:"time"`
+	Route string `json:"route"`
+	Method string `json:"method"`
+	Host string `json:"host"`
+	Path string `json:"path"`
+	Status int `json:"status"`
+	Bytes int64 `json:"bytes"`
+	// milliseconds
+	Duration float64 `json:"duration"`
+	ClientID string `json:"clientID"`
+	User string `json:"user"`
+	RequestID string `json:"requestID"`
+}
+
+const accessLogBatch = 100
+const accessLogQueueSize = 10000
+const accessLogFlushTimeout = 10 * time.Second
+
+var accessLogQueue = make(chan AccessLogEntry, accessLogQueueSize)
+var accessLogWorker sync.Once
+var accessLogWorkerStarted int32
+var accessLogFlush = make(chan chan bool)
+var accessLogCollection *mongo.Collection
+var accessLogLock sync.Mutex
+
+// getAccessLogCollection creates the capped collection on first use
+func getAccessLogCollection() (*mongo.Collection, error) {
+	accessLogLock.Lock()
+	defer accessLogLock.Unlock()
+
+	if accessLogCollection != nil {
+		return accessLogCollection, nil
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "accesslog")
+	if errCo != nil {
+		return nil, errCo
+	}
+
+	maxSize := int64(utils.GetMainConfig().AccessLogConfig.MaxSize)
+	if maxSize <= 0 {
+		maxSize = 100
+	}
+
+	err := c.Database().CreateCollection(nil, c.Name(),
+		options.CreateCollection().SetCapped(true).SetSizeInBytes(maxSize * 1024 * 1024))
+
+	// 48: NamespaceExists
+	if cmdErr, ok := err.(mongo.CommandError); err != nil && !(ok && cmdErr.Code == 48) {
+		return nil, err
+	}
+
+	accessLogCollection = c
+	return c, nil
+}
+
+func writeAccessLog(entries []AccessLogEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	c, errCo := getAccessLogCollection()
+	if errCo != nil {
+		utils.Error("AccessLog: Database Connect", errCo)
+		return
+	}
+
+	docs := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		docs[i] = entry
+	}
+
+	if _, err := c.InsertMany(nil, docs); err != nil {
+		utils.Error("AccessLog: Insert", err)
+	}
+}
+
+// FlushAccessLog has the writer insert its pending batch and the queued
+// entries, called on shutdown once the requests are drained
+func FlushAccessLog() {
+	if atomic.LoadInt32(&accessLogWorkerStarted) == 0 {
+		return
+	}
+
+	done := make(chan bool)
+	timeout := time.After(accessLogFlushTimeout)
+
+	// the writer can be busy with a batch, or the database not answering
+	select {
+		case accessLogFlush <- done:
+		case <-timeout:
+			utils.Error("AccessLog: flush timed out, entries lost", nil)
+			return
+	}
+
+	select {
+		case <-done:
+		case <-timeout:
+			utils.Error("AccessLog: flush timed out, entries lost", nil)
+	}
+}
+
+// runAccessLogWriter inserts the entries in batches, so requests never wait on the database
+func runAccessLogWriter() {
+	ticker := time.NewTicker(time.Second)
+	entries := []AccessLogEntry{}
+
+	for {
+		select {
+			case entry := <-accessLogQueue:
+				entries = append(entries, entry)
+				if len(entries) < accessLogBatch {
+					continue
+				}
+			case <-ticker.C:
+			case done := <-accessLogFlush:
+				for len(accessLogQueue) > 0 {
+					entries = append(entries, <-accessLogQueue)
+				}
+				writeAccessLog(entries)
+				entries = []AccessLogEntry{}
+				close(done)
+				continue
+		}
+
+		writeAccessLog(entries)
+		entries = []AccessLogEntry{}
+	}
+}
+
+func AccessLogMiddleware(enabled bool) func(next http.Handler) http.Handler {
+	if !enabled || utils.GetMainConfig().DisableUserManagement {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+
+	accessLogWorker.Do(func() {
+		atomic.StoreInt32(&accessLogWorkerStarted, 1)
+		go runAccessLogWriter()
+	})
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &utils.ResponseRecorder{ResponseWriter: w}
+
+			next.ServeHTTP(rec, r)
+
+			entry := AccessLogEntry{
+				Time: start,
+				Method: r.Method,
+				Host: r.Host,
+				Path: r.URL.Path,
+				Status: rec.Status(),
+				Bytes: rec.Bytes(),
+				Duration: float64(time.Since(start).Microseconds()) / 1000,
+				ClientID: utils.GetClientIP(r),
+				// set by the token middleware, after this one
+				User: r.Header.Get("x-cosmos-user"),
+			}
+
+			if info := utils.GetRequestInfo(r); info != nil {
+				entry.Route = info.Route
+				entry.ClientID = info.ClientID
+				entry.RequestID = info.ID
+			}
+
+			select {
+				case accessLogQueue <- entry:
+				default:
+					utils.ReqLog(r).Debug("AccessLog: queue full, dropping entry")
+			}
+		})
+	}
+}
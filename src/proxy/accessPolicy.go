@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"html/template"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+var accessDeniedPage = template.Must(template.New("denied").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Access denied</title>
+	<style>
+		body { font-family: sans-serif; background: #f5f5f5; color: #333; display: flex; align-items: center; justify-content: center; height: 100vh; margin: 0; }
+		div { background: #fff; padding: 2em 3em; border-radius: 8px; box-shadow: 0 2px 8px rgba(0,0,0,0.1); text-align: center; }
+		a { color: #1976d2; }
+	</style>
+</head>
+<body>
+	<div>
+		<h1>Access denied</h1>
+		<p>{{.Reason}}</p>
+		{{if .Nickname}}<p>You are logged in as <b>{{.Nickname}}</b>.</p>{{end}}
+		<p><a href="/ui">Back to Cosmos</a></p>
+	</div>
+</body>
+</html>
+`))
+
+// GetRequestGroups returns the groups of the user making the request
+func GetRequestGroups(r *http.Request) []string {
+	groups := []string{}
+	for _, group := range strings.Split(r.Header.Get("x-cosmos-groups"), ",") {
+		group = strings.TrimSpace(group)
+		if group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func denyAccess(w http.ResponseWriter, r *http.Request, reason string) {
+	utils.ReqLog(r).Warn("AccessPolicy: " + reason)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusForbidden)
+		accessDeniedPage.Execute(w, map[string]string{
+			"Reason": reason,
+			"Nickname": r.Header.Get("x-cosmos-user"),
+		})
+		return
+	}
+
+	utils.HTTPError(w, reason, http.StatusForbidden, "ACL001")
+}
+
+var routePoliciesLock sync.Mutex
+var routePolicies = map[string]accessPolicyEntry{}
+
+type accessPolicyEntry struct {
+	policy utils.RouteAccessPolicy
+	middleware func(next http.Handler) http.Handler
+}
+
+// routeAccessPolicy returns the AccessPolicyMiddleware of the route, kept
+// between requests as long as the policy of the route doesn't change
+func routeAccessPolicy(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	routePoliciesLock.Lock()
+	defer routePoliciesLock.Unlock()
+
+	entry, ok := routePolicies[route.Name]
+	if !ok || !reflect.DeepEqual(entry.policy, route.AccessPolicy) {
+		entry = accessPolicyEntry{
+			policy: route.AccessPolicy,
+			middleware: AccessPolicyMiddleware(route),
+		}
+		routePolicies[route.Name] = entry
+	}
+
+	return entry.middleware
+}
+
+// AccessPolicyMiddleware enforces the AccessPolicy of the route. Anonymous
+// users are sent to the login page when the policy needs to know who they are
+func AccessPolicyMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	policy := route.AccessPolicy
+	sources := utils.ParseIPList(policy.AllowedSources)
+
+	allowedUsers := map[string]bool{}
+	for _, nickname := range policy.AllowedUsers {
+		allowedUsers[nickname] = true
+	}
+	allowedGroups := map[string]bool{}
+	for _, group := range policy.AllowedGroups {
+		allowedGroups[group] = true
+	}
+
+	needsUser := policy.MinRole > 0 || len(allowedUsers) > 0 || len(allowedGroups) > 0
+
+	return func(next http.Handler) http.Handler {
+		if !needsUser && len(policy.AllowedSources) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(policy.AllowedSources) > 0 && !utils.IPInList(utils.GetClientIP(r), sources) {
+				denyAccess(w, r, "Your network is not allowed to access this application")
+				return
+			}
+
+			if !needsUser {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if utils.LoggedInOnlyWithRedirect(w, r) != nil {
+				return
+			}
+
+			nickname := r.Header.Get("x-cosmos-user")
+			role, _ := strconv.Atoi(r.Header.Get("x-cosmos-role"))
+
+			if role < policy.MinRole {
+				denyAccess(w, r, "Your role is not allowed to access this application")
+				return
+			}
+
+			if len(allowedUsers) > 0 || len(allowedGroups) > 0 {
+				allowed := allowedUsers[nickname]
+				for _, group := range GetRequestGroups(r) {
+					allowed = allowed || allowedGroups[group]
+				}
+
+				if !allowed {
+					denyAccess(w, r, "Your account is not allowed to access this application")
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
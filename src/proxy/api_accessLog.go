@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net/http"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var maxAccessLogLimit = 1000
+
+// AccessLogRoute lists the access log, newest first. Filters: route, client,
+// user, statusMin, statusMax, from and to (RFC3339), limit
+func AccessLogRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		query := req.URL.Query()
+		filter := map[string]interface{}{}
+
+		if query.Get("route") != "" {
+			filter["route"] = query.Get("route")
+		}
+		if query.Get("client") != "" {
+			filter["clientid"] = query.Get("client")
+		}
+		if query.Get("user") != "" {
+			filter["user"] = query.Get("user")
+		}
+
+		status := map[string]interface{}{}
+		if query.Get("statusMin") != "" {
+			statusMin, err := strconv.Atoi(query.Get("statusMin"))
+			if err != nil {
+				utils.ReqLog(req).Error("AccessLog: Invalid statusMin", err)
+				utils.HTTPError(w, "Invalid statusMin", http.StatusBadRequest, "AL001")
+				return
+			}
+			status["$gte"] = statusMin
+		}
+		if query.Get("statusMax") != "" {
+			statusMax, err := strconv.Atoi(query.Get("statusMax"))
+			if err != nil {
+				utils.ReqLog(req).Error("AccessLog: Invalid statusMax", err)
+				utils.HTTPError(w, "Invalid statusMax", http.StatusBadRequest, "AL001")
+				return
+			}
+			status["$lte"] = statusMax
+		}
+		if len(status) > 0 {
+			filter["status"] = status
+		}
+
+		window := map[string]interface{}{}
+		if query.Get("from") != "" {
+			from, err := time.Parse(time.RFC3339, query.Get("from"))
+			if err != nil {
+				utils.ReqLog(req).Error("AccessLog: Invalid from", err)
+				utils.HTTPError(w, "Invalid from, expected RFC3339", http.StatusBadRequest, "AL001")
+				return
+			}
+			window["$gte"] = from
+		}
+		if query.Get("to") != "" {
+			to, err := time.Parse(time.RFC3339, query.Get("to"))
+			if err != nil {
+				utils.ReqLog(req).Error("AccessLog: Invalid to", err)
+				utils.HTTPError(w, "Invalid to, expected RFC3339", http.StatusBadRequest, "AL001")
+				return
+			}
+			window["$lte"] = to
+		}
+		if len(window) > 0 {
+			filter["time"] = window
+		}
+
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		if limit <= 0 {
+			limit = 100
+		}
+		if limit > maxAccessLogLimit {
+			limit = maxAccessLogLimit
+		}
+
+		c, errCo := getAccessLogCollection()
+		if errCo != nil {
+			utils.ReqLog(req).Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		l := int64(limit)
+		fOpt := options.FindOptions{
+			Limit: &l,
+			// capped collections keep the insertion order
+			Sort: map[string]interface{}{"$natural": -1},
+		}
+
+		cursor, errDB := c.Find(nil, filter, &fOpt)
+		if errDB != nil {
+			utils.ReqLog(req).Error("AccessLog: Error while querying", errDB)
+			utils.HTTPError(w, "Access Log Error", http.StatusInternalServerError, "AL002")
+			return
+		}
+		defer cursor.Close(nil)
+
+		entries := []AccessLogEntry{}
+		if errDec := cursor.All(nil, &entries); errDec != nil {
+			utils.ReqLog(req).Error("AccessLog: Error while decoding", errDec)
+			utils.HTTPError(w, "Access Log Error", http.StatusInternalServerError, "AL002")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": entries,
+		})
+	} else {
+		utils.ReqLog(req).Error("AccessLog: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net/http"
+	"encoding/json"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+type CachePurgeRequestJSON struct {
+	// name of the route to purge
+	Route string `json:"route"`
+	// URL, with or without scheme, or path the purged URLs start with
+	Prefix string `json:"prefix"`
+}
+
+// CachePurgeRoute removes the cached responses of a route, of a URL prefix, or both
+func CachePurgeRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "POST") {
+		var request CachePurgeRequestJSON
+		err1 := json.NewDecoder(req.Body).Decode(&request)
+		if err1 != nil {
+			utils.ReqLog(req).Error("CachePurge: Invalid Request", err1)
+			utils.HTTPError(w, "Invalid request", http.StatusBadRequest, "CA001")
+			return
+		}
+
+		if request.Route == "" && request.Prefix == "" {
+			utils.ReqLog(req).Error("CachePurge: Missing route or prefix", nil)
+			utils.HTTPError(w, "A route or a prefix is required", http.StatusBadRequest, "CA001")
+			return
+		}
+
+		purged := PurgeCache(request.Route, request.Prefix)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": map[string]interface{}{
+				"purged": purged,
+			},
+		})
+	} else {
+		utils.ReqLog(req).Error("CachePurge: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
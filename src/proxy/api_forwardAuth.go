@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"net/http"
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/azukaar/cosmos-server/src/user"
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// ForwardAuthRoute lets other reverse proxies (Traefik ForwardAuth, nginx
+// auth_request...) check that a request comes from a Cosmos user. It answers
+// 200 with X-Cosmos-User, X-Cosmos-Role, X-Cosmos-Groups and X-Cosmos-Token for the app,
+// and 401 otherwise, or a redirect to the login page with ?redirect=true.
+// When a trusted proxy forwards the host of a route, the AccessPolicy of the
+// route applies and the token is the one of the route
+func ForwardAuthRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET" && req.Method != "HEAD") {
+		utils.ReqLog(req).Error("ForwardAuth: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+
+	nickname := req.Header.Get("x-cosmos-user")
+	role, _ := strconv.Atoi(req.Header.Get("x-cosmos-role"))
+
+	if nickname == "" || role <= 0 {
+		original := forwardedURL(req)
+
+		if req.URL.Query().Get("redirect") == "true" {
+			http.Redirect(w, req, user.GetIssuer() + "/ui/login?notlogged=1&redirect=" + url.QueryEscape(original), http.StatusFound)
+			return
+		}
+
+		utils.ReqLog(req).Debug("ForwardAuth: anonymous request to " + original)
+		utils.HTTPError(w, "User not logged in", http.StatusUnauthorized, "HTTP004")
+		return
+	}
+
+	issueToken := func(w http.ResponseWriter, req *http.Request, routeName string, audience string) {
+		appToken, err := user.MakeAppToken(utils.User{
+			Nickname: nickname,
+			Role: utils.Role(role),
+			Groups: GetRequestGroups(req),
+		}, routeName, audience)
+		if err != nil {
+			utils.ReqLog(req).Error("ForwardAuth: signing app token", err)
+			utils.HTTPError(w, "Authorization Error", http.StatusInternalServerError, "A001")
+			return
+		}
+
+		w.Header().Set("X-Cosmos-User", nickname)
+		w.Header().Set("X-Cosmos-Role", strconv.Itoa(role))
+		w.Header().Set("X-Cosmos-Groups", req.Header.Get("x-cosmos-groups"))
+		w.Header().Set("X-Cosmos-Token", appToken)
+		w.Header().Set("Cache-Control", "no-store")
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	}
+
+	target, trusted := forwardedTarget(req)
+
+	if !trusted {
+		issueToken(w, req, "forward-auth", utils.GetMainConfig().HTTPConfig.Hostname)
+		return
+	}
+
+	route, found := routeForRequest(target.Host, target.Path)
+
+	if !found {
+		issueToken(w, req, "forward-auth", target.Host)
+		return
+	}
+
+	audience := route.TokenAudience
+	if audience == "" {
+		audience = route.Name
+	}
+
+	routeAccessPolicy(route)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		issueToken(w, req, route.Name, audience)
+	})).ServeHTTP(w, req)
+}
+
+// forwardedTarget returns the host, path and query checked by the reverse
+// proxy. The forwarding headers are only read from trusted proxies
+func forwardedTarget(r *http.Request) (*url.URL, bool) {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !utils.IsTrustedProxy(peer) {
+		return nil, false
+	}
+
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return nil, false
+	}
+
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = r.Header.Get("X-Original-URI")
+	}
+
+	target := &url.URL{Host: host, Path: "/"}
+	if parsed, err := url.ParseRequestURI(uri); err == nil && parsed.Path != "" {
+		target.Path = parsed.Path
+		target.RawQuery = parsed.RawQuery
+	}
+
+	return target, true
+}
+
+// forwardedURL rebuilds the URL asked to the reverse proxy calling the Cosmos
+// auth endpoint, or the Cosmos UI when the caller is not a trusted proxy
+func forwardedURL(r *http.Request) string {
+	target, trusted := forwardedTarget(r)
+	if !trusted {
+		return user.GetIssuer() + "/ui"
+	}
+
+	target.Scheme = strings.ToLower(r.Header.Get("X-Forwarded-Proto"))
+	if target.Scheme != "http" {
+		target.Scheme = "https"
+	}
+
+	return target.String()
+}
+
+func sameHost(routeHost string, host string) bool {
+	// mux ignores the port of the request when the route has none
+	if !strings.Contains(routeHost, ":") {
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+	}
+	return strings.EqualFold(routeHost, host)
+}
+
+// routeForRequest finds the route serving the host and path like the router
+// does, where the last routes of the config are tried first
+func routeForRequest(host string, path string) (utils.ProxyRouteConfig, bool) {
+	routes := utils.GetMainConfig().HTTPConfig.ProxyConfig.Routes
+
+	for i := len(routes) - 1; i >= 0; i-- {
+		route := routes[i]
+		if route.UseHost && !sameHost(route.Host, host) {
+			continue
+		}
+		if route.UsePathPrefix && !strings.HasPrefix(path, route.PathPrefix) {
+			continue
+		}
+		return route, true
+	}
+
+	return utils.ProxyRouteConfig{}, false
+}
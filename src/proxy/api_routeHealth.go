@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net/http"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// RoutesHealthRoute lists the health of the checked routes. Targets, errors
+// and upstreams are only shown to admins
+func RoutesHealthRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.LoggedInOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		role, _ := strconv.Atoi(req.Header.Get("x-cosmos-role"))
+		health := GetRoutesHealth()
+
+		sort.Slice(health, func(i, j int) bool {
+			return health[i].Name < health[j].Name
+		})
+
+		if utils.Role(role) < utils.ADMIN {
+			for i := range health {
+				health[i].Target = ""
+				health[i].Error = ""
+				health[i].Upstreams = nil
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": health,
+		})
+	} else {
+		utils.ReqLog(req).Error("RoutesHealth: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
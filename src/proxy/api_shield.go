@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"net/http"
+	"encoding/json"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+
+	"github.com/gorilla/mux"
+)
+
+var banTypeLabels = map[int]string{
+	STRIKE: "STRIKE",
+	TEMP: "TEMP",
+	PERM: "PERM",
+}
+
+type BanJSON struct {
+	ClientID string `json:"clientID"`
+	Type string `json:"type"`
+	Since time.Time `json:"since"`
+	Expires *time.Time `json:"expires"`
+}
+
+type AddBanRequestJSON struct {
+	ClientID string `json:"clientID" validate:"required,min=1,max=256"`
+}
+
+func ShieldClientsRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": shield.GetAllUsedBudgets(),
+		})
+	} else {
+		utils.ReqLog(req).Error("ShieldClients: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func ShieldBansRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		banType := req.URL.Query().Get("type")
+		bans := []BanJSON{}
+
+		for _, ban := range shield.GetActiveBans() {
+			label := banTypeLabels[ban.banType]
+			if banType != "" && banType != label {
+				continue
+			}
+
+			banJSON := BanJSON{
+				ClientID: ban.ClientID,
+				Type: label,
+				Since: ban.time,
+			}
+			if ban.banType != PERM {
+				expires := getBanExpiry(&ban)
+				banJSON.Expires = &expires
+			}
+
+			bans = append(bans, banJSON)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": bans,
+		})
+	} else if(req.Method == "POST") {
+		var request AddBanRequestJSON
+		err1 := json.NewDecoder(req.Body).Decode(&request)
+		if err1 != nil {
+			utils.ReqLog(req).Error("ShieldBan: Invalid Ban Request", err1)
+			utils.HTTPError(w, "Invalid Ban Request", http.StatusBadRequest, "SH001")
+			return
+		}
+
+		errV := utils.Validate.Struct(request)
+		if errV != nil {
+			utils.ReqLog(req).Error("ShieldBan: Invalid Ban Request", errV)
+			utils.HTTPError(w, "Invalid Ban Request: " + errV.Error(), http.StatusBadRequest, "SH001")
+			return
+		}
+
+		shield.AddPermBan(request.ClientID)
+		SaveSmartShield()
+		utils.ReqLog(req).Log("SmartShield: " + request.ClientID + " permanently banned by " + req.Header.Get("x-cosmos-user"))
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.ReqLog(req).Error("ShieldBans: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func ShieldBanIdRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	vars := mux.Vars(req)
+	clientID := vars["clientId"]
+
+	if(req.Method == "DELETE") {
+		removed := shield.LiftBans(clientID)
+
+		if removed == 0 {
+			utils.ReqLog(req).Error("ShieldBanLift: No ban found for " + clientID, nil)
+			utils.HTTPError(w, "No ban found", http.StatusNotFound, "SH002")
+			return
+		}
+
+		SaveSmartShield()
+
+		utils.ReqLog(req).Log("SmartShield: Bans of " + clientID + " lifted by " + req.Header.Get("x-cosmos-user"))
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.ReqLog(req).Error("ShieldBanLift: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
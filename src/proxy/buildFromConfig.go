@@ -7,6 +7,9 @@ import (
 )
 
 func BuildFromConfig(router *mux.Router, config utils.ProxyConfig) *mux.Router {
+	stopUpstreamPools()
+	stopRouteCheckers(config)
+	configureCache()
 
 	router.HandleFunc("/_health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -0,0 +1,426 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// the Vary headers of a URL are forgotten past this many URLs, the
+// next response of each URL records them again
+const maxVaryRecords = 10000
+
+type cacheEntry struct {
+	Key string
+	Route string
+	// host and request URI
+	URL string
+	Status int
+	Header http.Header
+	Body []byte
+	// when the response was received or last revalidated
+	Stored time.Time
+	// Age of the response when it was received
+	InitialAge time.Duration
+	Expires time.Time
+}
+
+func (entry *cacheEntry) size() int64 {
+	size := len(entry.Key) + len(entry.URL) + len(entry.Body)
+	for name, values := range entry.Header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return int64(size)
+}
+
+func (entry *cacheEntry) age(now time.Time) time.Duration {
+	return now.Sub(entry.Stored) + entry.InitialAge
+}
+
+type diskCacheEntry struct {
+	key string
+	route string
+	url string
+	file string
+	size int64
+}
+
+// responseCache keeps the hottest entries in memory, and the ones evicted
+// from memory on disk when a DiskPath is configured. Both tiers are LRU
+type responseCache struct {
+	sync.Mutex
+	config utils.CacheConfig
+
+	memory map[string]*list.Element
+	memoryLRU *list.List
+	memorySize int64
+
+	disk map[string]*list.Element
+	diskLRU *list.List
+	diskSize int64
+
+	// Vary header names of the last response of each route and URL
+	vary map[string][]string
+}
+
+var cache = newResponseCache()
+
+var metricCacheRequests = utils.NewCounter("cosmos_cache_requests_total",
+	"Requests to cached routes, by route and result (HIT, MISS, REVALIDATED)", "route", "result")
+var metricCacheSize = utils.NewGauge("cosmos_cache_size_bytes",
+	"Size of the response cache, by tier", "tier")
+
+func init() {
+	utils.OnMetricsScrape(func() {
+		cache.Lock()
+		defer cache.Unlock()
+		metricCacheSize.Set(float64(cache.memorySize), "memory")
+		metricCacheSize.Set(float64(cache.diskSize), "disk")
+	})
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		memory: map[string]*list.Element{},
+		memoryLRU: list.New(),
+		disk: map[string]*list.Element{},
+		diskLRU: list.New(),
+		vary: map[string][]string{},
+	}
+}
+
+func megabytes(value int, defaultValue int) int64 {
+	if value <= 0 {
+		value = defaultValue
+	}
+	return int64(value) * 1024 * 1024
+}
+
+func (c *responseCache) memoryMax() int64 {
+	return megabytes(c.config.MemorySize, 64)
+}
+
+func (c *responseCache) diskMax() int64 {
+	return megabytes(c.config.DiskSize, 1024)
+}
+
+func (c *responseCache) maxObjectSize() int64 {
+	c.Lock()
+	defer c.Unlock()
+	return megabytes(c.config.MaxObjectSize, 8)
+}
+
+// configureCache applies the CacheConfig of the main config. The disk tier
+// starts empty, the files left by a previous run are not indexed
+func configureCache() {
+	config := utils.GetMainConfig().CacheConfig
+
+	cache.Lock()
+	previous := cache.config
+	cache.config = config
+
+	var removed []string
+	if previous.DiskPath != config.DiskPath {
+		for key := range cache.disk {
+			removed = append(removed, cache.removeDisk(key))
+		}
+	}
+
+	demoted := cache.evictMemory()
+	cache.Unlock()
+
+	removeCacheFiles(removed)
+
+	if config.DiskPath != "" && previous.DiskPath != config.DiskPath {
+		if err := os.MkdirAll(config.DiskPath, 0750); err != nil {
+			utils.Error("Cache: creating " + config.DiskPath, err)
+		}
+		leftovers, _ := filepath.Glob(filepath.Join(config.DiskPath, "*.cache"))
+		removeCacheFiles(leftovers)
+	}
+
+	cache.demote(demoted)
+}
+
+func removeCacheFiles(files []string) {
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			utils.Error("Cache: removing " + file, err)
+		}
+	}
+}
+
+func cachePrimaryKey(route string, r *http.Request) string {
+	return route + "\x00" + r.Host + r.URL.RequestURI()
+}
+
+func cacheVariantKey(primary string, vary []string, r *http.Request) string {
+	key := primary
+	for _, name := range vary {
+		key += "\x00" + name + "=" + strings.Join(r.Header.Values(name), ",")
+	}
+	return key
+}
+
+// get returns the entry matching the request, promoting it to memory if it was on disk
+func (c *responseCache) get(primary string, r *http.Request) *cacheEntry {
+	c.Lock()
+	key := cacheVariantKey(primary, c.vary[primary], r)
+
+	if element, ok := c.memory[key]; ok {
+		c.memoryLRU.MoveToFront(element)
+		c.Unlock()
+		return element.Value.(*cacheEntry)
+	}
+
+	element, ok := c.disk[key]
+	if !ok {
+		c.Unlock()
+		return nil
+	}
+	file := element.Value.(*diskCacheEntry).file
+	c.Unlock()
+
+	entry, err := readCacheFile(file)
+	if err != nil {
+		utils.ReqLog(r).Error("Cache: reading " + file, err)
+		c.Lock()
+		removed := c.removeDisk(key)
+		c.Unlock()
+		removeCacheFiles([]string{removed})
+		return nil
+	}
+
+	c.put(entry, nil)
+	return entry
+}
+
+// put stores an entry in memory. vary is recorded for the URL unless nil
+func (c *responseCache) put(entry *cacheEntry, vary []string) {
+	primary := entry.Route + "\x00" + entry.URL
+
+	c.Lock()
+	if vary != nil {
+		if _, ok := c.vary[primary]; !ok && len(c.vary) >= maxVaryRecords {
+			c.vary = map[string][]string{}
+		}
+		c.vary[primary] = vary
+	}
+
+	c.removeMemory(entry.Key)
+	c.memory[entry.Key] = c.memoryLRU.PushFront(entry)
+	c.memorySize += entry.size()
+
+	demoted := c.evictMemory()
+	c.Unlock()
+
+	c.demote(demoted)
+}
+
+func (c *responseCache) delete(key string) {
+	c.Lock()
+	c.removeMemory(key)
+	removed := c.removeDisk(key)
+	c.Unlock()
+
+	removeCacheFiles([]string{removed})
+}
+
+// removeMemory must hold the cache lock
+func (c *responseCache) removeMemory(key string) {
+	if element, ok := c.memory[key]; ok {
+		c.memorySize -= element.Value.(*cacheEntry).size()
+		c.memoryLRU.Remove(element)
+		delete(c.memory, key)
+	}
+}
+
+// removeDisk must hold the cache lock. It returns the file to remove, if any
+func (c *responseCache) removeDisk(key string) string {
+	element, ok := c.disk[key]
+	if !ok {
+		return ""
+	}
+	entry := element.Value.(*diskCacheEntry)
+	c.diskSize -= entry.size
+	c.diskLRU.Remove(element)
+	delete(c.disk, key)
+	return entry.file
+}
+
+// evictMemory must hold the cache lock. It returns the evicted entries
+func (c *responseCache) evictMemory() []*cacheEntry {
+	evicted := []*cacheEntry{}
+	for c.memorySize > c.memoryMax() {
+		entry := c.memoryLRU.Back().Value.(*cacheEntry)
+		c.removeMemory(entry.Key)
+		evicted = append(evicted, entry)
+	}
+	return evicted
+}
+
+// demote writes the entries evicted from memory to the disk tier
+func (c *responseCache) demote(entries []*cacheEntry) {
+	c.Lock()
+	diskPath := c.config.DiskPath
+	c.Unlock()
+
+	if diskPath == "" {
+		return
+	}
+
+	for _, entry := range entries {
+		if time.Now().After(entry.Expires) && entry.Header.Get("ETag") == "" && entry.Header.Get("Last-Modified") == "" {
+			continue
+		}
+
+		sum := sha256.Sum256([]byte(entry.Key))
+		file := filepath.Join(diskPath, hex.EncodeToString(sum[:]) + ".cache")
+
+		size, err := writeCacheFile(file, entry)
+		if err != nil {
+			utils.Error("Cache: writing " + file, err)
+			continue
+		}
+
+		c.Lock()
+		if c.config.DiskPath != diskPath {
+			c.Unlock()
+			removeCacheFiles([]string{file})
+			return
+		}
+
+		c.removeDisk(entry.Key)
+		c.disk[entry.Key] = c.diskLRU.PushFront(&diskCacheEntry{
+			key: entry.Key,
+			route: entry.Route,
+			url: entry.URL,
+			file: file,
+			size: size,
+		})
+		c.diskSize += size
+
+		removed := []string{}
+		for c.diskSize > c.diskMax() {
+			oldest := c.diskLRU.Back().Value.(*diskCacheEntry)
+			removed = append(removed, c.removeDisk(oldest.key))
+		}
+		c.Unlock()
+
+		removeCacheFiles(removed)
+	}
+}
+
+func writeCacheFile(file string, entry *cacheEntry) (int64, error) {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	err = gob.NewEncoder(f).Encode(entry)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	info, err := os.Stat(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	return info.Size(), os.Rename(tmp, file)
+}
+
+func readCacheFile(file string) (*cacheEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entry := &cacheEntry{}
+	err = gob.NewDecoder(f).Decode(entry)
+	return entry, err
+}
+
+// matchesPurge tells if an entry of route and url (host and request URI) is
+// purged. prefix is a URL, with or without scheme, or a path
+func matchesPurge(route string, url string, purgeRoute string, prefix string) bool {
+	if purgeRoute != "" && route != purgeRoute {
+		return false
+	}
+
+	if prefix == "" {
+		return true
+	}
+
+	prefix = strings.TrimPrefix(strings.TrimPrefix(prefix, "https://"), "http://")
+	if strings.HasPrefix(prefix, "/") {
+		if slash := strings.Index(url, "/"); slash >= 0 {
+			url = url[slash:]
+		}
+	}
+
+	return strings.HasPrefix(url, prefix)
+}
+
+// PurgeCache removes the entries of a route, of a URL prefix, or of both.
+// It returns the number of entries removed
+func PurgeCache(route string, prefix string) int {
+	cache.Lock()
+
+	purged := map[string]bool{}
+	removed := []string{}
+
+	for key, element := range cache.memory {
+		entry := element.Value.(*cacheEntry)
+		if matchesPurge(entry.Route, entry.URL, route, prefix) {
+			cache.removeMemory(key)
+			purged[key] = true
+		}
+	}
+
+	for key, element := range cache.disk {
+		entry := element.Value.(*diskCacheEntry)
+		if matchesPurge(entry.route, entry.url, route, prefix) {
+			removed = append(removed, cache.removeDisk(key))
+			purged[key] = true
+		}
+	}
+
+	for primary := range cache.vary {
+		parts := strings.SplitN(primary, "\x00", 2)
+		if len(parts) == 2 && matchesPurge(parts[0], parts[1], route, prefix) {
+			delete(cache.vary, primary)
+		}
+	}
+
+	cache.Unlock()
+
+	removeCacheFiles(removed)
+
+	utils.Log("Cache: purged " + strconv.Itoa(len(purged)) + " entries")
+
+	return len(purged)
+}
@@ -0,0 +1,392 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// statuses cached without explicit freshness, as defined by RFC 9111
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(header string) cacheControl {
+	directives := cacheControl{}
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), "\"")
+	}
+	return directives
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the value of a delta-seconds directive, -1 if absent or invalid
+func (cc cacheControl) seconds(directive string) int {
+	value, ok := cc[directive]
+	if !ok {
+		return -1
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return -1
+	}
+	return seconds
+}
+
+// freshness returns how long a response stays fresh from when it was generated.
+// ok is false when the response gives no freshness information
+func freshness(header http.Header, cc cacheControl) (lifetime time.Duration, ok bool) {
+	if seconds := cc.seconds("s-maxage"); seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if seconds := cc.seconds("max-age"); seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if header.Get("Expires") != "" {
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			// invalid dates mean already expired
+			return 0, true
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+func hasValidator(header http.Header) bool {
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+// newCacheEntry returns the entry to store for a response, nil if it can't be cached
+func newCacheEntry(route utils.ProxyRouteConfig, r *http.Request, primary string, status int, header http.Header, body []byte) (*cacheEntry, []string) {
+	cc := parseCacheControl(header.Get("Cache-Control"))
+
+	if cc.has("no-store") || cc.has("private") ||
+		header.Get("Set-Cookie") != "" || header.Get("Trailer") != "" {
+		return nil, nil
+	}
+
+	// shared caches only keep responses to authenticated requests when allowed to
+	if (r.Header.Get("Authorization") != "" || r.Header.Get("x-cosmos-user") != "") &&
+		!cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return nil, nil
+	}
+
+	// the key has no cookie, a backend with its own sessions can answer per user
+	// without saying so, only responses meant for everyone are kept
+	if r.Header.Get("Cookie") != "" && !cc.has("public") && !cc.has("s-maxage") {
+		return nil, nil
+	}
+
+	vary := []string{}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, nil
+			}
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	lifetime, explicit := freshness(header, cc)
+	if !explicit {
+		if !heuristicallyCacheable[status] {
+			return nil, nil
+		}
+		lifetime = time.Duration(route.Cache.DefaultTTL) * time.Second
+	}
+	if cc.has("no-cache") {
+		lifetime = 0
+	}
+
+	// a response already stale can only be used after revalidation
+	if lifetime <= 0 && !hasValidator(header) {
+		return nil, nil
+	}
+
+	age := time.Duration(0)
+	if seconds, err := strconv.Atoi(header.Get("Age")); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+
+	now := time.Now()
+	return &cacheEntry{
+		Key: cacheVariantKey(primary, vary, r),
+		Route: route.Name,
+		URL: r.Host + r.URL.RequestURI(),
+		Status: status,
+		Header: header,
+		Body: body,
+		Stored: now,
+		InitialAge: age,
+		Expires: now.Add(lifetime - age),
+	}, vary
+}
+
+// revalidated returns a copy of entry refreshed by the headers of a 304
+func revalidated(route utils.ProxyRouteConfig, r *http.Request, primary string, entry *cacheEntry, header http.Header) (*cacheEntry, []string) {
+	merged := entry.Header.Clone()
+	for name, values := range header {
+		merged[name] = values
+	}
+	return newCacheEntry(route, r, primary, entry.Status, merged, entry.Body)
+}
+
+func etagMatches(list string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates the conditional headers of the request against a cached response
+func notModified(r *http.Request, entry *cacheEntry) bool {
+	if entry.Status != http.StatusOK {
+		return false
+	}
+	if r.Header.Get("If-None-Match") != "" {
+		return etagMatches(r.Header.Get("If-None-Match"), entry.Header.Get("ETag"))
+	}
+	if r.Header.Get("If-Modified-Since") != "" {
+		since, errSince := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		modified, errModified := http.ParseTime(entry.Header.Get("Last-Modified"))
+		return errSince == nil && errModified == nil && !modified.After(since)
+	}
+	return false
+}
+
+func serveCached(w http.ResponseWriter, r *http.Request, entry *cacheEntry, result string) {
+	header := w.Header()
+	for name, values := range entry.Header {
+		header[name] = append([]string{}, values...)
+	}
+	header.Set("Age", strconv.Itoa(int(entry.age(time.Now()).Seconds())))
+	header.Set("X-Cache", result)
+
+	if notModified(r, entry) {
+		header.Del("Content-Length")
+		header.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(entry.Status)
+	if r.Method != "HEAD" {
+		w.Write(entry.Body)
+	}
+}
+
+// cacheWriter copies the response of the upstream while it is sent to the
+// client. The upstream gets its own header map, so the headers set by the
+// other middlewares (cookies of the session...) are never cached
+type cacheWriter struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	body bytes.Buffer
+	maxSize int64
+	tooLarge bool
+	// a 304 answering our revalidation is not forwarded to the client
+	revalidating bool
+	notModified bool
+}
+
+func (w *cacheWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+
+	if w.revalidating && status == http.StatusNotModified {
+		w.notModified = true
+		return
+	}
+
+	header := w.ResponseWriter.Header()
+	for name, values := range w.header {
+		header[name] = values
+	}
+	header.Set("X-Cache", "MISS")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.notModified {
+		return len(b), nil
+	}
+
+	if !w.tooLarge {
+		if int64(w.body.Len() + len(b)) > w.maxSize {
+			w.tooLarge = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok && !w.notModified {
+		flusher.Flush()
+	}
+}
+
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish forwards the headers set after the body, trailers included
+func (w *cacheWriter) finish() {
+	if w.notModified {
+		return
+	}
+	header := w.ResponseWriter.Header()
+	for name, values := range w.header {
+		if _, ok := header[name]; !ok {
+			header[name] = values
+		}
+	}
+}
+
+// CacheMiddleware serves the GET and HEAD requests of the route from the
+// response cache, when the route has caching enabled
+func CacheMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !route.Cache.Enabled {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if (r.Method != "GET" && r.Method != "HEAD") || utils.IsUpgradeRequest(r) || r.Header.Get("Range") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			requestCC := parseCacheControl(r.Header.Get("Cache-Control"))
+			if requestCC.has("no-store") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			primary := cachePrimaryKey(route.Name, r)
+			entry := cache.get(primary, r)
+
+			noCache := requestCC.has("no-cache") || requestCC.seconds("max-age") == 0 ||
+				r.Header.Get("Pragma") == "no-cache"
+
+			if entry != nil && !noCache && time.Now().Before(entry.Expires) {
+				metricCacheRequests.Inc(route.Name, "HIT")
+				serveCached(w, r, entry, "HIT")
+				return
+			}
+
+			// without an entry, HEAD responses have no body to store
+			if entry == nil && r.Method == "HEAD" {
+				metricCacheRequests.Inc(route.Name, "MISS")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			upstreamReq := r
+			revalidating := entry != nil && hasValidator(entry.Header)
+			if revalidating {
+				upstreamReq = r.Clone(r.Context())
+				upstreamReq.Header.Del("If-None-Match")
+				upstreamReq.Header.Del("If-Modified-Since")
+				if etag := entry.Header.Get("ETag"); etag != "" {
+					upstreamReq.Header.Set("If-None-Match", etag)
+				} else {
+					upstreamReq.Header.Set("If-Modified-Since", entry.Header.Get("Last-Modified"))
+				}
+			}
+
+			writer := &cacheWriter{
+				ResponseWriter: w,
+				header: http.Header{},
+				maxSize: cache.maxObjectSize(),
+				revalidating: revalidating,
+			}
+
+			next.ServeHTTP(writer, upstreamReq)
+			writer.finish()
+
+			if writer.notModified {
+				metricCacheRequests.Inc(route.Name, "REVALIDATED")
+				refreshed, vary := revalidated(route, r, primary, entry, writer.header)
+				if refreshed == nil {
+					cache.delete(entry.Key)
+					serveCached(w, r, entry, "REVALIDATED")
+					return
+				}
+				cache.put(refreshed, vary)
+				serveCached(w, r, refreshed, "REVALIDATED")
+				return
+			}
+
+			metricCacheRequests.Inc(route.Name, "MISS")
+
+			status := writer.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			if upstreamReq.Method != "GET" || writer.tooLarge || r.Context().Err() != nil {
+				return
+			}
+
+			// conditional requests of the client can get a 304 with no body to store
+			if status == http.StatusNotModified || status == http.StatusPartialContent {
+				return
+			}
+
+			stored, vary := newCacheEntry(route, r, primary, status, writer.header.Clone(), writer.body.Bytes())
+			if stored != nil {
+				cache.put(stored, vary)
+			} else if entry != nil && status < 500 {
+				cache.delete(entry.Key)
+			}
+		})
+	}
+}
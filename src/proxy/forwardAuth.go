@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// headers of a denied answer sent back to the client with its status and body
+var forwardAuthDenyHeaders = []string{
+	"Content-Type",
+	"Location",
+	"Set-Cookie",
+	"WWW-Authenticate",
+	"Retry-After",
+}
+
+// requestScheme trusts X-Forwarded-Proto from trusted proxies only
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil && utils.IsTrustedProxy(peer) && r.Header.Get("X-Forwarded-Proto") != "" {
+		return strings.ToLower(r.Header.Get("X-Forwarded-Proto"))
+	}
+
+	return "http"
+}
+
+// newForwardAuthRequest copies the metadata of the request for the auth endpoint
+func newForwardAuthRequest(config utils.ForwardAuthConfig, r *http.Request) (*http.Request, error) {
+	authReq, err := http.NewRequestWithContext(r.Context(), "GET", config.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.AuthRequestHeaders) == 0 {
+		for name, values := range r.Header {
+			authReq.Header[name] = append([]string{}, values...)
+		}
+	} else {
+		for _, name := range config.AuthRequestHeaders {
+			for _, value := range r.Header.Values(name) {
+				authReq.Header.Add(name, value)
+			}
+		}
+	}
+
+	// the endpoint answers this request, not the original one
+	for _, name := range []string{"Connection", "Upgrade", "Content-Length", "Transfer-Encoding", "Te", "Trailer"} {
+		authReq.Header.Del(name)
+	}
+
+	authReq.Header.Set("X-Forwarded-Method", r.Method)
+	authReq.Header.Set("X-Forwarded-Proto", requestScheme(r))
+	authReq.Header.Set("X-Forwarded-Host", r.Host)
+	authReq.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	authReq.Header.Set("X-Forwarded-For", utils.GetClientIP(r))
+
+	return authReq, nil
+}
+
+// ForwardAuthMiddleware lets the requests of the route through only when the
+// auth endpoint allows them, or when they come from a Cosmos user if there is no endpoint
+func ForwardAuthMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	config := route.ForwardAuth
+
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return func(next http.Handler) http.Handler {
+		if !config.Enabled {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if config.URL == "" {
+				if utils.LoggedInOnlyWithRedirect(w, r) != nil {
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			authReq, err := newForwardAuthRequest(config, r)
+			if err != nil {
+				utils.ReqLog(r).Error("ForwardAuth: invalid endpoint " + config.URL, err)
+				utils.HTTPError(w, "Authorization Error", http.StatusInternalServerError, "FA001")
+				return
+			}
+
+			resp, err := client.Do(authReq)
+			if err != nil {
+				utils.ReqLog(r).Error("ForwardAuth: calling " + config.URL, err)
+				utils.HTTPError(w, "Authorization service unavailable", http.StatusBadGateway, "FA002")
+				return
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				utils.ReqLog(r).Warn("ForwardAuth: request denied by " + config.URL + " with status " + resp.Status)
+
+				for _, name := range forwardAuthDenyHeaders {
+					for _, value := range resp.Header.Values(name) {
+						w.Header().Add(name, value)
+					}
+				}
+				w.WriteHeader(resp.StatusCode)
+				io.Copy(w, resp.Body)
+				return
+			}
+
+			// the client can't set the headers it is identified with
+			for _, name := range config.AuthResponseHeaders {
+				r.Header.Del(name)
+				for _, value := range resp.Header.Values(name) {
+					r.Header.Add(name, value)
+				}
+			}
+
+			utils.ReqLog(r).Debug("ForwardAuth: request allowed by " + config.URL)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
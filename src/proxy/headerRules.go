@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+func applyHeaderRules(header http.Header, rules []utils.HeaderRule) {
+	for _, rule := range rules {
+		switch rule.Action {
+			case utils.HeaderActionList["ADD"]:
+				header.Add(rule.Name, rule.Value)
+			case utils.HeaderActionList["SET"]:
+				header.Set(rule.Name, rule.Value)
+			case utils.HeaderActionList["REMOVE"]:
+				header.Del(rule.Name)
+		}
+	}
+}
+
+// headerRulesWriter applies the response rules once every other handler set its headers
+type headerRulesWriter struct {
+	http.ResponseWriter
+	rules []utils.HeaderRule
+	applied bool
+}
+
+func (w *headerRulesWriter) apply() {
+	if !w.applied {
+		w.applied = true
+		applyHeaderRules(w.ResponseWriter.Header(), w.rules)
+	}
+}
+
+func (w *headerRulesWriter) WriteHeader(status int) {
+	w.apply()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerRulesWriter) Write(b []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerRulesWriter) Flush() {
+	w.apply()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *headerRulesWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func (w *headerRulesWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// HeaderRulesMiddleware applies the RequestHeaders and ResponseHeaders rules of the route
+func HeaderRulesMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(route.RequestHeaders) == 0 && len(route.ResponseHeaders) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			applyHeaderRules(r.Header, route.RequestHeaders)
+
+			if len(route.ResponseHeaders) > 0 {
+				w = &headerRulesWriter{
+					ResponseWriter: w,
+					rules: route.ResponseHeaders,
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// PathRewriteMiddleware replaces the matches of PathRewrite in the path of the request
+func PathRewriteMiddleware(rule utils.PathRewriteRule) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if rule.Match == "" {
+			return next
+		}
+
+		match, err := regexp.Compile(rule.Match)
+		if err != nil {
+			utils.Error("PathRewrite: invalid regexp " + rule.Match, err)
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := match.ReplaceAllString(r.URL.Path, rule.Replace)
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+
+			rewritten := r.Clone(r.Context())
+
+			// a query in the replacement is merged with the one of the request
+			if path, query, ok := strings.Cut(path, "?"); ok {
+				values := rewritten.URL.Query()
+				added, _ := url.ParseQuery(query)
+				for name, value := range added {
+					values[name] = value
+				}
+				rewritten.URL.Path = path
+				rewritten.URL.RawQuery = values.Encode()
+			} else {
+				rewritten.URL.Path = path
+			}
+			rewritten.URL.RawPath = ""
+			rewritten.RequestURI = rewritten.URL.RequestURI()
+
+			utils.ReqLog(r).Debug("PathRewrite: " + r.URL.RequestURI() + " to " + rewritten.URL.RequestURI())
+
+			next.ServeHTTP(w, rewritten)
+		})
+	}
+}
+
+// rewriteLocation points the redirects of the target back at the route.
+// resp.Request still has the Host of the client, the director does not change it
+func rewriteLocation(resp *http.Response, target *url.URL, route utils.ProxyRouteConfig) {
+	scheme := "http"
+	if utils.IsHTTPS {
+		scheme = "https"
+	}
+
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := resp.Header.Get(name)
+		if value == "" {
+			continue
+		}
+
+		location, err := url.Parse(value)
+		if err != nil {
+			continue
+		}
+
+		if location.IsAbs() {
+			if location.Host == target.Host || location.Host == target.Hostname() {
+				location.Scheme = scheme
+				location.Host = resp.Request.Host
+			} else if location.Host != resp.Request.Host {
+				continue
+			}
+		} else if location.Host != "" || !strings.HasPrefix(location.Path, "/") {
+			continue
+		}
+
+		// the target does not know the prefix it is served under
+		if route.UsePathPrefix && route.StripPathPrefix && !strings.HasPrefix(location.Path, route.PathPrefix) {
+			location.Path = singleJoiningSlash(route.PathPrefix, location.Path)
+			location.RawPath = ""
+		}
+
+		resp.Header.Set(name, location.String())
+	}
+}
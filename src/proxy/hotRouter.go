@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// HotRouter serves requests with a mux.Router that can be replaced at runtime.
+// Requests (and hijacked connections such as websockets) already in flight keep
+// running on the router they started with, new requests use the latest one.
+type HotRouter struct {
+	router atomic.Pointer[mux.Router]
+}
+
+func (h *HotRouter) Swap(router *mux.Router) {
+	h.router.Store(router)
+}
+
+func (h *HotRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	router := h.router.Load()
+
+	if router == nil {
+		http.Error(w, "Server is starting", http.StatusServiceUnavailable)
+		return
+	}
+
+	router.ServeHTTP(w, r)
+}
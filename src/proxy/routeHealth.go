@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+const maxHealthHistory = 50
+
+type HealthTransition struct {
+	Time time.Time `json:"time"`
+	Up bool `json:"up"`
+	Reason string `json:"reason"`
+}
+
+type UpstreamHealth struct {
+	Target string `json:"target"`
+	Up bool `json:"up"`
+	Ejected bool `json:"ejected"`
+	ActiveRequests int64 `json:"activeRequests"`
+}
+
+type RouteHealth struct {
+	Name string `json:"name"`
+	Target string `json:"target,omitempty"`
+	Up bool `json:"up"`
+	StatusCode int `json:"statusCode,omitempty"`
+	Error string `json:"error,omitempty"`
+	LastCheck time.Time `json:"lastCheck"`
+	Since time.Time `json:"since"`
+	History []HealthTransition `json:"history"`
+	Upstreams []UpstreamHealth `json:"upstreams,omitempty"`
+}
+
+type routeChecker struct {
+	route utils.ProxyRouteConfig
+	pool *upstreamPool
+	stop chan bool
+}
+
+// the health of the routes survives router rebuilds, keyed by route name
+var routeHealthLock sync.RWMutex
+var routeHealth = map[string]*RouteHealth{}
+var routeCheckers = []*routeChecker{}
+
+func isHealthChecked(route utils.ProxyRouteConfig) bool {
+	return (route.Mode == "SERVAPP" || route.Mode == "PROXY") && !route.HealthCheck.Disabled
+}
+
+// isHealthyStatus compares with ExpectedStatus, or accepts 2xx and 3xx on an
+// explicit Path, and any answer below 500 otherwise
+func isHealthyStatus(check utils.HealthCheckConfig, status int) bool {
+	if check.ExpectedStatus != 0 {
+		return status == check.ExpectedStatus
+	}
+	if check.Path != "" {
+		return status >= 200 && status < 400
+	}
+	return status < 500
+}
+
+// probeTarget requests the health check path of a target
+func probeTarget(target *url.URL, transport http.RoundTripper, check utils.HealthCheckConfig) (int, error) {
+	timeout := time.Duration(check.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	checkURL := *target
+	checkURL.Path = singleJoiningSlash(target.Path, check.Path)
+
+	resp, err := client.Get(checkURL.String())
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if !isHealthyStatus(check, resp.StatusCode) {
+		return resp.StatusCode, errors.New("unexpected status " + strconv.Itoa(resp.StatusCode))
+	}
+
+	return resp.StatusCode, nil
+}
+
+// stopRouteCheckers stops the checkers of the previous router and forgets the removed routes
+func stopRouteCheckers(config utils.ProxyConfig) {
+	routeHealthLock.Lock()
+	defer routeHealthLock.Unlock()
+
+	for _, checker := range routeCheckers {
+		close(checker.stop)
+	}
+	routeCheckers = []*routeChecker{}
+
+	names := map[string]bool{}
+	for _, route := range config.Routes {
+		names[route.Name] = true
+	}
+	for name := range routeHealth {
+		if !names[name] {
+			delete(routeHealth, name)
+		}
+	}
+}
+
+// startRouteChecker probes the Target of the route in the background. pool is
+// set for balanced routes, to report the state of their upstreams
+func startRouteChecker(route utils.ProxyRouteConfig, pool *upstreamPool) {
+	if !isHealthChecked(route) {
+		return
+	}
+
+	checker := &routeChecker{
+		route: route,
+		pool: pool,
+		stop: make(chan bool),
+	}
+
+	routeHealthLock.Lock()
+	health, ok := routeHealth[route.Name]
+	if !ok {
+		health = &RouteHealth{
+			Name: route.Name,
+			Up: true,
+			Since: time.Now(),
+			History: []HealthTransition{},
+		}
+		routeHealth[route.Name] = health
+	}
+	health.Target = route.Target
+	routeCheckers = append(routeCheckers, checker)
+	routeHealthLock.Unlock()
+
+	go checker.run()
+}
+
+func (checker *routeChecker) run() {
+	interval := time.Duration(checker.route.HealthCheck.Interval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	checker.check()
+
+	for {
+		select {
+			case <-checker.stop:
+				return
+			case <-ticker.C:
+				checker.check()
+		}
+	}
+}
+
+func (checker *routeChecker) check() {
+	route := checker.route
+
+	status := 0
+	var err error
+	var upstreams []UpstreamHealth
+
+	// balanced routes are up as long as one upstream is in rotation
+	if checker.pool != nil {
+		upstreams = checker.pool.health()
+		err = errors.New("no healthy upstream")
+		for _, u := range upstreams {
+			if u.Up && !u.Ejected {
+				err = nil
+			}
+		}
+	} else {
+		var target *url.URL
+		target, err = url.Parse(route.Target)
+		if err == nil {
+			status, err = probeTarget(target, upstreamTransport(route, target), route.HealthCheck)
+		}
+	}
+
+	routeHealthLock.Lock()
+	defer routeHealthLock.Unlock()
+
+	health, ok := routeHealth[route.Name]
+	if !ok {
+		return
+	}
+
+	up := err == nil
+	reason := "status " + strconv.Itoa(status)
+	if err != nil {
+		reason = err.Error()
+	}
+
+	if health.Up != up {
+		if up {
+			utils.Log("Route " + route.Name + " is back up")
+		} else {
+			utils.Warn("Route " + route.Name + " is down: " + reason)
+		}
+
+		health.Since = time.Now()
+		health.History = append(health.History, HealthTransition{
+			Time: health.Since,
+			Up: up,
+			Reason: reason,
+		})
+		if len(health.History) > maxHealthHistory {
+			health.History = health.History[len(health.History) - maxHealthHistory:]
+		}
+	}
+
+	health.Up = up
+	health.StatusCode = status
+	health.Error = ""
+	if err != nil {
+		health.Error = err.Error()
+	}
+	health.LastCheck = time.Now()
+
+	health.Upstreams = upstreams
+}
+
+// IsRouteDown tells if the last check of the route failed
+func IsRouteDown(name string) bool {
+	routeHealthLock.RLock()
+	defer routeHealthLock.RUnlock()
+
+	health, ok := routeHealth[name]
+	return ok && !health.Up
+}
+
+func GetRoutesHealth() []RouteHealth {
+	routeHealthLock.RLock()
+	defer routeHealthLock.RUnlock()
+
+	result := []RouteHealth{}
+	for _, health := range routeHealth {
+		copied := *health
+		copied.History = append([]HealthTransition{}, health.History...)
+		copied.Upstreams = append([]UpstreamHealth{}, health.Upstreams...)
+		result = append(result, copied)
+	}
+
+	return result
+}
+
+// serveMaintenancePage answers with the maintenance page of the route, if it has one
+func serveMaintenancePage(w http.ResponseWriter, route utils.ProxyRouteConfig) bool {
+	if route.HealthCheck.MaintenancePage == "" {
+		return false
+	}
+
+	page, err := ioutil.ReadFile(route.HealthCheck.MaintenancePage)
+	if err != nil {
+		utils.Error("Route " + route.Name + ": reading maintenance page", err)
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Retry-After", "30")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(page)
+	return true
+}
+
+// MaintenanceMiddleware serves the maintenance page while the route is down
+func MaintenanceMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if route.HealthCheck.MaintenancePage == "" || !isHealthChecked(route) {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if IsRouteDown(route.Name) && serveMaintenancePage(w, route) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,29 +1,83 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
 	"net/http/httputil" 
 	"net/url"
+	"time"
 	spa "github.com/roberthodgen/spa-server"
 	"github.com/azukaar/cosmos-server/src/utils"
+	"golang.org/x/net/http2"
 )
 
+// h2cTransport speaks cleartext HTTP/2 (prior knowledge) to the backend
+var h2cTransport = &http2.Transport{
+	AllowHTTP: true,
+	DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	},
+}
+
+// h2Transport requires HTTP/2 over TLS, for gRPC backends behind https://
+var h2Transport = &http2.Transport{}
+
+// upstreamTransport returns the transport for the UpstreamProtocol of the route,
+// nil for the default one. Websocket upgrades need HTTP/1.1, so they are only
+// possible with the default transport
+func upstreamTransport(route utils.ProxyRouteConfig, target *url.URL) http.RoundTripper {
+	switch route.UpstreamProtocol {
+		case utils.UpstreamProtocolList["H2C"]:
+			return h2cTransport
+		case utils.UpstreamProtocolList["GRPC"]:
+			if target.Scheme == "https" {
+				return h2Transport
+			}
+			return h2cTransport
+	}
+	return nil
+}
+
 // NewProxy takes target host and creates a reverse proxy
-func NewProxy(targetHost string) (*httputil.ReverseProxy, error) {
+func NewProxy(targetHost string, route utils.ProxyRouteConfig) (*httputil.ReverseProxy, error) {
 	url, err := url.Parse(targetHost)
 	if err != nil {
 			return nil, err
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(url)
+	proxy.Transport = upstreamTransport(route, url)
+
+	// gRPC streams must reach the client message by message
+	if route.UpstreamProtocol == utils.UpstreamProtocolList["GRPC"] {
+		proxy.FlushInterval = -1
+	}
+
+	if route.FlushInterval != 0 {
+		proxy.FlushInterval = time.Duration(route.FlushInterval) * time.Millisecond
+	}
 
 	proxy.ModifyResponse = func(resp *http.Response) error {
 		utils.Debug("Response from backend: " + resp.Status)
 		utils.Debug("URL was " + resp.Request.URL.String())
 
+		if route.RewriteLocation {
+			rewriteLocation(resp, url, route)
+		}
+
 		return nil
 	}
 
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		utils.ReqLog(r).Error("Proxy: " + url.String() + " unreachable", err)
+		if !serveMaintenancePage(w, route) {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+
 	return proxy, nil
 }
 
@@ -34,12 +88,18 @@ func RouteTo(route utils.ProxyRouteConfig) http.Handler {
 	destination := route.Target
 	routeType := route.Mode
 
-	if(routeType == "SERVAPP" || routeType == "PROXY") {
-		proxy, err := NewProxy(destination)
+	if((routeType == "SERVAPP" || routeType == "PROXY") && needsUpstreamPool(route)) {
+		pool := newUpstreamPool(route)
+		startRouteChecker(route, pool)
+		return pool
+	} else if(routeType == "SERVAPP" || routeType == "PROXY") {
+		proxy, err := NewProxy(destination, route)
 		if err != nil {
 				utils.Error("Create Route", err)
 		}
 
+		startRouteChecker(route, nil)
+
 		// create a handler function which uses the reverse proxy
 		return proxy
 	}  else if (routeType == "STATIC") {
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newRouteServer serves the route through the whole chain built by RouterGen:
+// SmartShield, timeout, throttling and bandwidth limiting
+func newRouteServer(t *testing.T, route utils.ProxyRouteConfig, h2cFront bool) *httptest.Server {
+	utils.MainConfig.LoggingLevel = "ERROR"
+	shield = newSmartShieldState()
+
+	router := mux.NewRouter()
+	RouterGen(route, router, RouteTo(route))
+
+	var handler http.Handler = router
+	if h2cFront {
+		handler = h2c.NewHandler(router, &http2.Server{})
+	}
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func chainRoute(target string) utils.ProxyRouteConfig {
+	return utils.ProxyRouteConfig{
+		Name: "test",
+		Mode: "PROXY",
+		Target: target,
+		Timeout: 300,
+		ThrottlePerMinute: 100,
+		MaxBandwith: 1024 * 1024,
+		SmartShield: utils.SmartShieldPolicy{
+			Enabled: true,
+		},
+	}
+}
+
+// echoUpgradeHandler switches protocol then echoes every line it receives
+func echoUpgradeHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !utils.IsUpgradeRequest(r) {
+			http.Error(w, "expected an upgrade", http.StatusBadRequest)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("backend hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			rw.WriteString(line)
+			rw.Flush()
+		}
+	})
+}
+
+func TestWebsocketUpgradeThroughChain(t *testing.T) {
+	backend := httptest.NewServer(echoUpgradeHandler(t))
+	defer backend.Close()
+
+	front := newRouteServer(t, chainRoute(backend.URL), false)
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET /socket HTTP/1.1\r\nHost: " + front.Listener.Addr().String() +
+		"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+
+	echo := func(message string) {
+		conn.Write([]byte(message + "\n"))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading echo of %q: %v", message, err)
+		}
+		if line != message + "\n" {
+			t.Fatalf("expected echo %q, got %q", message, line)
+		}
+	}
+
+	echo("hello")
+
+	// the session must outlive the route timeout
+	time.Sleep(500 * time.Millisecond)
+	echo("still there")
+
+	// the open session is no longer a request in flight for SmartShield
+	client := shield.getClient("127.0.0.1")
+	client.Lock()
+	inFlight := client.inFlight
+	client.Unlock()
+	if inFlight != 0 {
+		t.Fatalf("expected no request in flight, got %d", inFlight)
+	}
+}
+
+func TestServerSentEventsAreFlushedThroughChain(t *testing.T) {
+	release := make(chan bool)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+			case <-release:
+			case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	route := chainRoute(backend.URL)
+	route.Timeout = 0
+	front := newRouteServer(t, route, false)
+
+	received := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(front.URL + "/events")
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		received <- line
+	}()
+
+	select {
+		case line := <-received:
+			if line != "data: first\n" {
+				t.Fatalf("unexpected event %q", line)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("event was not flushed to the client")
+	}
+}
+
+func TestGRPCUpstreamOverH2C(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "expected HTTP/2, got " + r.Proto, http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		w.(http.Flusher).Flush()
+
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "OK")
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	route := chainRoute(backend.URL)
+	route.UpstreamProtocol = "GRPC"
+	front := newRouteServer(t, route, true)
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+
+	req, _ := http.NewRequest("POST", front.URL + "/helloworld.Greeter/SayHello", strings.NewReader("message"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if string(body) != "message" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "OK" {
+		t.Fatalf("trailers were not forwarded: %v", resp.Trailer)
+	}
+}
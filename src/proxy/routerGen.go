@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/azukaar/cosmos-server/src/user"
@@ -12,11 +13,18 @@ import (
 	"github.com/gorilla/mux"
 )
 
-func tokenMiddleware(enabled bool) func(next http.Handler) http.Handler {
+func tokenMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	audience := route.TokenAudience
+	if audience == "" {
+		audience = route.Name
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			r.Header.Set("x-cosmos-user", "")
 			r.Header.Set("x-cosmos-role", "")
+			r.Header.Del("x-cosmos-groups")
+			r.Header.Del("x-cosmos-token")
 
 			u, err := user.RefreshUserToken(w, r)
 
@@ -26,17 +34,27 @@ func tokenMiddleware(enabled bool) func(next http.Handler) http.Handler {
 
 			r.Header.Set("x-cosmos-user", u.Nickname)
 			r.Header.Set("x-cosmos-role", strconv.Itoa((int)(u.Role)))
+			if len(u.Groups) > 0 {
+				r.Header.Set("x-cosmos-groups", strings.Join(u.Groups, ","))
+			}
 
 			ogcookies := r.Header.Get("Cookie")
 			cookieRemoveRegex := regexp.MustCompile(`jwttoken=[^;]*;`)
 			cookies := cookieRemoveRegex.ReplaceAllString(ogcookies, "")
 			r.Header.Set("Cookie", cookies)
 
-			// Replace the token with a application speicfic one
-			r.Header.Set("x-cosmos-token", "1234567890")
+			// Replace the token with a application specific one
+			if u.Nickname != "" {
+				appToken, errT := user.MakeAppToken(u, route.Name, audience)
+				if errT != nil {
+					utils.ReqLog(r).Error("Route " + route.Name + ": signing app token", errT)
+				} else {
+					r.Header.Set("x-cosmos-token", appToken)
+				}
+			}
 
-			if enabled {
-				utils.LoggedInOnlyWithRedirect(w, r)
+			if route.AuthEnabled && utils.LoggedInOnlyWithRedirect(w, r) != nil {
+				return
 			}
 
 			next.ServeHTTP(w, r)
@@ -58,6 +76,8 @@ func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination htt
 		origin = origin.PathPrefix(route.PathPrefix)
 	}
 	
+	destination = PathRewriteMiddleware(route.PathRewrite)(destination)
+
 	if route.UsePathPrefix && route.StripPathPrefix {
 		if route.PathPrefix != "" && route.PathPrefix[0] != '/' {
 			utils.Error("PathPrefix must start with a /", nil)
@@ -65,6 +85,13 @@ func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination htt
 		destination = http.StripPrefix(route.PathPrefix, destination)
 	}
 	
+	destination = MaintenanceMiddleware(route)(destination)
+
+	destination = CacheMiddleware(route)(destination)
+
+	// inside SmartShield, which must count the bytes actually sent
+	destination = utils.CompressionMiddleware(route.Compression)(destination)
+
 	destination = SmartShieldMiddleware(route.SmartShield)(destination)
 
 	originCORS := route.CORSOrigin
@@ -92,9 +119,10 @@ func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination htt
 	if throttlePerMinute > 0 {
 		throtthleTime := time.Minute
 		destination = httprate.Limit(throttlePerMinute, throtthleTime,
-			httprate.WithKeyFuncs(httprate.KeyByIP),
+			httprate.WithKeyFuncs(KeyByClientID),
 			httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
-				utils.Error("Too many requests. Throttling", nil)
+				utils.ReqLog(r).Error("Too many requests. Throttling", nil)
+				utils.MetricHTTPThrottled.Inc(utils.GetRouteName(r))
 				utils.HTTPError(w, "Too many requests",
 					http.StatusTooManyRequests, "HTTP003")
 				return
@@ -106,7 +134,9 @@ func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination htt
 		destination = utils.BandwithLimiterMiddleware(route.MaxBandwith)(destination)
 	}
 
-	origin.Handler(tokenMiddleware(route.AuthEnabled)(utils.CORSHeader(originCORS)((destination))))
+	accessLog := AccessLogMiddleware(utils.GetMainConfig().AccessLogConfig.Enabled)
+
+	origin.Handler(utils.MetricsMiddleware(route.Name)(accessLog(tokenMiddleware(route)(AccessPolicyMiddleware(route)(ForwardAuthMiddleware(route)(HeaderRulesMiddleware(route)(utils.CORSHeader(originCORS)((destination)))))))))
 
 	utils.Log("Added route: [" + (string)(route.Mode) + "] " + route.Host + route.PathPrefix + " to " + route.Target + "")
 
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"github.com/azukaar/cosmos-server/src/utils"
+	"hash/fnv"
 	"sync"
 	"time"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"net"
 	"math"
 	"strconv"
+	"strings"
 )
 
 /*
@@ -27,77 +29,397 @@ type userBan struct {
 	time time.Time
 }
 
-type smartShieldState struct {
+// Usage is accounted per client in one-minute buckets over a sliding hour,
+// so the cost of a request does not depend on the traffic of other clients
+const shieldBucketSeconds = 60
+const shieldBuckets = 60
+const shieldShards = 64
+
+var metricShieldBans = utils.NewCounter("cosmos_shield_bans_total",
+	"Strikes and bans given by SmartShield, by type", "type")
+var metricShieldActiveBans = utils.NewGauge("cosmos_shield_active_bans",
+	"Strikes and bans currently blocking a client, by type", "type")
+var metricShieldClients = utils.NewGauge("cosmos_shield_clients",
+	"Clients tracked by SmartShield")
+
+func init() {
+	utils.OnMetricsScrape(func() {
+		active := map[int]int{}
+		for _, ban := range shield.GetActiveBans() {
+			active[ban.banType]++
+		}
+		for banType, label := range banTypeLabels {
+			metricShieldActiveBans.Set(float64(active[banType]), label)
+		}
+
+		clients := 0
+		shield.forEachClient(func(client *clientState) {
+			clients++
+		})
+		metricShieldClients.Set(float64(clients))
+	})
+}
+
+type usageBucket struct {
+	minute int64
+	time float64
+	requests int
+	bytes int64
+}
+
+type clientState struct {
 	sync.Mutex
-	requests []*SmartResponseWriterWrapper
+	ClientID string
+	buckets [shieldBuckets]usageBucket
+	inFlight int
+	// sum of the start times of in-flight requests, in seconds
+	inFlightStarted float64
 	bans []*userBan
 }
 
+type shieldShard struct {
+	sync.RWMutex
+	clients map[string]*clientState
+}
+
+type smartShieldState struct {
+	shards [shieldShards]shieldShard
+}
+
 type userUsedBudget struct {
-	ClientID string
-	Time float64
-	Requests int
-	Bytes int64
+	ClientID string `json:"clientID"`
+	Time float64 `json:"time"`
+	Requests int `json:"requests"`
+	Bytes int64 `json:"bytes"`
 }
 
-var shield smartShieldState
+var shield = newSmartShieldState()
 
-func (shield *smartShieldState) GetUserUsedBudgets(ClientID string) userUsedBudget {
-	shield.Lock()
-	defer shield.Unlock()
+func newSmartShieldState() *smartShieldState {
+	state := &smartShieldState{}
+	for i := range state.shards {
+		state.shards[i].clients = map[string]*clientState{}
+	}
+	return state
+}
 
-	userConsumed	:= userUsedBudget{
-		ClientID: ClientID,
-		Time: 0,
-		Requests: 0,
-		Bytes: 0,
+func (shield *smartShieldState) getShard(ClientID string) *shieldShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(ClientID))
+	return &shield.shards[hash.Sum32() % shieldShards]
+}
+
+// getClient returns the state of a client, creating it if needed
+func (shield *smartShieldState) getClient(ClientID string) *clientState {
+	shard := shield.getShard(ClientID)
+
+	shard.RLock()
+	client, ok := shard.clients[ClientID]
+	shard.RUnlock()
+
+	if ok {
+		return client
 	}
 
-	// Check for recent requests
-	for i := len(shield.requests) - 1; i >= 0; i-- {
-		request := shield.requests[i]
-		if(request.IsOld()) {
-			return userConsumed
+	shard.Lock()
+	defer shard.Unlock()
+
+	client, ok = shard.clients[ClientID]
+	if !ok {
+		client = &clientState{
+			ClientID: ClientID,
+		}
+		shard.clients[ClientID] = client
+	}
+
+	return client
+}
+
+// forEachClient calls fn on every client, one shard locked at a time
+func (shield *smartShieldState) forEachClient(fn func(client *clientState)) {
+	for i := range shield.shards {
+		shard := &shield.shards[i]
+		shard.RLock()
+		clients := make([]*clientState, 0, len(shard.clients))
+		for _, client := range shard.clients {
+			clients = append(clients, client)
 		}
-		if request.ClientID == ClientID && !request.IsOld() {
-			if(request.IsOver()) {
-				userConsumed.Time += request.TimeEnded.Sub(request.TimeStarted).Seconds()
+		shard.RUnlock()
+
+		for _, client := range clients {
+			fn(client)
+		}
+	}
+}
+
+func getMinute(t time.Time) int64 {
+	return t.Unix() / shieldBucketSeconds
+}
+
+// getBucket returns the bucket of the current minute, must hold the client lock
+func (client *clientState) getBucket(now time.Time) *usageBucket {
+	minute := getMinute(now)
+	bucket := &client.buckets[minute % shieldBuckets]
+	if bucket.minute != minute {
+		*bucket = usageBucket{
+			minute: minute,
+		}
+	}
+	return bucket
+}
+
+func (client *clientState) startRequest(started time.Time) {
+	client.Lock()
+	defer client.Unlock()
+
+	client.inFlight++
+	client.inFlightStarted += float64(started.UnixNano()) / 1e9
+	client.getBucket(started).requests++
+}
+
+func (client *clientState) endRequest(started time.Time, ended time.Time) {
+	client.Lock()
+	defer client.Unlock()
+
+	client.inFlight--
+	client.inFlightStarted -= float64(started.UnixNano()) / 1e9
+	client.getBucket(ended).time += ended.Sub(started).Seconds()
+}
+
+func (client *clientState) addCost(cost int) {
+	client.Lock()
+	defer client.Unlock()
+
+	client.getBucket(time.Now()).requests += cost
+}
+
+func (client *clientState) addBytes(bytes int64) {
+	client.Lock()
+	defer client.Unlock()
+
+	client.getBucket(time.Now()).bytes += bytes
+}
+
+// getUsage sums the buckets of the last hour, must hold the client lock
+func (client *clientState) getUsage(now time.Time) userUsedBudget {
+	userConsumed := userUsedBudget{
+		ClientID: client.ClientID,
+	}
+
+	oldest := getMinute(now) - shieldBuckets
+	for i := range client.buckets {
+		bucket := &client.buckets[i]
+		if bucket.minute > oldest {
+			userConsumed.Time += bucket.time
+			userConsumed.Requests += bucket.requests
+			userConsumed.Bytes += bucket.bytes
+		}
+	}
+
+	if client.inFlight > 0 {
+		userConsumed.Time += float64(client.inFlight) * float64(now.UnixNano()) / 1e9 - client.inFlightStarted
+	}
+
+	return userConsumed
+}
+
+// isIdle returns true if the client can be forgotten, must hold the client lock
+func (client *clientState) isIdle(now time.Time) bool {
+	if client.inFlight > 0 {
+		return false
+	}
+
+	oldest := getMinute(now) - shieldBuckets
+	for i := range client.buckets {
+		if client.buckets[i].minute > oldest {
+			return false
+		}
+	}
+
+	for _, ban := range client.bans {
+		if isBanRelevant(ban) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkRequest returns the usage of the client and whether it can proceed
+func (client *clientState) checkRequest(policy utils.SmartShieldPolicy) (userUsedBudget, bool) {
+	client.Lock()
+	defer client.Unlock()
+
+	userConsumed := client.getUsage(time.Now())
+	return userConsumed, client.isAllowedToReqest(policy, userConsumed)
+}
+
+func (shield *smartShieldState) GetUserUsedBudgets(ClientID string) userUsedBudget {
+	client := shield.getClient(ClientID)
+
+	client.Lock()
+	defer client.Unlock()
+
+	return client.getUsage(time.Now())
+}
+
+// GetAllUsedBudgets returns the recent usage of every client seen in the last hour
+func (shield *smartShieldState) GetAllUsedBudgets() []userUsedBudget {
+	now := time.Now()
+	result := []userUsedBudget{}
+
+	shield.forEachClient(func(client *clientState) {
+		client.Lock()
+		defer client.Unlock()
+
+		userConsumed := client.getUsage(now)
+		if userConsumed.Requests > 0 || client.inFlight > 0 {
+			result = append(result, userConsumed)
+		}
+	})
+
+	return result
+}
+
+// CleanUpSmartShield forgets clients without recent usage or relevant bans
+func CleanUpSmartShield() {
+	now := time.Now()
+	removed := 0
+
+	for i := range shield.shards {
+		shard := &shield.shards[i]
+		shard.Lock()
+		for clientID, client := range shard.clients {
+			client.Lock()
+			if client.isIdle(now) {
+				delete(shard.clients, clientID)
+				removed++
 			} else {
-				userConsumed.Time += time.Now().Sub(request.TimeStarted).Seconds()
+				bans := client.bans[:0]
+				for _, ban := range client.bans {
+					if isBanRelevant(ban) {
+						bans = append(bans, ban)
+					}
+				}
+				client.bans = bans
 			}
-			userConsumed.Requests += request.RequestCost
-			userConsumed.Bytes += request.Bytes
+			client.Unlock()
 		}
+		shard.Unlock()
 	}
 
-	return userConsumed
+	utils.Debug("SmartShield: Cleaned up " + strconv.Itoa(removed) + " idle clients")
+}
+
+// getBanExpiry returns when a ban stops blocking its client, zero for PERM bans
+func getBanExpiry(ban *userBan) time.Time {
+	switch ban.banType {
+		case TEMP:
+			return ban.time.Add(4 * 3600 * time.Second)
+		case STRIKE:
+			return ban.time.Add(3600 * time.Second)
+	}
+	return time.Time{}
+}
+
+func isBanActive(ban *userBan) bool {
+	return ban.banType == PERM || getBanExpiry(ban).After(time.Now())
+}
+
+func (shield *smartShieldState) GetActiveBans() []userBan {
+	bans := []userBan{}
+
+	shield.forEachClient(func(client *clientState) {
+		client.Lock()
+		defer client.Unlock()
+
+		for i := len(client.bans) - 1; i >= 0; i-- {
+			if isBanActive(client.bans[i]) {
+				bans = append(bans, *client.bans[i])
+			}
+		}
+	})
+
+	return bans
+}
+
+// LiftBans removes every ban and strike of a client, returns how many were removed
+func (shield *smartShieldState) LiftBans(ClientID string) int {
+	client := shield.getClient(ClientID)
+
+	client.Lock()
+	defer client.Unlock()
+
+	removed := len(client.bans)
+	client.bans = nil
+	return removed
+}
+
+func (shield *smartShieldState) AddPermBan(ClientID string) {
+	client := shield.getClient(ClientID)
+
+	client.Lock()
+	defer client.Unlock()
+
+	client.addBan(ClientID, PERM)
+}
+
+// isAllowListed checks a client against a list of IPs, CIDRs or client IDs
+func isAllowListed(ClientID string, allowList []string) bool {
+	ip := net.ParseIP(ClientID)
+
+	for _, allowed := range allowList {
+		if allowed == ClientID {
+			return true
+		}
+
+		if ip != nil && strings.Contains(allowed, "/") {
+			_, cidr, err := net.ParseCIDR(allowed)
+			if err != nil {
+				utils.Error("SmartShield: Invalid CIDR in allow list: " + allowed, err)
+				continue
+			}
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
-func (shield *smartShieldState) isAllowedToReqest(policy utils.SmartShieldPolicy, userConsumed userUsedBudget) bool {
-	shield.Lock()
-	defer shield.Unlock()
+// addBan must hold the client lock
+func (client *clientState) addBan(ClientID string, banType int) {
+	client.bans = append(client.bans, &userBan{
+		ClientID: ClientID,
+		banType: banType,
+		time: time.Now(),
+	})
+	metricShieldBans.Inc(banTypeLabels[banType])
+}
 
+// isAllowedToReqest must hold the client lock
+func (client *clientState) isAllowedToReqest(policy utils.SmartShieldPolicy, userConsumed userUsedBudget) bool {
 	ClientID := userConsumed.ClientID
 	
 	nbTempBans := 0
 	nbStrikes := 0
 
 	// Check for bans
-	for i := len(shield.bans) - 1; i >= 0; i-- {
-		ban := shield.bans[i]
+	for i := len(client.bans) - 1; i >= 0; i-- {
+		ban := client.bans[i]
 		if ban.banType == PERM {
 			return false
 		} else if ban.banType == TEMP {
-			if(ban.time.Add(4 * 3600 * time.Second).Before(time.Now())) {
+			if(ban.time.Add(4 * 3600 * time.Second).After(time.Now())) {
 				return false
-			} else if (ban.time.Add(72 * 3600 * time.Second).Before(time.Now())) {
+			} else if (ban.time.Add(72 * 3600 * time.Second).After(time.Now())) {
 				nbTempBans++
 			}
 		} else if ban.banType == STRIKE {
-			return false
-			if(ban.time.Add(3600 * time.Second).Before(time.Now())) {
+			if(ban.time.Add(3600 * time.Second).After(time.Now())) {
 				return false
-			} else if (ban.time.Add(24 * 3600 * time.Second).Before(time.Now())) {
+			} else if (ban.time.Add(24 * 3600 * time.Second).After(time.Now())) {
 				nbStrikes++
 			}
 		}
@@ -106,19 +428,11 @@ func (shield *smartShieldState) isAllowedToReqest(policy utils.SmartShieldPolicy
 	// Check for new bans
 	if nbTempBans >= 3 {
 		// perm ban
-		shield.bans = append(shield.bans, &userBan{
-			ClientID: ClientID,
-			banType: PERM,
-			time: time.Now(),
-		})
+		client.addBan(ClientID, PERM)
 		return false
 	} else if nbStrikes >= 3 {
 		// temp ban
-		shield.bans = append(shield.bans, &userBan{
-			ClientID: ClientID,
-			banType: TEMP,
-			time: time.Now(),
-		})
+		client.addBan(ClientID, TEMP)
 		return false
 	}
 
@@ -126,21 +440,14 @@ func (shield *smartShieldState) isAllowedToReqest(policy utils.SmartShieldPolicy
 	if (userConsumed.Time > (policy.PerUserTimeBudget * float64(policy.PolicyStrictness))) || 
 		 (userConsumed.Requests > (policy.PerUserRequestLimit * policy.PolicyStrictness)) ||
 		 (userConsumed.Bytes > (policy.PerUserByteLimit * int64(policy.PolicyStrictness))) {
-		shield.bans = append(shield.bans, &userBan{
-			ClientID: ClientID,
-			banType: STRIKE,
-			time: time.Now(),
-		})
+		client.addBan(ClientID, STRIKE)
 		return false
 	}
 
 	return true
 }
 
-func (shield *smartShieldState) computeThrottle(policy utils.SmartShieldPolicy, userConsumed userUsedBudget) int {	
-	shield.Lock()
-	defer shield.Unlock()
-
+func computeThrottle(policy utils.SmartShieldPolicy, userConsumed userUsedBudget) int {	
 	throttle := 0
 
 	overReq := policy.PerUserRequestLimit - userConsumed.Requests
@@ -180,9 +487,70 @@ func calculateLowestExhaustedPercentage(policy utils.SmartShieldPolicy, userCons
 	return int64(math.Max(0, math.Min(math.Min(timeExhaustedPercentage, requestsExhaustedPercentage), bytesExhaustedPercentage)))
 }
 
+// GetClientID identifies the client in SmartShield and throttling: its real IP
+// (see utils.GetClientIP) or, if enabled, the nickname of the logged in user.
+// x-cosmos-user is set by the token middleware, which runs first
 func GetClientID(r *http.Request) string {
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return ip
+	if utils.GetMainConfig().HTTPConfig.IdentifyUsersByNickname {
+		if nickname := r.Header.Get("x-cosmos-user"); nickname != "" {
+			return nickname
+		}
+	}
+
+	return utils.GetClientIP(r)
+}
+
+// KeyByClientID is an httprate key func using GetClientID
+func KeyByClientID(r *http.Request) (string, error) {
+	return GetClientID(r), nil
+}
+
+func applyPolicyOverride(policy utils.SmartShieldPolicy, override utils.SmartShieldPolicyOverride) utils.SmartShieldPolicy {
+	if override.PolicyStrictness != 0 {
+		policy.PolicyStrictness = override.PolicyStrictness
+	}
+	if override.PerUserTimeBudget != 0 {
+		policy.PerUserTimeBudget = override.PerUserTimeBudget
+	}
+	if override.PerUserRequestLimit != 0 {
+		policy.PerUserRequestLimit = override.PerUserRequestLimit
+	}
+	if override.PerUserByteLimit != 0 {
+		policy.PerUserByteLimit = override.PerUserByteLimit
+	}
+	return policy
+}
+
+// resolvePolicy applies the overrides matching the role then the nickname of the
+// user, the ones of the route win over the global ones. Anonymous clients are GUEST
+func resolvePolicy(policy utils.SmartShieldPolicy, r *http.Request) utils.SmartShieldPolicy {
+	nickname := r.Header.Get("x-cosmos-user")
+	role := utils.GUEST
+
+	if nickname != "" {
+		role, _ = strconv.Atoi(r.Header.Get("x-cosmos-role"))
+	}
+
+	roleName := utils.RoleNames[utils.Role(role)]
+	global := utils.GetMainConfig().SmartShieldConfig
+
+	if override, ok := global.RolePolicies[roleName]; ok {
+		policy = applyPolicyOverride(policy, override)
+	}
+	if override, ok := policy.RolePolicies[roleName]; ok {
+		policy = applyPolicyOverride(policy, override)
+	}
+
+	if nickname != "" {
+		if override, ok := global.UserPolicies[nickname]; ok {
+			policy = applyPolicyOverride(policy, override)
+		}
+		if override, ok := policy.UserPolicies[nickname]; ok {
+			policy = applyPolicyOverride(policy, override)
+		}
+	}
+
+	return policy
 }
 
 func SmartShieldMiddleware(policy utils.SmartShieldPolicy) func(http.Handler) http.Handler {
@@ -206,17 +574,34 @@ func SmartShieldMiddleware(policy utils.SmartShieldPolicy) func(http.Handler) ht
 	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			utils.Log("SmartShield: Request received")
+			utils.ReqLog(r).Log("SmartShield: Request received")
 			clientID := GetClientID(r)
-			userConsumed := shield.GetUserUsedBudgets(clientID)
+			clientIP := utils.GetClientIP(r)
+
+			if isAllowListed(clientIP, policy.AllowList) ||
+				 isAllowListed(clientIP, utils.GetMainConfig().SmartShieldConfig.AllowList) ||
+				 isAllowListed(clientID, policy.AllowList) ||
+				 isAllowListed(clientID, utils.GetMainConfig().SmartShieldConfig.AllowList) {
+				utils.ReqLog(r).Debug("SmartShield: " + clientID + " is allow-listed")
+				next.ServeHTTP(w, r)
+				return
+			}
 
-			if !shield.isAllowedToReqest(policy, userConsumed) {
-				utils.Log("SmartShield: User is banned")
+			userPolicy := resolvePolicy(policy, r)
+			if info := utils.GetRequestInfo(r); info != nil {
+				info.ClientID = clientID
+			}
+
+			client := shield.getClient(clientID)
+			userConsumed, allowed := client.checkRequest(userPolicy)
+
+			if !allowed {
+				utils.ReqLog(r).Log("SmartShield: User is banned")
 				http.Error(w, "Too many requests", http.StatusTooManyRequests)
 				return
 			} else {
-				utils.Debug("SmartShield: Creating request")
-				throttle := shield.computeThrottle(policy, userConsumed)
+				utils.ReqLog(r).Debug("SmartShield: Creating request")
+				throttle := computeThrottle(userPolicy, userConsumed)
 				wrapper := &SmartResponseWriterWrapper {
 					ResponseWriter: w,
 					ThrottleNext:   throttle,
@@ -224,30 +609,30 @@ func SmartShieldMiddleware(policy utils.SmartShieldPolicy) func(http.Handler) ht
 					ClientID:       clientID,
 					RequestCost:    1,
 					Method: 				r.Method,
-					shield: shield,
-					policy: policy,
+					client: client,
+					policy: userPolicy,
 				}
 
 				// add rate limite headers
 				In20Minutes := strconv.FormatInt(time.Now().Add(20 * time.Minute).Unix(), 10)
-				w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(calculateLowestExhaustedPercentage(policy, userConsumed), 10))
-				w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(int64(policy.PerUserRequestLimit), 10))
+				w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(calculateLowestExhaustedPercentage(userPolicy, userConsumed), 10))
+				w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(int64(userPolicy.PerUserRequestLimit), 10))
 				w.Header().Set("X-RateLimit-Reset", In20Minutes)
 
-				utils.Debug("SmartShield: Adding request")
-				shield.Lock()
-				shield.requests = append(shield.requests, wrapper)
-				shield.Unlock()
+				client.startRequest(wrapper.TimeStarted)
+				defer func() {
+					wrapper.TimeEnded = time.Now()
+					wrapper.isOver = true
+					// already accounted for when the connection was hijacked
+					if wrapper.TimeHijacked.IsZero() {
+						client.endRequest(wrapper.TimeStarted, wrapper.TimeEnded)
+					}
+					utils.ReqLog(r).Debug("SmartShield: Request finished")
+				}()
 				
-				utils.Debug("SmartShield: Processing request")
+				utils.ReqLog(r).Debug("SmartShield: Processing request")
 				next.ServeHTTP(wrapper, r)
-
-				shield.Lock()
-				wrapper.TimeEnded = time.Now()
-				wrapper.isOver = true
-				shield.Unlock()
-				utils.Debug("SmartShield: Request finished")
 			}
 		})
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// Upper bounds of the snapshot, idle clients are dropped first
+const maxSnapshotClients = 100000
+const maxSnapshotBansPerClient = 100
+
+type shieldSnapshot struct {
+	SavedAt time.Time
+	Clients []clientSnapshot
+}
+
+type clientSnapshot struct {
+	ClientID string
+	Buckets []bucketSnapshot
+	Bans []banSnapshot
+}
+
+type bucketSnapshot struct {
+	Minute int64
+	Time float64
+	Requests int
+	Bytes int64
+}
+
+type banSnapshot struct {
+	BanType int
+	Time time.Time
+}
+
+func getShieldSnapshotFile() string {
+	return filepath.Join(filepath.Dir(utils.GetConfigFileName()), "smartshield.json")
+}
+
+// isBanRelevant returns false for bans that can no longer
+// block a client or count toward a harsher ban
+func isBanRelevant(ban *userBan) bool {
+	switch ban.banType {
+		case PERM:
+			return true
+		case TEMP:
+			return ban.time.Add(72 * 3600 * time.Second).After(time.Now())
+		case STRIKE:
+			return ban.time.Add(24 * 3600 * time.Second).After(time.Now())
+	}
+	return false
+}
+
+func (client *clientState) snapshot(now time.Time) clientSnapshot {
+	client.Lock()
+	defer client.Unlock()
+
+	snap := clientSnapshot{
+		ClientID: client.ClientID,
+		Buckets: []bucketSnapshot{},
+		Bans: []banSnapshot{},
+	}
+
+	oldest := getMinute(now) - shieldBuckets
+	for _, bucket := range client.buckets {
+		if bucket.minute > oldest {
+			snap.Buckets = append(snap.Buckets, bucketSnapshot{
+				Minute: bucket.minute,
+				Time: bucket.time,
+				Requests: bucket.requests,
+				Bytes: bucket.bytes,
+			})
+		}
+	}
+
+	for i := len(client.bans) - 1; i >= 0 && len(snap.Bans) < maxSnapshotBansPerClient; i-- {
+		ban := client.bans[i]
+		if isBanRelevant(ban) {
+			snap.Bans = append(snap.Bans, banSnapshot{
+				BanType: ban.banType,
+				Time: ban.time,
+			})
+		}
+	}
+
+	return snap
+}
+
+func (shield *smartShieldState) snapshot() shieldSnapshot {
+	snap := shieldSnapshot{
+		SavedAt: time.Now(),
+		Clients: []clientSnapshot{},
+	}
+
+	// banned clients are kept first when the snapshot is full
+	withBans := []clientSnapshot{}
+	withUsage := []clientSnapshot{}
+
+	shield.forEachClient(func(client *clientState) {
+		clientSnap := client.snapshot(snap.SavedAt)
+		if len(clientSnap.Bans) > 0 {
+			withBans = append(withBans, clientSnap)
+		} else if len(clientSnap.Buckets) > 0 {
+			withUsage = append(withUsage, clientSnap)
+		}
+	})
+
+	for _, clientSnap := range append(withBans, withUsage...) {
+		if len(snap.Clients) >= maxSnapshotClients {
+			break
+		}
+		snap.Clients = append(snap.Clients, clientSnap)
+	}
+
+	return snap
+}
+
+func (shield *smartShieldState) restore(snap shieldSnapshot) {
+	oldest := getMinute(time.Now()) - shieldBuckets
+
+	for _, clientSnap := range snap.Clients {
+		client := shield.getClient(clientSnap.ClientID)
+
+		client.Lock()
+		for _, bucket := range clientSnap.Buckets {
+			if bucket.Minute > oldest {
+				client.buckets[bucket.Minute % shieldBuckets] = usageBucket{
+					minute: bucket.Minute,
+					time: bucket.Time,
+					requests: bucket.Requests,
+					bytes: bucket.Bytes,
+				}
+			}
+		}
+
+		// snapshots are stored newest first
+		for i := len(clientSnap.Bans) - 1; i >= 0; i-- {
+			client.bans = append(client.bans, &userBan{
+				ClientID: clientSnap.ClientID,
+				banType: clientSnap.Bans[i].BanType,
+				time: clientSnap.Bans[i].Time,
+			})
+		}
+		client.Unlock()
+	}
+}
+
+// SaveSmartShield writes the current usage and bans to the config folder
+func SaveSmartShield() {
+	snap := shield.snapshot()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		utils.Error("SmartShield: Cannot serialize state", err)
+		return
+	}
+
+	// write then rename, so a crash never leaves a truncated file
+	file := getShieldSnapshotFile()
+	errW := os.WriteFile(file + ".tmp", data, 0600)
+	if errW != nil {
+		utils.Error("SmartShield: Cannot save state", errW)
+		return
+	}
+
+	errR := os.Rename(file + ".tmp", file)
+	if errR != nil {
+		utils.Error("SmartShield: Cannot save state", errR)
+		return
+	}
+
+	utils.Debug("SmartShield: State saved")
+}
+
+// LoadSmartShield restores the state saved by SaveSmartShield, if any
+func LoadSmartShield() {
+	data, err := os.ReadFile(getShieldSnapshotFile())
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		utils.Error("SmartShield: Cannot read saved state", err)
+		return
+	}
+
+	var snap shieldSnapshot
+	errJ := json.Unmarshal(data, &snap)
+	if errJ != nil {
+		utils.Error("SmartShield: Saved state is corrupted, ignoring it", errJ)
+		return
+	}
+
+	shield.restore(snap)
+
+	utils.Log("SmartShield: Restored the state of " + strconv.Itoa(len(snap.Clients)) + " clients")
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {}
+
+func (w *discardResponseWriter) Flush() {}
+
+func benchmarkPolicy() utils.SmartShieldPolicy {
+	return utils.SmartShieldPolicy{
+		Enabled: true,
+		PerUserRequestLimit: 1 << 30,
+		PerUserByteLimit: 1 << 50,
+		PerUserTimeBudget: 1 << 30,
+	}
+}
+
+func newShieldRequest(clientID string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = clientID + ":1234"
+	return req
+}
+
+// preloadShield simulates the traffic of other clients in the last hour
+func preloadShield(handler http.Handler, requests int) {
+	for i := 0; i < requests; i++ {
+		clientID := "10.1." + strconv.Itoa((i / 250) % 250) + "." + strconv.Itoa(i % 250)
+		handler.ServeHTTP(&discardResponseWriter{header: http.Header{}}, newShieldRequest(clientID))
+	}
+}
+
+func benchmarkShield(b *testing.B, traffic int, chunks int) {
+	utils.MainConfig.LoggingLevel = "ERROR"
+	shield = newSmartShieldState()
+
+	chunk := make([]byte, 32 * 1024)
+	handler := SmartShieldMiddleware(benchmarkPolicy())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < chunks; i++ {
+			w.Write(chunk)
+		}
+	}))
+
+	preloadShield(handler, traffic)
+
+	var clients int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		clientID := "10.2.0." + strconv.FormatInt(atomic.AddInt64(&clients, 1), 10)
+		for pb.Next() {
+			handler.ServeHTTP(&discardResponseWriter{header: http.Header{}}, newShieldRequest(clientID))
+		}
+	})
+}
+
+// Cost of a small request should not depend on the traffic of other clients
+func BenchmarkSmartShieldRequest(b *testing.B) {
+	for _, traffic := range []int{0, 10000, 100000} {
+		b.Run("traffic=" + strconv.Itoa(traffic), func(b *testing.B) {
+			benchmarkShield(b, traffic, 1)
+		})
+	}
+}
+
+// A download written in many chunks checks the budget on every chunk
+func BenchmarkSmartShieldDownload(b *testing.B) {
+	for _, traffic := range []int{0, 10000, 100000} {
+		b.Run("traffic=" + strconv.Itoa(traffic), func(b *testing.B) {
+			benchmarkShield(b, traffic, 64)
+		})
+	}
+}
+
+// legacyShieldState is the store SmartShield had before the sharded
+// buckets: one list of every request of the last hour, scanned under a
+// global lock for each request and each written chunk. It is kept as
+// the baseline of the benchmarks above
+type legacyShieldRequest struct {
+	clientID string
+	started time.Time
+	ended time.Time
+	cost int
+	bytes int64
+}
+
+type legacyShieldState struct {
+	sync.Mutex
+	requests []*legacyShieldRequest
+}
+
+func (state *legacyShieldState) usedBudget(clientID string) userUsedBudget {
+	state.Lock()
+	defer state.Unlock()
+
+	consumed := userUsedBudget{ClientID: clientID}
+
+	for i := len(state.requests) - 1; i >= 0; i-- {
+		request := state.requests[i]
+		if time.Since(request.started) > time.Hour {
+			break
+		}
+		if request.clientID == clientID {
+			end := request.ended
+			if end.IsZero() {
+				end = time.Now()
+			}
+			consumed.Time += end.Sub(request.started).Seconds()
+			consumed.Requests += request.cost
+			consumed.Bytes += request.bytes
+		}
+	}
+
+	return consumed
+}
+
+func (state *legacyShieldState) serve(clientID string, chunks int, chunkSize int) {
+	state.usedBudget(clientID)
+
+	request := &legacyShieldRequest{clientID: clientID, started: time.Now(), cost: 1}
+	state.Lock()
+	state.requests = append(state.requests, request)
+	state.Unlock()
+
+	for i := 0; i < chunks; i++ {
+		state.usedBudget(clientID)
+		state.Lock()
+		request.bytes += int64(chunkSize)
+		state.Unlock()
+	}
+
+	state.Lock()
+	request.ended = time.Now()
+	state.Unlock()
+}
+
+func benchmarkLegacyShield(b *testing.B, traffic int, chunks int) {
+	state := &legacyShieldState{}
+
+	now := time.Now()
+	for i := 0; i < traffic; i++ {
+		state.requests = append(state.requests, &legacyShieldRequest{
+			clientID: "10.1." + strconv.Itoa((i / 250) % 250) + "." + strconv.Itoa(i % 250),
+			started: now,
+			ended: now,
+			cost: 1,
+			bytes: 32 * 1024,
+		})
+	}
+
+	var clients int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		clientID := "10.2.0." + strconv.FormatInt(atomic.AddInt64(&clients, 1), 10)
+		for pb.Next() {
+			state.serve(clientID, chunks, 32 * 1024)
+		}
+	})
+}
+
+func BenchmarkLegacySmartShieldRequest(b *testing.B) {
+	for _, traffic := range []int{0, 10000, 100000} {
+		b.Run("traffic=" + strconv.Itoa(traffic), func(b *testing.B) {
+			benchmarkLegacyShield(b, traffic, 1)
+		})
+	}
+}
+
+func BenchmarkLegacySmartShieldDownload(b *testing.B) {
+	for _, traffic := range []int{0, 10000, 100000} {
+		b.Run("traffic=" + strconv.Itoa(traffic), func(b *testing.B) {
+			benchmarkLegacyShield(b, traffic, 64)
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/docker"
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// an upstream failing maxUpstreamFails times in a row is taken out of
+// rotation for upstreamEjectDuration (passive health check)
+const maxUpstreamFails = 3
+const upstreamEjectDuration = 30 * time.Second
+
+type upstream struct {
+	target *url.URL
+	proxy *httputil.ReverseProxy
+	active int64
+
+	// guarded by the pool lock
+	fails int
+	ejectedUntil time.Time
+	healthy bool
+}
+
+// upstreamPool balances a route over several upstreams
+type upstreamPool struct {
+	sync.RWMutex
+	route utils.ProxyRouteConfig
+	upstreams []*upstream
+	next uint64
+	stop chan bool
+}
+
+var upstreamPoolsLock sync.Mutex
+var upstreamPools = []*upstreamPool{}
+
+// stopUpstreamPools ends the health checks of the pools of the previous router.
+// Requests still running on it keep using their pool
+func stopUpstreamPools() {
+	upstreamPoolsLock.Lock()
+	defer upstreamPoolsLock.Unlock()
+
+	for _, pool := range upstreamPools {
+		close(pool.stop)
+	}
+	upstreamPools = []*upstreamPool{}
+}
+
+// needsUpstreamPool tells if the route is balanced or health checked
+func needsUpstreamPool(route utils.ProxyRouteConfig) bool {
+	return len(route.Targets) > 0 || route.HealthCheck.Path != "" ||
+		(route.Mode == "SERVAPP" && route.TargetLabel != "")
+}
+
+func newUpstreamPool(route utils.ProxyRouteConfig) *upstreamPool {
+	pool := &upstreamPool{
+		route: route,
+		stop: make(chan bool),
+	}
+
+	pool.setTargets(pool.resolveTargets())
+
+	upstreamPoolsLock.Lock()
+	upstreamPools = append(upstreamPools, pool)
+	upstreamPoolsLock.Unlock()
+
+	if route.HealthCheck.Path != "" || route.TargetLabel != "" {
+		go pool.run()
+	}
+
+	return pool
+}
+
+// resolveTargets lists Target, Targets and, for SERVAPP routes with a
+// TargetLabel, every container with the label
+func (pool *upstreamPool) resolveTargets() []string {
+	route := pool.route
+	targets := append([]string{route.Target}, route.Targets...)
+
+	if route.Mode == "SERVAPP" && route.TargetLabel != "" {
+		base, err := url.Parse(route.Target)
+		if err != nil {
+			utils.Error("Upstreams: invalid target " + route.Target, err)
+			return targets
+		}
+
+		names, err := docker.ListContainerNamesByLabel(route.TargetLabel)
+		if err != nil {
+			utils.Error("Upstreams: listing containers with label " + route.TargetLabel, err)
+			return targets
+		}
+
+		for _, name := range names {
+			target := *base
+			target.Host = name
+			if base.Port() != "" {
+				target.Host = name + ":" + base.Port()
+			}
+			targets = append(targets, target.String())
+		}
+	}
+
+	return targets
+}
+
+// setTargets replaces the upstreams, keeping the state of the ones still listed
+func (pool *upstreamPool) setTargets(targets []string) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	existing := map[string]*upstream{}
+	for _, u := range pool.upstreams {
+		existing[u.target.String()] = u
+	}
+
+	upstreams := []*upstream{}
+	seen := map[string]bool{}
+
+	for _, target := range targets {
+		targetURL, err := url.Parse(target)
+		if err != nil {
+			utils.Error("Upstreams: invalid target " + target, err)
+			continue
+		}
+
+		key := targetURL.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if u, ok := existing[key]; ok {
+			upstreams = append(upstreams, u)
+			continue
+		}
+
+		u, err := pool.newUpstream(targetURL)
+		if err != nil {
+			utils.Error("Upstreams: creating proxy to " + target, err)
+			continue
+		}
+		upstreams = append(upstreams, u)
+	}
+
+	pool.upstreams = upstreams
+}
+
+func (pool *upstreamPool) newUpstream(target *url.URL) (*upstream, error) {
+	proxy, err := NewProxy(target.String(), pool.route)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upstream{
+		target: target,
+		proxy: proxy,
+		healthy: true,
+	}
+
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		pool.report(u, resp.StatusCode < 500)
+		if modifyResponse != nil {
+			return modifyResponse(resp)
+		}
+		return nil
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		pool.report(u, false)
+		utils.ReqLog(r).Error("Upstreams: " + u.target.String() + " unreachable", err)
+		if !serveMaintenancePage(w, pool.route) {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+
+	return u, nil
+}
+
+// report counts the consecutive failures of an upstream, and ejects it when there are too many
+func (pool *upstreamPool) report(u *upstream, ok bool) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	if ok {
+		u.fails = 0
+		return
+	}
+
+	u.fails++
+	if u.fails >= maxUpstreamFails {
+		utils.Warn("Upstreams: ejecting " + u.target.String() + " from " + pool.route.Name + " after repeated failures")
+		u.ejectedUntil = time.Now().Add(upstreamEjectDuration)
+		u.fails = 0
+	}
+}
+
+// available must hold the pool lock
+func (pool *upstreamPool) available() []*upstream {
+	now := time.Now()
+	available := []*upstream{}
+
+	for _, u := range pool.upstreams {
+		if u.healthy && now.After(u.ejectedUntil) {
+			available = append(available, u)
+		}
+	}
+
+	return available
+}
+
+func (pool *upstreamPool) health() []UpstreamHealth {
+	pool.RLock()
+	defer pool.RUnlock()
+
+	now := time.Now()
+	health := []UpstreamHealth{}
+	for _, u := range pool.upstreams {
+		health = append(health, UpstreamHealth{
+			Target: u.target.String(),
+			Up: u.healthy,
+			Ejected: now.Before(u.ejectedUntil),
+			ActiveRequests: atomic.LoadInt64(&u.active),
+		})
+	}
+	return health
+}
+
+func (pool *upstreamPool) pick(r *http.Request) *upstream {
+	pool.RLock()
+	available := pool.available()
+	pool.RUnlock()
+
+	if len(available) == 0 {
+		return nil
+	}
+
+	switch pool.route.LoadBalancing {
+		case utils.LoadBalancingList["LEAST_CONN"]:
+			best := available[0]
+			for _, u := range available[1:] {
+				if atomic.LoadInt64(&u.active) < atomic.LoadInt64(&best.active) {
+					best = u
+				}
+			}
+			return best
+		case utils.LoadBalancingList["IP_HASH"]:
+			hash := fnv.New32a()
+			hash.Write([]byte(utils.GetClientIP(r)))
+			return available[hash.Sum32() % uint32(len(available))]
+		default:
+			next := atomic.AddUint64(&pool.next, 1)
+			return available[next % uint64(len(available))]
+	}
+}
+
+func (pool *upstreamPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u := pool.pick(r)
+
+	if u == nil {
+		utils.ReqLog(r).Error("Upstreams: no healthy upstream for " + pool.route.Name, nil)
+		if !serveMaintenancePage(w, pool.route) {
+			utils.HTTPError(w, "No healthy upstream", http.StatusServiceUnavailable, "HTTP006")
+		}
+		return
+	}
+
+	atomic.AddInt64(&u.active, 1)
+	defer atomic.AddInt64(&u.active, -1)
+
+	u.proxy.ServeHTTP(w, r)
+}
+
+// run refreshes the containers of the label and checks the upstreams until the pool is stopped
+func (pool *upstreamPool) run() {
+	interval := time.Duration(pool.route.HealthCheck.Interval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pool.checkHealth()
+
+	for {
+		select {
+			case <-pool.stop:
+				return
+			case <-ticker.C:
+				if pool.route.TargetLabel != "" {
+					pool.setTargets(pool.resolveTargets())
+				}
+				pool.checkHealth()
+		}
+	}
+}
+
+func (pool *upstreamPool) checkHealth() {
+	check := pool.route.HealthCheck
+	if check.Path == "" {
+		return
+	}
+
+	pool.RLock()
+	upstreams := append([]*upstream{}, pool.upstreams...)
+	pool.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, u := range upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+
+			_, err := probeTarget(u.target, u.proxy.Transport, check)
+			healthy := err == nil
+			if err != nil {
+				utils.Debug("Upstreams: health check of " + u.target.String() + " failed: " + err.Error())
+			}
+
+			pool.Lock()
+			if u.healthy != healthy {
+				if healthy {
+					utils.Log("Upstreams: " + u.target.String() + " of " + pool.route.Name + " is back up")
+				} else {
+					utils.Warn("Upstreams: " + u.target.String() + " of " + pool.route.Name + " failed its health check")
+				}
+			}
+			u.healthy = healthy
+			pool.Unlock()
+		}(u)
+	}
+	wg.Wait()
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := len(a) > 0 && a[len(a)-1] == '/'
+	bslash := len(b) > 0 && b[0] == '/'
+	switch {
+		case aslash && bslash:
+			return a + b[1:]
+		case !aslash && !bslash:
+			return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/docker"
+	"github.com/azukaar/cosmos-server/src/proxy"
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// waitForShutdown blocks until SIGINT/SIGTERM or a restart is requested,
+// then drains the servers and exits
+func waitForShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+		case sig := <-signals:
+			utils.Log("Received " + sig.String() + ", shutting down...")
+		case <-utils.ShutdownRequested:
+			utils.Log("Restart requested, shutting down...")
+	}
+
+	shutdown()
+	os.Exit(0)
+}
+
+func shutdown() {
+	timeout := time.Duration(utils.GetMainConfig().HTTPConfig.ShutdownDrainTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	utils.Log("Draining connections (timeout " + timeout.String() + ")...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range []*http.Server{HTTPServer, HTTPSServer} {
+		if server == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				utils.Error("Shutdown: server did not drain in time", err)
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	proxy.SaveSmartShield()
+
+	docker.StopListeningEvents()
+	StopCRON()
+
+	if !utils.GetMainConfig().DisableUserManagement {
+		proxy.FlushAccessLog()
+		utils.Disconnect()
+	}
+
+	utils.Log("Shutdown complete")
+}
@@ -14,24 +14,24 @@ func StatusRoute(w http.ResponseWriter, req *http.Request) {
 	}
 
 	if(req.Method == "GET") {
-		utils.Log("API: Status")
+		utils.ReqLog(req).Log("API: Status")
 
 		databaseStatus := true
 		
 		if(!utils.GetMainConfig().DisableUserManagement) {
 			err := utils.DB()
 			if err != nil {
-				utils.Error("Status: Database error", err)
+				utils.ReqLog(req).Error("Status: Database error", err)
 				databaseStatus = false
 			}
 		} else {
-			utils.Log("Status: User management is disabled, skipping database check")
+			utils.ReqLog(req).Log("Status: User management is disabled, skipping database check")
 		}
 
 		if(!docker.DockerIsConnected) {
 			ed := docker.Connect()
 			if ed != nil {
-				utils.Error("Status: Docker error", ed)
+				utils.ReqLog(req).Error("Status: Docker error", ed)
 			}
 		}
 
@@ -47,7 +47,7 @@ func StatusRoute(w http.ResponseWriter, req *http.Request) {
 			},
 		})
 	} else {
-		utils.Error("UserList: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserList: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
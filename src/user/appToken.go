@@ -0,0 +1,152 @@
+package user
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/golang-jwt/jwt"
+)
+
+// app tokens are renewed once half of their lifetime is over
+const appTokenLifetime = 5 * time.Minute
+const maxCachedAppTokens = 10000
+
+type cachedAppToken struct {
+	token string
+	renewAt time.Time
+}
+
+var appTokensLock sync.Mutex
+var appTokens = map[string]cachedAppToken{}
+
+// GetIssuer is the iss of the tokens minted by Cosmos
+func GetIssuer() string {
+	scheme := "http://"
+	if utils.IsHTTPS {
+		scheme = "https://"
+	}
+	return scheme + utils.GetMainConfig().HTTPConfig.Hostname
+}
+
+func authPublicKey() (ed25519.PublicKey, error) {
+	key, err := jwt.ParseEdPublicKeyFromPEM([]byte(utils.GetPublicAuthKey()))
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("auth public key is not an Ed25519 key")
+	}
+
+	return publicKey, nil
+}
+
+// GetAuthJWK returns the auth public key as a JWK. Its kid is the RFC 7638 thumbprint
+func GetAuthJWK() (map[string]string, error) {
+	publicKey, err := authPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	x := base64.RawURLEncoding.EncodeToString(publicKey)
+	thumbprint := sha256.Sum256([]byte(`{"crv":"Ed25519","kty":"OKP","x":"` + x + `"}`))
+
+	return map[string]string{
+		"kty": "OKP",
+		"crv": "Ed25519",
+		"x": x,
+		"kid": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+		"use": "sig",
+		"alg": "EdDSA",
+	}, nil
+}
+
+// MakeAppToken returns a short lived JWT telling the target of a route who the user is
+func MakeAppToken(user utils.User, route string, audience string) (string, error) {
+	cacheKey := user.Nickname + "\x00" + strconv.Itoa(int(user.Role)) + "\x00" +
+		strconv.Itoa(user.PasswordCycle) + "\x00" + route + "\x00" + audience + "\x00" + strings.Join(user.Groups, ",")
+
+	appTokensLock.Lock()
+	cached, ok := appTokens[cacheKey]
+	appTokensLock.Unlock()
+
+	if ok && time.Now().Before(cached.renewAt) {
+		return cached.token, nil
+	}
+
+	jwk, err := GetAuthJWK()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := jwt.ParseEdPrivateKeyFromPEM([]byte(utils.GetPrivateAuthKey()))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	token := jwt.New(jwt.SigningMethodEdDSA)
+	token.Header["kid"] = jwk["kid"]
+	claims := token.Claims.(jwt.MapClaims)
+	claims["iss"] = GetIssuer()
+	claims["sub"] = user.Nickname
+	claims["aud"] = audience
+	claims["exp"] = now.Add(appTokenLifetime).Unix()
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["nickname"] = user.Nickname
+	claims["role"] = user.Role
+	claims["groups"] = user.Groups
+	claims["route"] = route
+
+	tokenString, err := token.SignedString(key)
+	if err != nil {
+		return "", err
+	}
+
+	appTokensLock.Lock()
+	if len(appTokens) >= maxCachedAppTokens {
+		appTokens = map[string]cachedAppToken{}
+	}
+	appTokens[cacheKey] = cachedAppToken{
+		token: tokenString,
+		renewAt: now.Add(appTokenLifetime / 2),
+	}
+	appTokensLock.Unlock()
+
+	return tokenString, nil
+}
+
+// JWKSRoute publishes the key signing the tokens, for the apps to verify them
+func JWKSRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method == "GET") {
+		jwk, err := GetAuthJWK()
+		if err != nil {
+			utils.ReqLog(req).Error("JWKS: Cannot read auth public key", err)
+			utils.HTTPError(w, "Authorization Error", http.StatusInternalServerError, "A001")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{jwk},
+		})
+	} else {
+		utils.ReqLog(req).Error("JWKS: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
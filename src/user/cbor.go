@@ -0,0 +1,160 @@
+package user
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Minimal CBOR (RFC 8949) decoder for the WebAuthn attestation objects and
+// COSE keys. Authenticators use the CTAP2 canonical form, so indefinite
+// lengths and tags are refused. Integers decode to int64, byte strings to
+// []byte, text to string, arrays to []interface{}, maps to map[interface{}]interface{}
+
+const cborMaxDepth = 16
+
+var errCBORTruncated = errors.New("cbor: truncated data")
+
+// decodeCBOR decodes the first item of data and returns the bytes it used
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func cborArgument(data []byte, info byte) (uint64, int, error) {
+	switch {
+		case info < 24:
+			return uint64(info), 1, nil
+		case info == 24:
+			if len(data) < 2 {
+				return 0, 0, errCBORTruncated
+			}
+			return uint64(data[1]), 2, nil
+		case info == 25:
+			if len(data) < 3 {
+				return 0, 0, errCBORTruncated
+			}
+			return uint64(binary.BigEndian.Uint16(data[1:])), 3, nil
+		case info == 26:
+			if len(data) < 5 {
+				return 0, 0, errCBORTruncated
+			}
+			return uint64(binary.BigEndian.Uint32(data[1:])), 5, nil
+		case info == 27:
+			if len(data) < 9 {
+				return 0, 0, errCBORTruncated
+			}
+			return binary.BigEndian.Uint64(data[1:]), 9, nil
+	}
+
+	return 0, 0, errors.New("cbor: indefinite lengths are not supported")
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, int, error) {
+	if depth > cborMaxDepth {
+		return nil, 0, errors.New("cbor: nested too deep")
+	}
+	if len(data) == 0 {
+		return nil, 0, errCBORTruncated
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+
+	// simple values and floats
+	if major == 7 {
+		switch info {
+			case 20:
+				return false, 1, nil
+			case 21:
+				return true, 1, nil
+			case 22, 23:
+				return nil, 1, nil
+			case 26:
+				if len(data) < 5 {
+					return nil, 0, errCBORTruncated
+				}
+				return float64(math.Float32frombits(binary.BigEndian.Uint32(data[1:]))), 5, nil
+			case 27:
+				if len(data) < 9 {
+					return nil, 0, errCBORTruncated
+				}
+				return math.Float64frombits(binary.BigEndian.Uint64(data[1:])), 9, nil
+		}
+		return nil, 0, errors.New("cbor: unsupported simple value")
+	}
+
+	argument, read, err := cborArgument(data, info)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch major {
+		case 0:
+			if argument > math.MaxInt64 {
+				return nil, 0, errors.New("cbor: integer overflow")
+			}
+			return int64(argument), read, nil
+
+		case 1:
+			if argument > math.MaxInt64 {
+				return nil, 0, errors.New("cbor: integer overflow")
+			}
+			return -1 - int64(argument), read, nil
+
+		case 2, 3:
+			if argument > uint64(len(data) - read) {
+				return nil, 0, errCBORTruncated
+			}
+			end := read + int(argument)
+			if major == 3 {
+				return string(data[read:end]), end, nil
+			}
+			return append([]byte{}, data[read:end]...), end, nil
+
+		case 4:
+			// every item takes at least one byte
+			if argument > uint64(len(data) - read) {
+				return nil, 0, errCBORTruncated
+			}
+			items := make([]interface{}, 0, argument)
+			for i := uint64(0); i < argument; i++ {
+				item, n, err := decodeCBORItem(data[read:], depth + 1)
+				if err != nil {
+					return nil, 0, err
+				}
+				items = append(items, item)
+				read += n
+			}
+			return items, read, nil
+
+		case 5:
+			if argument > uint64(len(data) - read) / 2 {
+				return nil, 0, errCBORTruncated
+			}
+			items := make(map[interface{}]interface{}, argument)
+			for i := uint64(0); i < argument; i++ {
+				key, n, err := decodeCBORItem(data[read:], depth + 1)
+				if err != nil {
+					return nil, 0, err
+				}
+				read += n
+
+				switch key.(type) {
+					case int64, string:
+					default:
+						return nil, 0, errors.New("cbor: unsupported map key")
+				}
+
+				value, n, err := decodeCBORItem(data[read:], depth + 1)
+				if err != nil {
+					return nil, 0, err
+				}
+				read += n
+
+				items[key] = value
+			}
+			return items, read, nil
+	}
+
+	return nil, 0, errors.New("cbor: tags are not supported")
+}
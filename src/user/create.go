@@ -26,7 +26,7 @@ func UserCreate(w http.ResponseWriter, req *http.Request) {
 		var request CreateRequestJSON
 		err1 := json.NewDecoder(req.Body).Decode(&request)
 		if err1 != nil {
-			utils.Error("UserCreation: Invalid User Request", err1)
+			utils.ReqLog(req).Error("UserCreation: Invalid User Request", err1)
 			utils.HTTPError(w, "User Creation Error", 
 				http.StatusInternalServerError, "UC001")
 			return 
@@ -34,7 +34,7 @@ func UserCreate(w http.ResponseWriter, req *http.Request) {
 
 		errV := utils.Validate.Struct(request)
 		if errV != nil {
-			utils.Error("UserCreation: Invalid User Request", errV)
+			utils.ReqLog(req).Error("UserCreation: Invalid User Request", errV)
 			utils.HTTPError(w, "User Creation Error: " + errV.Error(),
 				http.StatusInternalServerError, "UC003")
 			return 
@@ -45,14 +45,14 @@ func UserCreate(w http.ResponseWriter, req *http.Request) {
 
 		c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
 		if errCo != nil {
-				utils.Error("Database Connect", errCo)
+				utils.ReqLog(req).Error("Database Connect", errCo)
 				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
 				return
 		}
 
 		user := utils.User{}
 
-		utils.Debug("UserCreation: Creating user " + nickname)
+		utils.ReqLog(req).Debug("UserCreation: Creating user " + nickname)
 
 		err2 := c.FindOne(nil, map[string]interface{}{
 			"Nickname": nickname,
@@ -70,11 +70,12 @@ func UserCreate(w http.ResponseWriter, req *http.Request) {
 				"RegisterKeyExp": RegisterKeyExp,
 				"Role": utils.USER,
 				"PasswordCycle": 0,
+				"Groups": []string{},
 				"CreatedAt": time.Now(),
 			})
 
 			if err3 != nil {
-				utils.Error("UserCreation: Error while creating user", err3)
+				utils.ReqLog(req).Error("UserCreation: Error while creating user", err3)
 				utils.HTTPError(w, "User Creation Error", 
 					http.StatusInternalServerError, "UC001")
 				return 
@@ -88,16 +89,16 @@ func UserCreate(w http.ResponseWriter, req *http.Request) {
 				},
 			})
 		} else if err2 == nil {
-			utils.Error("UserCreation: User already exists", nil)
+			utils.ReqLog(req).Error("UserCreation: User already exists", nil)
 			utils.HTTPError(w, "User already exists", http.StatusConflict, "UC002")
 		  return 
 		} else {
-			utils.Error("UserCreation: Error while finding user", err2)
+			utils.ReqLog(req).Error("UserCreation: Error while finding user", err2)
 			utils.HTTPError(w, "User Creation Error", http.StatusInternalServerError, "UC001")
 			return 
 		}
 	} else {
-		utils.Error("UserCreation: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserCreation: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -20,28 +20,32 @@ func UserDelete(w http.ResponseWriter, req *http.Request) {
 
 		c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
 		if errCo != nil {
-				utils.Error("Database Connect", errCo)
+				utils.ReqLog(req).Error("Database Connect", errCo)
 				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
 				return
 		}
 
-		utils.Debug("UserDeletion: Deleting user " + nickname)
+		utils.ReqLog(req).Debug("UserDeletion: Deleting user " + nickname)
 
 		_, err := c.DeleteOne(nil, map[string]interface{}{
 			"Nickname": nickname,
 		})
 
 		if err != nil {
-			utils.Error("UserDeletion: Error while deleting user", err)
+			utils.ReqLog(req).Error("UserDeletion: Error while deleting user", err)
 			utils.HTTPError(w, "User Deletion Error", http.StatusInternalServerError, "UD001")
 			return
 		}
 
+		if _, errS := revokeSessions(nickname, ""); errS != nil {
+			utils.ReqLog(req).Error("UserDeletion: Error while closing sessions", errS)
+		}
+
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "OK",
 		})
 	} else {
-		utils.Error("UserDeletion: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserDeletion: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
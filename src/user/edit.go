@@ -3,12 +3,14 @@ package user
 import (
 	"net/http"
 	"encoding/json"
+	"strings"
 	"github.com/gorilla/mux"
 	"github.com/azukaar/cosmos-server/src/utils" 
 )
 
 type EditRequestJSON struct {
 	Email string `validate:"email"`
+	Groups *[]string
 }
 
 func UserEdit(w http.ResponseWriter, req *http.Request) {
@@ -23,7 +25,7 @@ func UserEdit(w http.ResponseWriter, req *http.Request) {
 		var request EditRequestJSON
 		err1 := json.NewDecoder(req.Body).Decode(&request)
 		if err1 != nil {
-			utils.Error("UserEdit: Invalid User Request", err1)
+			utils.ReqLog(req).Error("UserEdit: Invalid User Request", err1)
 			utils.HTTPError(w, "User Edit Error", http.StatusInternalServerError, "UL001")
 			return
 		}
@@ -31,19 +33,19 @@ func UserEdit(w http.ResponseWriter, req *http.Request) {
 		// Validate request
 		err2 := utils.Validate.Struct(request)
 		if err2 != nil {
-			utils.Error("UserEdit: Invalid User Request", err2)
+			utils.ReqLog(req).Error("UserEdit: Invalid User Request", err2)
 			utils.HTTPError(w, "User request invalid: " + err2.Error(), http.StatusInternalServerError, "UL002")
 			return
 		}
 		
 		c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
 		if errCo != nil {
-				utils.Error("Database Connect", errCo)
+				utils.ReqLog(req).Error("Database Connect", errCo)
 				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
 				return
 		}
 
-		utils.Debug("UserEdit: Edit user " + nickname)
+		utils.ReqLog(req).Debug("UserEdit: Edit user " + nickname)
 
 		toSet := map[string]interface{}{}
 		if request.Email != "" {
@@ -55,6 +57,36 @@ func UserEdit(w http.ResponseWriter, req *http.Request) {
 			toSet["Email"] = request.Email
 		}
 
+		if request.Groups != nil {
+			if utils.AdminOnly(w, req) != nil {
+				return
+			}
+
+			groups := []string{}
+			seen := map[string]bool{}
+			for _, group := range *request.Groups {
+				if !seen[group] {
+					seen[group] = true
+					groups = append(groups, group)
+				}
+			}
+
+			missing, errG := checkGroupsExist(groups)
+			if errG != nil {
+				utils.ReqLog(req).Error("UserEdit: Error while checking groups", errG)
+				utils.HTTPError(w, "User Edit Error", http.StatusInternalServerError, "UE001")
+				return
+			}
+
+			if len(missing) > 0 {
+				utils.ReqLog(req).Error("UserEdit: Unknown groups " + strings.Join(missing, ", "), nil)
+				utils.HTTPError(w, "Unknown groups: " + strings.Join(missing, ", "), http.StatusBadRequest, "UE002")
+				return
+			}
+
+			toSet["Groups"] = groups
+		}
+
 		_, err := c.UpdateOne(nil, map[string]interface{}{
 			"Nickname": nickname,
 		}, map[string]interface{}{
@@ -62,7 +94,7 @@ func UserEdit(w http.ResponseWriter, req *http.Request) {
 		})
 
 		if err != nil {
-			utils.Error("UserEdit: Error while getting user", err)
+			utils.ReqLog(req).Error("UserEdit: Error while getting user", err)
 			utils.HTTPError(w, "User Edit Error", http.StatusInternalServerError, "UE001")
 			return
 		}
@@ -71,7 +103,7 @@ func UserEdit(w http.ResponseWriter, req *http.Request) {
 			"status": "OK",
 		})
 	} else {
-		utils.Error("UserEdit: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserEdit: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -23,12 +23,12 @@ func UserGet(w http.ResponseWriter, req *http.Request) {
 
 		c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
 		if errCo != nil {
-				utils.Error("Database Connect", errCo)
+				utils.ReqLog(req).Error("Database Connect", errCo)
 				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
 				return
 		}
 
-		utils.Debug("UserGet: Get user " + nickname)
+		utils.ReqLog(req).Debug("UserGet: Get user " + nickname)
 
 		user := utils.User{}
 
@@ -37,7 +37,7 @@ func UserGet(w http.ResponseWriter, req *http.Request) {
 		}).Decode(&user)
 
 		if err != nil {
-			utils.Error("UserGet: Error while getting user", err)
+			utils.ReqLog(req).Error("UserGet: Error while getting user", err)
 			utils.HTTPError(w, "User Get Error", http.StatusInternalServerError, "UD001")
 			return
 		}
@@ -49,7 +49,7 @@ func UserGet(w http.ResponseWriter, req *http.Request) {
 			"data": user,
 		})
 	} else {
-		utils.Error("UserGet: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserGet: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -0,0 +1,96 @@
+package user
+
+import (
+	"net/http"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils" 
+)
+
+type GroupCreateRequestJSON struct {
+	Name string `validate:"required"`
+	Description string `validate:"max=256"`
+}
+
+func GroupCreate(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	} 
+
+	if(req.Method == "POST") {
+		var request GroupCreateRequestJSON
+		err1 := json.NewDecoder(req.Body).Decode(&request)
+		if err1 != nil {
+			utils.ReqLog(req).Error("GroupCreation: Invalid Group Request", err1)
+			utils.HTTPError(w, "Group Creation Error", 
+				http.StatusInternalServerError, "GC001")
+			return 
+		}
+
+		errV := utils.Validate.Struct(request)
+		if errV != nil {
+			utils.ReqLog(req).Error("GroupCreation: Invalid Group Request", errV)
+			utils.HTTPError(w, "Group Creation Error: " + errV.Error(),
+				http.StatusInternalServerError, "GC003")
+			return 
+		}
+
+		if !groupNameRegexp.MatchString(request.Name) {
+			utils.ReqLog(req).Error("GroupCreation: Invalid group name " + request.Name, nil)
+			utils.HTTPError(w, "Group Creation Error: names are 2 to 32 letters, digits, - or _",
+				http.StatusBadRequest, "GC003")
+			return 
+		}
+		
+		name := request.Name
+		description := utils.Sanitize(request.Description)
+
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "groups")
+		if errCo != nil {
+				utils.ReqLog(req).Error("Database Connect", errCo)
+				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+				return
+		}
+
+		group := utils.Group{}
+
+		utils.ReqLog(req).Debug("GroupCreation: Creating group " + name)
+
+		err2 := c.FindOne(nil, map[string]interface{}{
+			"Name": name,
+		}).Decode(&group)
+
+		if err2 == mongo.ErrNoDocuments {
+			_, err3 := c.InsertOne(nil, map[string]interface{}{
+				"Name": name,
+				"Description": description,
+				"CreatedAt": time.Now(),
+			})
+
+			if err3 != nil {
+				utils.ReqLog(req).Error("GroupCreation: Error while creating group", err3)
+				utils.HTTPError(w, "Group Creation Error", 
+					http.StatusInternalServerError, "GC001")
+				return 
+			} 
+			
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": "OK",
+			})
+		} else if err2 == nil {
+			utils.ReqLog(req).Error("GroupCreation: Group already exists", nil)
+			utils.HTTPError(w, "Group already exists", http.StatusConflict, "GC002")
+		  return 
+		} else {
+			utils.ReqLog(req).Error("GroupCreation: Error while finding group", err2)
+			utils.HTTPError(w, "Group Creation Error", http.StatusInternalServerError, "GC001")
+			return 
+		}
+	} else {
+		utils.ReqLog(req).Error("GroupCreation: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
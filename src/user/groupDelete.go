@@ -0,0 +1,69 @@
+package user
+
+import (
+	"net/http"
+	"encoding/json"
+	"github.com/gorilla/mux"
+
+	"github.com/azukaar/cosmos-server/src/utils" 
+)
+
+// GroupDelete removes the group and its memberships
+func GroupDelete(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	name := vars["name"]
+
+	if utils.AdminOnly(w, req) != nil {
+		return
+	} 
+
+	if(req.Method == "DELETE") {
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "groups")
+		if errCo != nil {
+				utils.ReqLog(req).Error("Database Connect", errCo)
+				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+				return
+		}
+
+		cu, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+		if errCo != nil {
+				utils.ReqLog(req).Error("Database Connect", errCo)
+				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+				return
+		}
+
+		utils.ReqLog(req).Debug("GroupDeletion: Deleting group " + name)
+
+		_, err := c.DeleteOne(nil, map[string]interface{}{
+			"Name": name,
+		})
+
+		if err != nil {
+			utils.ReqLog(req).Error("GroupDeletion: Error while deleting group", err)
+			utils.HTTPError(w, "Group Deletion Error", http.StatusInternalServerError, "GD001")
+			return
+		}
+
+		_, err = cu.UpdateMany(nil, map[string]interface{}{
+			"Groups": name,
+		}, map[string]interface{}{
+			"$pull": map[string]interface{}{
+				"Groups": name,
+			},
+		})
+
+		if err != nil {
+			utils.ReqLog(req).Error("GroupDeletion: Error while removing members", err)
+			utils.HTTPError(w, "Group Deletion Error", http.StatusInternalServerError, "GD001")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.ReqLog(req).Error("GroupDeletion: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
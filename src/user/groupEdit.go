@@ -0,0 +1,75 @@
+package user
+
+import (
+	"net/http"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/azukaar/cosmos-server/src/utils" 
+)
+
+type GroupEditRequestJSON struct {
+	Description string `validate:"max=256"`
+}
+
+func GroupEdit(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	name := vars["name"]
+
+	if utils.AdminOnly(w, req) != nil {
+		return
+	} 
+
+	if(req.Method == "PATCH") {
+		var request GroupEditRequestJSON
+		err1 := json.NewDecoder(req.Body).Decode(&request)
+		if err1 != nil {
+			utils.ReqLog(req).Error("GroupEdit: Invalid Group Request", err1)
+			utils.HTTPError(w, "Group Edit Error", http.StatusInternalServerError, "GE001")
+			return
+		}
+
+		err2 := utils.Validate.Struct(request)
+		if err2 != nil {
+			utils.ReqLog(req).Error("GroupEdit: Invalid Group Request", err2)
+			utils.HTTPError(w, "Group request invalid: " + err2.Error(), http.StatusInternalServerError, "GE002")
+			return
+		}
+		
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "groups")
+		if errCo != nil {
+				utils.ReqLog(req).Error("Database Connect", errCo)
+				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+				return
+		}
+
+		utils.ReqLog(req).Debug("GroupEdit: Edit group " + name)
+
+		result, err := c.UpdateOne(nil, map[string]interface{}{
+			"Name": name,
+		}, map[string]interface{}{
+			"$set": map[string]interface{}{
+				"Description": utils.Sanitize(request.Description),
+			},
+		})
+
+		if err != nil {
+			utils.ReqLog(req).Error("GroupEdit: Error while editing group", err)
+			utils.HTTPError(w, "Group Edit Error", http.StatusInternalServerError, "GE001")
+			return
+		}
+
+		if result.MatchedCount == 0 {
+			utils.ReqLog(req).Error("GroupEdit: Group not found " + name, nil)
+			utils.HTTPError(w, "Group not found", http.StatusNotFound, "GE003")
+			return
+		}
+		
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.ReqLog(req).Error("GroupEdit: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
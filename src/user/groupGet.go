@@ -0,0 +1,78 @@
+package user
+
+import (
+	"net/http"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/azukaar/cosmos-server/src/utils" 
+)
+
+// GroupGet returns the group with the nicknames of its members
+func GroupGet(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	name := vars["name"]
+
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "groups")
+		if errCo != nil {
+				utils.ReqLog(req).Error("Database Connect", errCo)
+				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+				return
+		}
+
+		utils.ReqLog(req).Debug("GroupGet: Get group " + name)
+
+		group := utils.Group{}
+
+		err := c.FindOne(nil, map[string]interface{}{
+			"Name": name,
+		}).Decode(&group)
+
+		if err != nil {
+			utils.ReqLog(req).Error("GroupGet: Error while getting group", err)
+			utils.HTTPError(w, "Group not found", http.StatusNotFound, "GG001")
+			return
+		}
+
+		cu, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+		if errCo != nil {
+				utils.ReqLog(req).Error("Database Connect", errCo)
+				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+				return
+		}
+
+		cursor, errDB := cu.Find(nil, map[string]interface{}{
+			"Groups": name,
+		})
+		if errDB != nil {
+			utils.ReqLog(req).Error("GroupGet: Error while getting members", errDB)
+			utils.HTTPError(w, "Group Get Error", http.StatusInternalServerError, "GG002")
+			return
+		}
+		defer cursor.Close(nil)
+
+		group.Members = []string{}
+		for cursor.Next(nil) {
+			member := utils.User{}
+			if errDec := cursor.Decode(&member); errDec != nil {
+				utils.ReqLog(req).Error("GroupGet: Error while decoding member", errDec)
+				utils.HTTPError(w, "Group Get Error", http.StatusInternalServerError, "GG002")
+				return
+			}
+			group.Members = append(group.Members, member.Nickname)
+		}
+		
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": group,
+		})
+	} else {
+		utils.ReqLog(req).Error("GroupGet: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,49 @@
+package user
+
+import (
+	"net/http"
+	"encoding/json"
+	"github.com/azukaar/cosmos-server/src/utils" 
+)
+
+func GroupList(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	} 
+
+	if(req.Method == "GET") {
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "groups")
+		if errCo != nil {
+				utils.ReqLog(req).Error("Database Connect", errCo)
+				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+				return
+		}
+
+		utils.ReqLog(req).Debug("GroupList: List groups")
+
+		cursor, errDB := c.Find(nil, map[string]interface{}{})
+
+		if errDB != nil {
+			utils.ReqLog(req).Error("GroupList: Error while getting groups", errDB)
+			utils.HTTPError(w, "Group Get Error", http.StatusInternalServerError, "GL001")
+			return
+		}
+		defer cursor.Close(nil)
+
+		groupList := []utils.Group{}
+		if errDec := cursor.All(nil, &groupList); errDec != nil {
+			utils.ReqLog(req).Error("GroupList: Error while decoding groups", errDec)
+			utils.HTTPError(w, "Group Get Error", http.StatusInternalServerError, "GL001")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": groupList,
+		})
+	} else {
+		utils.ReqLog(req).Error("GroupList: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
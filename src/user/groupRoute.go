@@ -0,0 +1,72 @@
+package user
+
+import (
+	"net/http"
+	"regexp"
+	"github.com/azukaar/cosmos-server/src/utils" 
+)
+
+// group names are joined with commas in x-cosmos-groups
+var groupNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{2,32}$`)
+
+func GroupsIdRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method == "DELETE") {
+		GroupDelete(w, req)
+	} else if (req.Method == "GET") {
+		GroupGet(w, req)
+	} else if (req.Method == "PATCH") {
+		GroupEdit(w, req)
+	} else {
+		utils.ReqLog(req).Error("GroupRoute: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func GroupsRoute(w http.ResponseWriter, req *http.Request) {
+	if (req.Method == "POST") {
+		GroupCreate(w, req)
+	} else if (req.Method == "GET") {
+		GroupList(w, req)
+	} else {
+		utils.ReqLog(req).Error("GroupRoute: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// checkGroupsExist returns the groups of the list missing from the database
+func checkGroupsExist(groups []string) ([]string, error) {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "groups")
+	if errCo != nil {
+		return nil, errCo
+	}
+
+	cursor, err := c.Find(nil, map[string]interface{}{
+		"Name": map[string]interface{}{
+			"$in": groups,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(nil)
+
+	found := map[string]bool{}
+	for cursor.Next(nil) {
+		group := utils.Group{}
+		if errDec := cursor.Decode(&group); errDec != nil {
+			return nil, errDec
+		}
+		found[group.Name] = true
+	}
+
+	missing := []string{}
+	for _, group := range groups {
+		if !found[group] {
+			missing = append(missing, group)
+		}
+	}
+
+	return missing, nil
+}
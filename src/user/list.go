@@ -26,12 +26,12 @@ func UserList(w http.ResponseWriter, req *http.Request) {
 	if(req.Method == "GET") {
 		c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
 		if errCo != nil {
-				utils.Error("Database Connect", errCo)
+				utils.ReqLog(req).Error("Database Connect", errCo)
 				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
 				return
 		}
 
-		utils.Debug("UserList: List user ")
+		utils.ReqLog(req).Debug("UserList: List user ")
 
 		userList := []utils.User{}	
 
@@ -54,7 +54,7 @@ func UserList(w http.ResponseWriter, req *http.Request) {
 		)
 
 		if errDB != nil {
-			utils.Error("UserList: Error while getting user", errDB)
+			utils.ReqLog(req).Error("UserList: Error while getting user", errDB)
 			utils.HTTPError(w, "User Get Error", http.StatusInternalServerError, "UL001")
 			return
 		}
@@ -63,7 +63,7 @@ func UserList(w http.ResponseWriter, req *http.Request) {
 			user := utils.User{}
 			errDec := cursor.Decode(&user)
 			if errDec != nil {
-				utils.Error("UserList: Error while decoding user", errDec)
+				utils.ReqLog(req).Error("UserList: Error while decoding user", errDec)
 				utils.HTTPError(w, "User Get Error", http.StatusInternalServerError, "UL001")
 				return
 			}
@@ -77,7 +77,7 @@ func UserList(w http.ResponseWriter, req *http.Request) {
 			"data": userList,
 		})
 	} else {
-		utils.Error("UserList: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserList: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -23,14 +23,14 @@ func UserLogin(w http.ResponseWriter, req *http.Request) {
 		var request LoginRequestJSON
 		err1 := json.NewDecoder(req.Body).Decode(&request)
 		if err1 != nil {
-			utils.Error("UserLogin: Invalid User Request", err1)
+			utils.ReqLog(req).Error("UserLogin: Invalid User Request", err1)
 			utils.HTTPError(w, "User Login Error", http.StatusInternalServerError, "UL001")
 			return
 		}
 
 		c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
 		if errCo != nil {
-				utils.Error("Database Connect", errCo)
+				utils.ReqLog(req).Error("Database Connect", errCo)
 				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
 				return
 		}
@@ -40,7 +40,7 @@ func UserLogin(w http.ResponseWriter, req *http.Request) {
 
 		user := utils.User{}
 
-		utils.Debug("UserLogin: Logging user " + nickname)
+		utils.ReqLog(req).Debug("UserLogin: Logging user " + nickname)
 
 		err3 := c.FindOne(nil, map[string]interface{}{
 			"Nickname": nickname,
@@ -48,48 +48,82 @@ func UserLogin(w http.ResponseWriter, req *http.Request) {
 
 		if err3 == mongo.ErrNoDocuments {
 			bcrypt.CompareHashAndPassword([]byte("$2a$14$4nzsVwEnR3.jEbMTME7kqeCo4gMgR/Tuk7ivNExvXjr73nKvLgHka"), []byte("dummyPassword"))
-			utils.Error("UserLogin: User not found", err3)
+			utils.ReqLog(req).Error("UserLogin: User not found", err3)
 			utils.HTTPError(w, "User Logging Error", http.StatusInternalServerError, "UL001")
 			return
 		} else if err3 != nil {
 			bcrypt.CompareHashAndPassword([]byte("$2a$14$4nzsVwEnR3.jEbMTME7kqeCo4gMgR/Tuk7ivNExvXjr73nKvLgHka"), []byte("dummyPassword"))
-			utils.Error("UserLogin: Error while finding user", err3)
+			utils.ReqLog(req).Error("UserLogin: Error while finding user", err3)
 			utils.HTTPError(w, "User Logging Error", http.StatusInternalServerError, "UL001")
 			return
 		} else if user.Password == "" {
-			utils.Error("UserLogin: User not registered", nil)
+			utils.ReqLog(req).Error("UserLogin: User not registered", nil)
 			utils.HTTPError(w, "User not registered", http.StatusUnauthorized, "UL002")
 			return
 		} else {
 			err2 := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	
 			if err2 != nil {
-				utils.Error("UserLogin: Encryption error", err2)
+				utils.ReqLog(req).Error("UserLogin: Encryption error", err2)
 				utils.HTTPError(w, "User Logging Error", http.StatusUnauthorized, "UL001")
 				return
 			}
 
-			SendUserToken(w, user)
+			// the session is only opened once the second factor is checked
+			if MFARequired(user) {
+				purpose, status := MFAPendingLogin, "MFA_REQUIRED"
+				if !HasSecondFactor(user) {
+					purpose, status = MFAPendingSetup, "MFA_SETUP_REQUIRED"
+				}
+
+				errM := sendMFAToken(w, user, purpose)
+				if errM != nil {
+					utils.ReqLog(req).Error("UserLogin: Error while signing MFA token", errM)
+					utils.HTTPError(w, "User Logging Error", http.StatusInternalServerError, "UL001")
+					return
+				}
+
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"status": status,
+					"data": map[string]interface{}{
+						"totp": user.MFAEnabled,
+						"webauthn": len(user.WebAuthnCredentials) > 0,
+					},
+				})
+				return
+			}
+
+			SendUserToken(w, req, user)
 
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"status": "OK",
 			})
 
-			_, errE := c.UpdateOne(nil, map[string]interface{}{
-				"Nickname": nickname,
-			}, map[string]interface{}{
-				"$set": map[string]interface{}{
-					"LastLogin": time.Now(),
-				},
-			})
-
-			if errE != nil {
-				utils.Error("UserLogin: Error while updating user last login", errE)
-			}
+			updateLastLogin(nickname)
 		}
 	} else {
-		utils.Error("UserLogin: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserLogin: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
 }
+
+func updateLastLogin(nickname string) {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+	if errCo != nil {
+		utils.Error("Database Connect", errCo)
+		return
+	}
+
+	_, errE := c.UpdateOne(nil, map[string]interface{}{
+		"Nickname": nickname,
+	}, map[string]interface{}{
+		"$set": map[string]interface{}{
+			"LastLogin": time.Now(),
+		},
+	})
+
+	if errE != nil {
+		utils.Error("UserLogin: Error while updating user last login", errE)
+	}
+}
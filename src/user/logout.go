@@ -8,15 +8,22 @@ import (
 
 func UserLogout(w http.ResponseWriter, req *http.Request) {
 	if(req.Method == "GET") {
-		utils.Debug("UserLogout: Logging out user")
+		utils.ReqLog(req).Debug("UserLogout: Logging out user")
+
+		if sid := currentSessionID(req); sid != "" {
+			if _, err := revokeSession(req.Header.Get("x-cosmos-user"), sid); err != nil {
+				utils.ReqLog(req).Error("UserLogout: Error while closing session", err)
+			}
+		}
 
 		logOutUser(w);
+		clearMFAToken(w)
 
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "OK",
 		})
 	} else {
-		utils.Error("UserLogin: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserLogin: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -0,0 +1,307 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/golang-jwt/jwt"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+)
+
+const mfaPeriod = 30
+const mfaTokenLifetime = 10 * time.Minute
+const mfaRecoveryCodesCount = 10
+
+// failed codes allowed per user before a pause
+const mfaMaxFailures = 5
+const mfaFailuresWindow = 5 * time.Minute
+
+// purposes of the mfatoken cookie, given between the password and the second factor
+const (
+	MFAPendingLogin = "login"
+	MFAPendingSetup = "setup"
+)
+
+type mfaFailure struct {
+	count int
+	since time.Time
+}
+
+var mfaFailuresLock sync.Mutex
+var mfaFailures = map[string]mfaFailure{}
+
+// MFARequired tells if the user has to use a second factor to log in
+func MFARequired(user utils.User) bool {
+	return HasSecondFactor(user) ||
+		(user.Role >= utils.ADMIN && utils.GetMainConfig().AuthConfig.RequireMFAForAdmins)
+}
+
+func mfaCookie(value string, expiration time.Time) *http.Cookie {
+	cookie := http.Cookie{
+		Name: "mfatoken",
+		Value: value,
+		Expires: expiration,
+		Path: "/",
+		Secure: true,
+		HttpOnly: true,
+		Domain: utils.GetMainConfig().HTTPConfig.Hostname,
+	}
+
+	if(utils.GetMainConfig().HTTPConfig.Hostname == "localhost" || utils.GetMainConfig().HTTPConfig.Hostname == "0.0.0.0") {
+		cookie.Domain = ""
+	}
+
+	return &cookie
+}
+
+// sendMFAToken proves that the password was checked, the jwttoken comes after the second factor
+func sendMFAToken(w http.ResponseWriter, user utils.User, purpose string) error {
+	expiration := time.Now().Add(mfaTokenLifetime)
+
+	token := jwt.New(jwt.SigningMethodEdDSA)
+	claims := token.Claims.(jwt.MapClaims)
+	claims["exp"] = expiration.Unix()
+	claims["nickname"] = user.Nickname
+	claims["passwordCycle"] = user.PasswordCycle
+	claims["mfaPending"] = purpose
+	claims["iat"] = time.Now().Unix()
+	claims["nbf"] = time.Now().Unix()
+
+	key, err := jwt.ParseEdPrivateKeyFromPEM([]byte(utils.GetPrivateAuthKey()))
+	if err != nil {
+		return err
+	}
+
+	tokenString, err := token.SignedString(key)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, mfaCookie(tokenString, expiration))
+	return nil
+}
+
+func clearMFAToken(w http.ResponseWriter) {
+	http.SetCookie(w, mfaCookie("", time.Now().Add(-time.Hour * 24 * 365)))
+}
+
+// readMFAToken returns the user of a valid mfatoken cookie with the given purpose
+func readMFAToken(req *http.Request, purpose string) (utils.User, error) {
+	cookie, err := req.Cookie("mfatoken")
+	if err != nil || cookie.Value == "" {
+		return utils.User{}, errors.New("No pending authentication")
+	}
+
+	claims := jwt.MapClaims{}
+
+	_, errP := jwt.ParseWithClaims(cookie.Value, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, errors.New("Unexpected signing method")
+		}
+		return jwt.ParseEdPublicKeyFromPEM([]byte(utils.GetPublicAuthKey()))
+	})
+
+	if errP != nil {
+		return utils.User{}, errP
+	}
+
+	pending, _ := claims["mfaPending"].(string)
+	nickname, _ := claims["nickname"].(string)
+	passwordCycle, _ := claims["passwordCycle"].(float64)
+
+	if pending != purpose || nickname == "" {
+		return utils.User{}, errors.New("Invalid pending authentication")
+	}
+
+	user, err := GetUserByNickname(nickname)
+	if err != nil {
+		return utils.User{}, err
+	}
+
+	if user.PasswordCycle != int(passwordCycle) {
+		return utils.User{}, errors.New("Password cycle changed, token is too old")
+	}
+
+	return user, nil
+}
+
+// GetUserByNickname reads a user from the database
+func GetUserByNickname(nickname string) (utils.User, error) {
+	user := utils.User{}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+	if errCo != nil {
+		return user, errCo
+	}
+
+	err := c.FindOne(nil, map[string]interface{}{
+		"Nickname": nickname,
+	}).Decode(&user)
+
+	return user, err
+}
+
+// mfaThrottled tells if the user failed too many codes lately
+func mfaThrottled(nickname string) bool {
+	mfaFailuresLock.Lock()
+	defer mfaFailuresLock.Unlock()
+
+	failure, ok := mfaFailures[nickname]
+	if ok && time.Since(failure.since) > mfaFailuresWindow {
+		delete(mfaFailures, nickname)
+		return false
+	}
+
+	return ok && failure.count >= mfaMaxFailures
+}
+
+func recordMFAResult(nickname string, success bool) {
+	mfaFailuresLock.Lock()
+	defer mfaFailuresLock.Unlock()
+
+	if success {
+		delete(mfaFailures, nickname)
+		return
+	}
+
+	failure, ok := mfaFailures[nickname]
+	if !ok || time.Since(failure.since) > mfaFailuresWindow {
+		failure = mfaFailure{since: time.Now()}
+	}
+	failure.count++
+	mfaFailures[nickname] = failure
+}
+
+// validateTOTP checks a code against the secret of the user, allowing one
+// step of clock drift. An accepted step is saved so the code can't be replayed
+func validateTOTP(user utils.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if user.MFAKey == "" || len(code) != 6 {
+		return false, nil
+	}
+
+	opts := hotp.ValidateOpts{
+		Digits: otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+
+	current := time.Now().Unix() / mfaPeriod
+
+	for _, counter := range []int64{current, current - 1, current + 1} {
+		expected, err := hotp.GenerateCodeCustom(user.MFAKey, uint64(counter), opts)
+		if err != nil {
+			return false, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) != 1 {
+			continue
+		}
+
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+		if errCo != nil {
+			return false, errCo
+		}
+
+		result, err := c.UpdateOne(nil, map[string]interface{}{
+			"Nickname": user.Nickname,
+			"MFALastCounter": map[string]interface{}{
+				"$not": map[string]interface{}{
+					"$gte": counter,
+				},
+			},
+		}, map[string]interface{}{
+			"$set": map[string]interface{}{
+				"MFALastCounter": counter,
+			},
+		})
+		if err != nil {
+			return false, err
+		}
+
+		return result.ModifiedCount == 1, nil
+	}
+
+	return false, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateRecoveryCodes returns the codes to show once and the hashes to store
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := []string{}
+	hashes := []string{}
+
+	for i := 0; i < mfaRecoveryCodesCount; i++ {
+		random := make([]byte, 10)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(random))
+		code = code[:5] + "-" + code[5:10] + "-" + code[10:15]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// useRecoveryCode consumes one of the recovery codes of the user
+func useRecoveryCode(user utils.User, code string) (bool, error) {
+	if strings.TrimSpace(code) == "" {
+		return false, nil
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+	if errCo != nil {
+		return false, errCo
+	}
+
+	hash := hashRecoveryCode(code)
+
+	result, err := c.UpdateOne(nil, map[string]interface{}{
+		"Nickname": user.Nickname,
+		"MFARecoveryCodes": hash,
+	}, map[string]interface{}{
+		"$pull": map[string]interface{}{
+			"MFARecoveryCodes": hash,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+// checkSecondFactor accepts a TOTP code or a recovery code of an enrolled user
+func checkSecondFactor(user utils.User, code string, recoveryCode string) (bool, error) {
+	if !user.MFAEnabled {
+		return false, nil
+	}
+
+	if recoveryCode != "" {
+		ok, err := useRecoveryCode(user, recoveryCode)
+		if ok {
+			utils.Log("MFA: " + user.Nickname + " used a recovery code")
+		}
+		return ok, err
+	}
+
+	return validateTOTP(user, code)
+}
@@ -0,0 +1,425 @@
+package user
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/gorilla/mux"
+	"github.com/pquerna/otp/totp"
+)
+
+type MFARequestJSON struct {
+	Token string `validate:"omitempty,len=6,numeric"`
+	RecoveryCode string `validate:"max=32"`
+}
+
+// mfaSetupUser is the logged in user, or the one enrolling after the password on login
+func mfaSetupUser(w http.ResponseWriter, req *http.Request) (utils.User, bool, error) {
+	if nickname := req.Header.Get("x-cosmos-user"); nickname != "" {
+		user, err := GetUserByNickname(nickname)
+		if err != nil {
+			utils.ReqLog(req).Error("MFA: Error while getting user", err)
+			utils.HTTPError(w, "User not found", http.StatusInternalServerError, "MF001")
+		}
+		return user, false, err
+	}
+
+	user, err := readMFAToken(req, MFAPendingSetup)
+	if err != nil {
+		utils.ReqLog(req).Error("MFA: User is not logged in", err)
+		utils.HTTPError(w, "User not logged in", http.StatusUnauthorized, "HTTP004")
+		return user, true, err
+	}
+
+	return user, true, nil
+}
+
+// MFARoute enrolls the user in TOTP: GET returns a new secret and its QR code,
+// POST confirms it with a first code and returns the recovery codes,
+// DELETE turns TOTP off with a code or a recovery code
+func MFARoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method == "GET") {
+		MFASetup(w, req)
+	} else if (req.Method == "POST") {
+		MFAEnable(w, req)
+	} else if (req.Method == "DELETE") {
+		MFADisable(w, req)
+	} else {
+		utils.ReqLog(req).Error("MFARoute: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func MFASetup(w http.ResponseWriter, req *http.Request) {
+	user, _, err := mfaSetupUser(w, req)
+	if err != nil {
+		return
+	}
+
+	if user.MFAEnabled {
+		utils.ReqLog(req).Error("MFASetup: MFA already enabled for " + user.Nickname, nil)
+		utils.HTTPError(w, "MFA already enabled", http.StatusConflict, "MF003")
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer: "Cosmos",
+		AccountName: user.Nickname + "@" + utils.GetMainConfig().HTTPConfig.Hostname,
+		Period: mfaPeriod,
+	})
+	if err != nil {
+		utils.ReqLog(req).Error("MFASetup: Error while generating secret", err)
+		utils.HTTPError(w, "MFA Setup Error", http.StatusInternalServerError, "MF001")
+		return
+	}
+
+	image, err := key.Image(256, 256)
+	if err != nil {
+		utils.ReqLog(req).Error("MFASetup: Error while generating QR code", err)
+		utils.HTTPError(w, "MFA Setup Error", http.StatusInternalServerError, "MF001")
+		return
+	}
+
+	var qrcode bytes.Buffer
+	if err := png.Encode(&qrcode, image); err != nil {
+		utils.ReqLog(req).Error("MFASetup: Error while encoding QR code", err)
+		utils.HTTPError(w, "MFA Setup Error", http.StatusInternalServerError, "MF001")
+		return
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+	if errCo != nil {
+			utils.ReqLog(req).Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+	}
+
+	// the secret is only used once a first code confirms it
+	_, errDB := c.UpdateOne(nil, map[string]interface{}{
+		"Nickname": user.Nickname,
+		"MFAEnabled": map[string]interface{}{
+			"$ne": true,
+		},
+	}, map[string]interface{}{
+		"$set": map[string]interface{}{
+			"MFAKey": key.Secret(),
+		},
+	})
+	if errDB != nil {
+		utils.ReqLog(req).Error("MFASetup: Error while saving secret", errDB)
+		utils.HTTPError(w, "MFA Setup Error", http.StatusInternalServerError, "MF001")
+		return
+	}
+
+	utils.ReqLog(req).Debug("MFASetup: New secret for " + user.Nickname)
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+		"data": map[string]interface{}{
+			"secret": key.Secret(),
+			"url": key.URL(),
+			"qrcode": "data:image/png;base64," + base64.StdEncoding.EncodeToString(qrcode.Bytes()),
+		},
+	})
+}
+
+func MFAEnable(w http.ResponseWriter, req *http.Request) {
+	user, pending, err := mfaSetupUser(w, req)
+	if err != nil {
+		return
+	}
+
+	var request MFARequestJSON
+	err1 := json.NewDecoder(req.Body).Decode(&request)
+	if err1 != nil || utils.Validate.Struct(request) != nil || request.Token == "" {
+		utils.ReqLog(req).Error("MFAEnable: Invalid MFA Request", err1)
+		utils.HTTPError(w, "MFA Request Error", http.StatusBadRequest, "MF001")
+		return
+	}
+
+	if user.MFAEnabled {
+		utils.ReqLog(req).Error("MFAEnable: MFA already enabled for " + user.Nickname, nil)
+		utils.HTTPError(w, "MFA already enabled", http.StatusConflict, "MF003")
+		return
+	}
+
+	if user.MFAKey == "" {
+		utils.ReqLog(req).Error("MFAEnable: No pending secret for " + user.Nickname, nil)
+		utils.HTTPError(w, "MFA setup not started", http.StatusBadRequest, "MF004")
+		return
+	}
+
+	if mfaThrottled(user.Nickname) {
+		utils.ReqLog(req).Error("MFAEnable: Too many failed codes for " + user.Nickname, nil)
+		utils.HTTPError(w, "Too many attempts, try again later", http.StatusTooManyRequests, "MF006")
+		return
+	}
+
+	valid, errV := validateTOTP(user, request.Token)
+	if errV != nil {
+		utils.ReqLog(req).Error("MFAEnable: Error while checking code", errV)
+		utils.HTTPError(w, "MFA Setup Error", http.StatusInternalServerError, "MF001")
+		return
+	}
+
+	recordMFAResult(user.Nickname, valid)
+
+	if !valid {
+		utils.ReqLog(req).Error("MFAEnable: Invalid code for " + user.Nickname, nil)
+		utils.HTTPError(w, "Invalid code", http.StatusUnauthorized, "MF002")
+		return
+	}
+
+	codes, hashes, errR := generateRecoveryCodes()
+	if errR != nil {
+		utils.ReqLog(req).Error("MFAEnable: Error while generating recovery codes", errR)
+		utils.HTTPError(w, "MFA Setup Error", http.StatusInternalServerError, "MF001")
+		return
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+	if errCo != nil {
+			utils.ReqLog(req).Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+	}
+
+	_, errDB := c.UpdateOne(nil, map[string]interface{}{
+		"Nickname": user.Nickname,
+	}, map[string]interface{}{
+		"$set": map[string]interface{}{
+			"MFAEnabled": true,
+			"MFARecoveryCodes": hashes,
+		},
+	})
+	if errDB != nil {
+		utils.ReqLog(req).Error("MFAEnable: Error while enabling MFA", errDB)
+		utils.HTTPError(w, "MFA Setup Error", http.StatusInternalServerError, "MF001")
+		return
+	}
+
+	utils.ReqLog(req).Log("MFA: enabled for " + user.Nickname)
+
+	// the session is reissued, the ones opened without the second factor are closed
+	user.MFAEnabled = true
+	SendUserToken(w, req, user)
+
+	if pending {
+		clearMFAToken(w)
+		updateLastLogin(user.Nickname)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+		"data": map[string]interface{}{
+			"recoveryCodes": codes,
+		},
+	})
+}
+
+func MFADisable(w http.ResponseWriter, req *http.Request) {
+	if utils.LoggedInOnly(w, req) != nil {
+		return
+	}
+
+	user, err := GetUserByNickname(req.Header.Get("x-cosmos-user"))
+	if err != nil {
+		utils.ReqLog(req).Error("MFADisable: Error while getting user", err)
+		utils.HTTPError(w, "User not found", http.StatusInternalServerError, "MF001")
+		return
+	}
+
+	var request MFARequestJSON
+	err1 := json.NewDecoder(req.Body).Decode(&request)
+	if err1 != nil || utils.Validate.Struct(request) != nil {
+		utils.ReqLog(req).Error("MFADisable: Invalid MFA Request", err1)
+		utils.HTTPError(w, "MFA Request Error", http.StatusBadRequest, "MF001")
+		return
+	}
+
+	if !user.MFAEnabled {
+		utils.ReqLog(req).Error("MFADisable: MFA not enabled for " + user.Nickname, nil)
+		utils.HTTPError(w, "MFA not enabled", http.StatusBadRequest, "MF004")
+		return
+	}
+
+	if user.Role >= utils.ADMIN && utils.GetMainConfig().AuthConfig.RequireMFAForAdmins &&
+		len(user.WebAuthnCredentials) == 0 {
+		utils.ReqLog(req).Error("MFADisable: MFA is required for admins", nil)
+		utils.HTTPError(w, "MFA is required for admins", http.StatusForbidden, "MF005")
+		return
+	}
+
+	if mfaThrottled(user.Nickname) {
+		utils.ReqLog(req).Error("MFADisable: Too many failed codes for " + user.Nickname, nil)
+		utils.HTTPError(w, "Too many attempts, try again later", http.StatusTooManyRequests, "MF006")
+		return
+	}
+
+	valid, errV := checkSecondFactor(user, request.Token, request.RecoveryCode)
+	if errV != nil {
+		utils.ReqLog(req).Error("MFADisable: Error while checking code", errV)
+		utils.HTTPError(w, "MFA Error", http.StatusInternalServerError, "MF001")
+		return
+	}
+
+	recordMFAResult(user.Nickname, valid)
+
+	if !valid {
+		utils.ReqLog(req).Error("MFADisable: Invalid code for " + user.Nickname, nil)
+		utils.HTTPError(w, "Invalid code", http.StatusUnauthorized, "MF002")
+		return
+	}
+
+	if errR := disableTOTP(user.Nickname); errR != nil {
+		utils.ReqLog(req).Error("MFADisable: Error while disabling MFA", errR)
+		utils.HTTPError(w, "MFA Error", http.StatusInternalServerError, "MF001")
+		return
+	}
+
+	utils.ReqLog(req).Log("MFA: disabled by " + user.Nickname)
+
+	user.MFAEnabled = false
+	SendUserToken(w, req, user)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+	})
+}
+
+func disableTOTP(nickname string) error {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+	if errCo != nil {
+		return errCo
+	}
+
+	_, err := c.UpdateOne(nil, map[string]interface{}{
+		"Nickname": nickname,
+	}, map[string]interface{}{
+		"$set": map[string]interface{}{
+			"MFAEnabled": false,
+			"MFAKey": "",
+			"MFARecoveryCodes": []string{},
+		},
+	})
+
+	return err
+}
+
+func resetMFA(nickname string) error {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+	if errCo != nil {
+		return errCo
+	}
+
+	_, err := c.UpdateOne(nil, map[string]interface{}{
+		"Nickname": nickname,
+	}, map[string]interface{}{
+		"$set": map[string]interface{}{
+			"MFAEnabled": false,
+			"MFAKey": "",
+			"MFARecoveryCodes": []string{},
+			"WebAuthnCredentials": []utils.WebAuthnCredential{},
+		},
+	})
+
+	return err
+}
+
+// MFALoginRoute checks the second factor after UserLogin answered MFA_REQUIRED
+func MFALoginRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method == "POST") {
+		var request MFARequestJSON
+		err1 := json.NewDecoder(req.Body).Decode(&request)
+		if err1 != nil || utils.Validate.Struct(request) != nil {
+			utils.ReqLog(req).Error("MFALogin: Invalid MFA Request", err1)
+			utils.HTTPError(w, "MFA Request Error", http.StatusBadRequest, "MF001")
+			return
+		}
+
+		user, err := readMFAToken(req, MFAPendingLogin)
+		if err != nil {
+			utils.ReqLog(req).Error("MFALogin: No valid pending login", err)
+			utils.HTTPError(w, "Login expired, enter your password again", http.StatusUnauthorized, "MF004")
+			return
+		}
+
+		if mfaThrottled(user.Nickname) {
+			utils.ReqLog(req).Error("MFALogin: Too many failed codes for " + user.Nickname, nil)
+			utils.HTTPError(w, "Too many attempts, try again later", http.StatusTooManyRequests, "MF006")
+			return
+		}
+
+		valid, errV := checkSecondFactor(user, request.Token, request.RecoveryCode)
+		if errV != nil {
+			utils.ReqLog(req).Error("MFALogin: Error while checking code", errV)
+			utils.HTTPError(w, "User Logging Error", http.StatusInternalServerError, "MF001")
+			return
+		}
+
+		recordMFAResult(user.Nickname, valid)
+
+		if !valid {
+			time.Sleep(time.Second)
+			utils.ReqLog(req).Error("MFALogin: Invalid code for " + user.Nickname, nil)
+			utils.HTTPError(w, "Invalid code", http.StatusUnauthorized, "MF002")
+			return
+		}
+
+		clearMFAToken(w)
+		SendUserToken(w, req, user)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+
+		updateLastLogin(user.Nickname)
+	} else {
+		utils.ReqLog(req).Error("MFALogin: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// MFAResetRoute lets an admin remove the TOTP and passkeys of a user who lost their device
+func MFAResetRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "DELETE") {
+		nickname := utils.Sanitize(mux.Vars(req)["nickname"])
+
+		if _, err := GetUserByNickname(nickname); err != nil {
+			utils.ReqLog(req).Error("MFAReset: User not found " + nickname, err)
+			utils.HTTPError(w, "User not found", http.StatusNotFound, "MF001")
+			return
+		}
+
+		if err := resetMFA(nickname); err != nil {
+			utils.ReqLog(req).Error("MFAReset: Error while resetting MFA", err)
+			utils.HTTPError(w, "MFA Error", http.StatusInternalServerError, "MF001")
+			return
+		}
+
+		utils.ReqLog(req).Log("MFA: reset for " + nickname + " by " + req.Header.Get("x-cosmos-user"))
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.ReqLog(req).Error("MFAReset: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
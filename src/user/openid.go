@@ -0,0 +1,344 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+// discovery documents and keys of the providers are read again after an hour
+const openIDCacheLifetime = time.Hour
+
+var openIDClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+type openIDDiscovery struct {
+	Issuer string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	UserInfoEndpoint string `json:"userinfo_endpoint"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+type openIDProvider struct {
+	config utils.OpenIDProviderConfig
+	discovery openIDDiscovery
+	keys jose.JSONWebKeySet
+	keysFetched time.Time
+	fetched time.Time
+}
+
+var openIDProvidersLock sync.Mutex
+var openIDProviders = map[string]*openIDProvider{}
+
+// GetOpenIDProviderConfig returns the configuration of a provider by name
+func GetOpenIDProviderConfig(name string) (utils.OpenIDProviderConfig, bool) {
+	for _, provider := range utils.GetMainConfig().AuthConfig.OpenIDProviders {
+		if provider.Name == name {
+			return provider, true
+		}
+	}
+	return utils.OpenIDProviderConfig{}, false
+}
+
+func fetchJSON(ctx context.Context, url string, dest interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := openIDClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("GET " + url + ": " + resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1 << 20)).Decode(dest)
+}
+
+// getOpenIDProvider reads the discovery document of the provider, cached for an hour.
+// A change of the provider config, such as a new client secret, drops its cache
+func getOpenIDProvider(ctx context.Context, config utils.OpenIDProviderConfig) (*openIDProvider, error) {
+	openIDProvidersLock.Lock()
+	provider, ok := openIDProviders[config.Name]
+	openIDProvidersLock.Unlock()
+
+	if ok && reflect.DeepEqual(provider.config, config) && time.Since(provider.fetched) < openIDCacheLifetime {
+		return provider, nil
+	}
+
+	issuer := strings.TrimSuffix(config.Issuer, "/")
+
+	discovery := openIDDiscovery{}
+	if err := fetchJSON(ctx, issuer + "/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, errors.New("Discovery document of another issuer: " + discovery.Issuer)
+	}
+
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("Incomplete discovery document for " + issuer)
+	}
+
+	provider = &openIDProvider{
+		config: config,
+		discovery: discovery,
+		fetched: time.Now(),
+	}
+
+	openIDProvidersLock.Lock()
+	openIDProviders[config.Name] = provider
+	openIDProvidersLock.Unlock()
+
+	return provider, nil
+}
+
+func (provider *openIDProvider) oauth2Config() *oauth2.Config {
+	scopes := provider.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+
+	return &oauth2.Config{
+		ClientID: provider.config.ClientID,
+		ClientSecret: provider.config.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL: provider.discovery.AuthorizationEndpoint,
+			TokenURL: provider.discovery.TokenEndpoint,
+		},
+		RedirectURL: GetIssuer() + "/cosmos/api/oidc/" + provider.config.Name + "/callback",
+		Scopes: scopes,
+	}
+}
+
+// signingKeys returns the keys of the provider, read again when a token uses an unknown one
+func (provider *openIDProvider) signingKeys(ctx context.Context, refresh bool) (jose.JSONWebKeySet, error) {
+	openIDProvidersLock.Lock()
+	keys, fetched := provider.keys, provider.keysFetched
+	openIDProvidersLock.Unlock()
+
+	// a rotation can't make the provider be queried more than once a minute
+	if len(keys.Keys) > 0 && time.Since(fetched) < openIDCacheLifetime && (!refresh || time.Since(fetched) < time.Minute) {
+		return keys, nil
+	}
+
+	keys = jose.JSONWebKeySet{}
+	if err := fetchJSON(ctx, provider.discovery.JWKSURI, &keys); err != nil {
+		return keys, err
+	}
+
+	openIDProvidersLock.Lock()
+	provider.keys = keys
+	provider.keysFetched = time.Now()
+	openIDProvidersLock.Unlock()
+
+	return keys, nil
+}
+
+// idTokenKey finds the key of the kid, a provider with one key can leave it out
+func idTokenKey(keys jose.JSONWebKeySet, headers []jose.Header) interface{} {
+	kid := ""
+	for _, header := range headers {
+		if header.KeyID != "" {
+			kid = header.KeyID
+		}
+	}
+
+	if kid == "" && len(keys.Keys) == 1 {
+		return keys.Keys[0].Key
+	}
+
+	for _, key := range keys.Key(kid) {
+		if key.Use == "" || key.Use == "sig" {
+			return key.Key
+		}
+	}
+
+	return nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiration and nonce of an ID token
+func (provider *openIDProvider) verifyIDToken(ctx context.Context, rawIDToken string, nonce string) (map[string]interface{}, error) {
+	token, err := josejwt.ParseSigned(rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, header := range token.Headers {
+		if header.Algorithm == "none" || strings.HasPrefix(header.Algorithm, "HS") {
+			return nil, errors.New("Unsupported ID token algorithm " + header.Algorithm)
+		}
+	}
+
+	keys, err := provider.signingKeys(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	standard := josejwt.Claims{}
+	claims := map[string]interface{}{}
+
+	verify := func(keys jose.JSONWebKeySet) error {
+		key := idTokenKey(keys, token.Headers)
+		if key == nil {
+			return errors.New("Unknown ID token signing key")
+		}
+		return token.Claims(key, &standard, &claims)
+	}
+
+	if errC := verify(keys); errC != nil {
+		keys, err = provider.signingKeys(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		if errC = verify(keys); errC != nil {
+			return nil, errC
+		}
+	}
+
+	err = standard.ValidateWithLeeway(josejwt.Expected{
+		Issuer: provider.discovery.Issuer,
+		Audience: josejwt.Audience{provider.config.ClientID},
+		Time: time.Now(),
+	}, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(standard.Audience) > 1 {
+		if azp, _ := claims["azp"].(string); azp != provider.config.ClientID {
+			return nil, errors.New("ID token issued to another party")
+		}
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+
+	if subject, _ := claims["sub"].(string); subject == "" {
+		return nil, errors.New("ID token without subject")
+	}
+
+	return claims, nil
+}
+
+// userInfo completes the claims of the ID token with the userinfo endpoint
+func (provider *openIDProvider) userInfo(ctx context.Context, token *oauth2.Token, claims map[string]interface{}) error {
+	if provider.discovery.UserInfoEndpoint == "" {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", provider.discovery.UserInfoEndpoint, nil)
+	if err != nil {
+		return err
+	}
+	token.SetAuthHeader(req)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := openIDClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("userinfo: " + resp.Status)
+	}
+
+	info := map[string]interface{}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1 << 20)).Decode(&info); err != nil {
+		return err
+	}
+
+	// the userinfo of another subject is ignored
+	if info["sub"] != claims["sub"] {
+		return errors.New("userinfo of another subject")
+	}
+
+	for key, value := range info {
+		if _, exists := claims[key]; !exists {
+			claims[key] = value
+		}
+	}
+
+	return nil
+}
+
+// claimValues reads a string or a list of strings, nested claims are separated by dots
+func claimValues(claims map[string]interface{}, name string) []string {
+	var value interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+
+	switch typed := value.(type) {
+		case string:
+			return []string{typed}
+		case []interface{}:
+			values := []string{}
+			for _, item := range typed {
+				if s, ok := item.(string); ok {
+					values = append(values, s)
+				}
+			}
+			return values
+	}
+
+	return nil
+}
+
+// mapOpenIDRole gives the role of the user from RoleClaim, ok is false if the user is refused
+func mapOpenIDRole(config utils.OpenIDProviderConfig, claims map[string]interface{}, current utils.Role) (utils.Role, bool) {
+	if config.RoleClaim == "" {
+		if current == 0 {
+			return utils.USER, true
+		}
+		return current, true
+	}
+
+	values := claimValues(claims, config.RoleClaim)
+
+	matches := func(accepted []string) bool {
+		for _, value := range values {
+			for _, a := range accepted {
+				if value == a {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if matches(config.AdminValues) {
+		return utils.ADMIN, true
+	}
+
+	if len(config.UserValues) == 0 || matches(config.UserValues) {
+		return utils.USER, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,417 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/oauth2"
+)
+
+const openIDLoginTimeout = 10 * time.Minute
+const maxOpenIDLogins = 10000
+
+type openIDLogin struct {
+	provider string
+	nonce string
+	verifier string
+	redirect string
+	expires time.Time
+}
+
+var openIDLoginsLock sync.Mutex
+var openIDLogins = map[string]openIDLogin{}
+
+var nonAlphaNum = regexp.MustCompile(`[^a-zA-Z0-9]`)
+
+func openIDStateCookie(value string, expiration time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name: "oidcstate",
+		Value: value,
+		Expires: expiration,
+		Path: "/cosmos/api/oidc/",
+		Secure: true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// openIDFail sends the browser back to the login page with the reason
+func openIDFail(w http.ResponseWriter, req *http.Request, message string, err error) {
+	utils.ReqLog(req).Error("OpenIDLogin: " + message, err)
+	http.Redirect(w, req, "/ui/login?oidcerror=" + url.QueryEscape(message), http.StatusFound)
+}
+
+// localRedirect only keeps paths of this host, to not be an open redirect
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/ui"
+	}
+	return redirect
+}
+
+func randomToken() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// OpenIDProvidersRoute lists the providers for the login page
+func OpenIDProvidersRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method == "GET") {
+		providers := []map[string]interface{}{}
+
+		for _, provider := range utils.GetMainConfig().AuthConfig.OpenIDProviders {
+			displayName := provider.DisplayName
+			if displayName == "" {
+				displayName = provider.Name
+			}
+
+			providers = append(providers, map[string]interface{}{
+				"name": provider.Name,
+				"displayName": displayName,
+				"loginURL": "/cosmos/api/oidc/" + provider.Name + "/login",
+			})
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": providers,
+		})
+	} else {
+		utils.ReqLog(req).Error("OpenIDProviders: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// OpenIDLoginRoute sends the browser to the provider, with a state, a nonce and PKCE
+func OpenIDLoginRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET") {
+		utils.ReqLog(req).Error("OpenIDLogin: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+
+	config, ok := GetOpenIDProviderConfig(mux.Vars(req)["provider"])
+	if !ok {
+		utils.ReqLog(req).Error("OpenIDLogin: Unknown provider " + mux.Vars(req)["provider"], nil)
+		utils.HTTPError(w, "Unknown provider", http.StatusNotFound, "OI001")
+		return
+	}
+
+	provider, err := getOpenIDProvider(req.Context(), config)
+	if err != nil {
+		openIDFail(w, req, "Cannot reach " + config.Name, err)
+		return
+	}
+
+	state, errS := randomToken()
+	nonce, errN := randomToken()
+	verifier, errV := randomToken()
+	if errS != nil || errN != nil || errV != nil {
+		openIDFail(w, req, "Cannot start the login", errS)
+		return
+	}
+
+	openIDLoginsLock.Lock()
+	if len(openIDLogins) >= maxOpenIDLogins {
+		for key, login := range openIDLogins {
+			if time.Now().After(login.expires) {
+				delete(openIDLogins, key)
+			}
+		}
+	}
+	full := len(openIDLogins) >= maxOpenIDLogins
+	if !full {
+		openIDLogins[state] = openIDLogin{
+			provider: config.Name,
+			nonce: nonce,
+			verifier: verifier,
+			redirect: localRedirect(req.URL.Query().Get("redirect")),
+			expires: time.Now().Add(openIDLoginTimeout),
+		}
+	}
+	openIDLoginsLock.Unlock()
+
+	if full {
+		openIDFail(w, req, "Too many pending logins", nil)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	http.SetCookie(w, openIDStateCookie(state, time.Now().Add(openIDLoginTimeout)))
+
+	http.Redirect(w, req, provider.oauth2Config().AuthCodeURL(state,
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), http.StatusFound)
+}
+
+// OpenIDCallbackRoute exchanges the code of the provider, finds or provisions
+// the Cosmos user of the ID token and opens its session
+func OpenIDCallbackRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET") {
+		utils.ReqLog(req).Error("OpenIDCallback: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+
+	query := req.URL.Query()
+	state := query.Get("state")
+
+	cookie, errC := req.Cookie("oidcstate")
+	http.SetCookie(w, openIDStateCookie("", time.Now().Add(-time.Hour * 24 * 365)))
+
+	openIDLoginsLock.Lock()
+	login, ok := openIDLogins[state]
+	delete(openIDLogins, state)
+	openIDLoginsLock.Unlock()
+
+	// the state must come back to the browser which started the login
+	if errC != nil || state == "" || cookie.Value != state || !ok || time.Now().After(login.expires) {
+		openIDFail(w, req, "Login expired, try again", errC)
+		return
+	}
+
+	if login.provider != mux.Vars(req)["provider"] {
+		openIDFail(w, req, "Login started with another provider", nil)
+		return
+	}
+
+	if query.Get("error") != "" {
+		openIDFail(w, req, "Refused by the provider: " + query.Get("error"), nil)
+		return
+	}
+
+	config, ok := GetOpenIDProviderConfig(login.provider)
+	if !ok {
+		openIDFail(w, req, "Unknown provider", nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), 20 * time.Second)
+	defer cancel()
+
+	provider, err := getOpenIDProvider(ctx, config)
+	if err != nil {
+		openIDFail(w, req, "Cannot reach " + config.Name, err)
+		return
+	}
+
+	token, err := provider.oauth2Config().Exchange(context.WithValue(ctx, oauth2.HTTPClient, openIDClient),
+		query.Get("code"), oauth2.SetAuthURLParam("code_verifier", login.verifier))
+	if err != nil {
+		openIDFail(w, req, "Cannot exchange the code with " + config.Name, err)
+		return
+	}
+
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		openIDFail(w, req, config.Name + " did not return an ID token", nil)
+		return
+	}
+
+	claims, err := provider.verifyIDToken(ctx, rawIDToken, login.nonce)
+	if err != nil {
+		openIDFail(w, req, "Invalid ID token from " + config.Name, err)
+		return
+	}
+
+	if err := provider.userInfo(ctx, token, claims); err != nil {
+		utils.ReqLog(req).Warn("OpenIDCallback: userinfo of " + config.Name + " not read: " + err.Error())
+	}
+
+	user, err := resolveOpenIDUser(config, claims)
+	if err != nil {
+		openIDFail(w, req, err.Error(), nil)
+		return
+	}
+
+	// the provider replaces the password, the second factor is still asked
+	if MFARequired(user) {
+		purpose, step := MFAPendingLogin, "required"
+		if !HasSecondFactor(user) {
+			purpose, step = MFAPendingSetup, "setup"
+		}
+
+		if err := sendMFAToken(w, user, purpose); err != nil {
+			openIDFail(w, req, "Cannot start the second factor", err)
+			return
+		}
+
+		http.Redirect(w, req, "/ui/login?mfa=" + step + "&redirect=" + url.QueryEscape(login.redirect), http.StatusFound)
+		return
+	}
+
+	utils.ReqLog(req).Log("OpenIDLogin: " + user.Nickname + " logged in with " + config.Name)
+
+	SendUserToken(w, req, user)
+	updateLastLogin(user.Nickname)
+
+	http.Redirect(w, req, login.redirect, http.StatusFound)
+}
+
+// resolveOpenIDUser finds the user linked to the subject, links it by email
+// or provisions it, and applies the role mapping of the provider
+func resolveOpenIDUser(config utils.OpenIDProviderConfig, claims map[string]interface{}) (utils.User, error) {
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	emailVerified, _ := claims["email_verified"].(bool)
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+	if errCo != nil {
+		utils.Error("Database Connect", errCo)
+		return utils.User{}, errOpenID("Database error")
+	}
+
+	link := map[string]interface{}{
+		"Provider": config.Name,
+		"Subject": subject,
+	}
+
+	user := utils.User{}
+
+	err := c.FindOne(nil, map[string]interface{}{
+		"OpenIDLinks": map[string]interface{}{
+			"$elemMatch": link,
+		},
+	}).Decode(&user)
+
+	if err == mongo.ErrNoDocuments && config.LinkByEmail && email != "" && emailVerified {
+		errE := c.FindOne(nil, map[string]interface{}{
+			"Email": email,
+		}).Decode(&user)
+
+		if errE != nil && errE != mongo.ErrNoDocuments {
+			utils.Error("OpenIDLogin: Error while finding user by email", errE)
+			return utils.User{}, errOpenID("Database error")
+		}
+
+		if errE == nil {
+			for _, existing := range user.OpenIDLinks {
+				if existing.Provider == config.Name {
+					return utils.User{}, errOpenID("This account is linked to another " + config.Name + " user")
+				}
+			}
+
+			_, errL := c.UpdateOne(nil, map[string]interface{}{
+				"Nickname": user.Nickname,
+			}, map[string]interface{}{
+				"$push": map[string]interface{}{
+					"OpenIDLinks": link,
+				},
+			})
+			if errL != nil {
+				utils.Error("OpenIDLogin: Error while linking user", errL)
+				return utils.User{}, errOpenID("Database error")
+			}
+
+			utils.Log("OpenIDLogin: " + user.Nickname + " linked to " + config.Name + " by email")
+			err = nil
+		}
+	}
+
+	role, allowed := mapOpenIDRole(config, claims, user.Role)
+	if !allowed {
+		return utils.User{}, errOpenID("Your " + config.Name + " account is not allowed to use this server")
+	}
+
+	if err == mongo.ErrNoDocuments {
+		if !config.AutoProvision {
+			return utils.User{}, errOpenID("No account is linked to this " + config.Name + " user")
+		}
+
+		usernameClaim := config.UsernameClaim
+		if usernameClaim == "" {
+			usernameClaim = "preferred_username"
+		}
+
+		nickname := ""
+		if values := claimValues(claims, usernameClaim); len(values) > 0 {
+			nickname = values[0]
+		} else if email != "" {
+			nickname = strings.Split(email, "@")[0]
+		}
+		nickname = nonAlphaNum.ReplaceAllString(nickname, "")
+
+		if len(nickname) < 3 || len(nickname) > 32 {
+			return utils.User{}, errOpenID("No valid nickname for this " + config.Name + " user")
+		}
+
+		errN := c.FindOne(nil, map[string]interface{}{
+			"Nickname": nickname,
+		}).Err()
+		if errN != mongo.ErrNoDocuments {
+			return utils.User{}, errOpenID("The nickname " + nickname + " is already taken")
+		}
+
+		if !emailVerified {
+			email = ""
+		}
+
+		_, errI := c.InsertOne(nil, map[string]interface{}{
+			"Nickname": nickname,
+			"Email": email,
+			"Password": "",
+			"RegisterKey": "",
+			"Role": role,
+			"PasswordCycle": 0,
+			"Groups": []string{},
+			"OpenIDLinks": []map[string]interface{}{link},
+			"CreatedAt": time.Now(),
+			"RegisteredAt": time.Now(),
+		})
+		if errI != nil {
+			utils.Error("OpenIDLogin: Error while provisioning user", errI)
+			return utils.User{}, errOpenID("Cannot create the account")
+		}
+
+		utils.Log("OpenIDLogin: " + nickname + " provisioned from " + config.Name)
+
+		return GetUserByNickname(nickname)
+	} else if err != nil {
+		utils.Error("OpenIDLogin: Error while finding user", err)
+		return utils.User{}, errOpenID("Database error")
+	}
+
+	if role != user.Role {
+		_, errR := c.UpdateOne(nil, map[string]interface{}{
+			"Nickname": user.Nickname,
+		}, map[string]interface{}{
+			"$set": map[string]interface{}{
+				"Role": role,
+			},
+		})
+		if errR != nil {
+			utils.Error("OpenIDLogin: Error while updating role", errR)
+			return utils.User{}, errOpenID("Database error")
+		}
+
+		utils.Log("OpenIDLogin: role of " + user.Nickname + " set to " + utils.RoleNames[role] + " by " + config.Name)
+		user.Role = role
+	}
+
+	return user, nil
+}
+
+type errOpenID string
+
+func (e errOpenID) Error() string {
+	return string(e)
+}
@@ -24,14 +24,14 @@ func UserRegister(w http.ResponseWriter, req *http.Request) {
 		var request RegisterRequestJSON
 		err1 := json.NewDecoder(req.Body).Decode(&request)
 		if err1 != nil {
-			utils.Error("UserRegister: Invalid User Request", err1)
+			utils.ReqLog(req).Error("UserRegister: Invalid User Request", err1)
 			utils.HTTPError(w, "User Register Error", http.StatusInternalServerError, "UR001")
 			return
 		}
 
 		errV := utils.Validate.Struct(request)
 		if errV != nil {
-			utils.Error("UserRegister: Invalid User Request", errV)
+			utils.ReqLog(req).Error("UserRegister: Invalid User Request", errV)
 			utils.HTTPError(w, "User Register Error: " + errV.Error(), http.StatusInternalServerError, "UR002")
 			return
 		}
@@ -40,19 +40,19 @@ func UserRegister(w http.ResponseWriter, req *http.Request) {
 		password := request.Password
 		registerKey := request.RegisterKey
 
-		utils.Debug("UserRegister: Registering user " + nickname)
+		utils.ReqLog(req).Debug("UserRegister: Registering user " + nickname)
 				
 		hashedPassword, err2 := bcrypt.GenerateFromPassword([]byte(password), 14)
 
 		if err2 != nil {
-			utils.Error("UserRegister: Encryption error", err2)
+			utils.ReqLog(req).Error("UserRegister: Encryption error", err2)
 			utils.HTTPError(w, "User Register Error", http.StatusUnauthorized, "UR001")
 			return
 		}
 
 		c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
 		if errCo != nil {
-				utils.Error("Database Connect", errCo)
+				utils.ReqLog(req).Error("Database Connect", errCo)
 				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
 				return
 		}
@@ -65,15 +65,15 @@ func UserRegister(w http.ResponseWriter, req *http.Request) {
 		}).Decode(&user)
 
 		if err3 == mongo.ErrNoDocuments {
-			utils.Error("UserRegister: User not found", err3)
+			utils.ReqLog(req).Error("UserRegister: User not found", err3)
 			utils.HTTPError(w, "User Register Error", http.StatusInternalServerError, "UR001")
 			return
 		} else if err3 != nil {
-			utils.Error("UserRegister: Error while finding user", err3)
+			utils.ReqLog(req).Error("UserRegister: Error while finding user", err3)
 			utils.HTTPError(w, "User Register Error", http.StatusInternalServerError, "UR001")
 			return
 		} else if user.RegisterKeyExp.Before(time.Now()) {
-			utils.Error("UserRegister: Link expired", nil)
+			utils.ReqLog(req).Error("UserRegister: Link expired", nil)
 			utils.HTTPError(w, "User Register Error", http.StatusInternalServerError, "UR001")
 			return
 		} else {
@@ -97,7 +97,7 @@ func UserRegister(w http.ResponseWriter, req *http.Request) {
 			})
 
 			if err4 != nil {
-				utils.Error("UserRegister: Error while updating user", err4)
+				utils.ReqLog(req).Error("UserRegister: Error while updating user", err4)
 				utils.HTTPError(w, "User Register Error", http.StatusInternalServerError, "UR001")
 				return
 			}
@@ -107,7 +107,7 @@ func UserRegister(w http.ResponseWriter, req *http.Request) {
 			"status": "OK",
 		})
 	} else {
-		utils.Error("UserRegister: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserRegister: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
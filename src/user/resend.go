@@ -18,7 +18,7 @@ func UserResendInviteLink(w http.ResponseWriter, req *http.Request) {
 		var request InviteRequestJSON
 		err1 := json.NewDecoder(req.Body).Decode(&request)
 		if err1 != nil {
-			utils.Error("UserInvite: Invalid User Request", err1)
+			utils.ReqLog(req).Error("UserInvite: Invalid User Request", err1)
 			utils.HTTPError(w, "User Send Invite Error", http.StatusInternalServerError, "US001")
 			return
 		}
@@ -29,11 +29,11 @@ func UserResendInviteLink(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		utils.Debug("Re-Sending an invite to " + nickname)
+		utils.ReqLog(req).Debug("Re-Sending an invite to " + nickname)
 		
 		c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
 		if errCo != nil {
-				utils.Error("Database Connect", errCo)
+				utils.ReqLog(req).Error("Database Connect", errCo)
 				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
 				return
 		}
@@ -47,19 +47,19 @@ func UserResendInviteLink(w http.ResponseWriter, req *http.Request) {
 		}).Decode(&user)
 
 		if err == mongo.ErrNoDocuments {
-			utils.Error("UserInvite: User not found", err)
+			utils.ReqLog(req).Error("UserInvite: User not found", err)
 			utils.HTTPError(w, "User Send Invite Error", http.StatusNotFound, "US001")
 			return
 		} else if err != nil {
-			utils.Error("UserInvite: Error while finding user", err)
+			utils.ReqLog(req).Error("UserInvite: Error while finding user", err)
 			utils.HTTPError(w, "User Send Invite Error", http.StatusInternalServerError, "US001")
 			return
 		} else {
 			RegisterKeyExp := time.Now().Add(time.Hour * 24 * 7)
 			RegisterKey := utils.GenerateRandomString(48)
 
-			utils.Debug(RegisterKey)
-			utils.Debug(RegisterKeyExp.String())
+			utils.ReqLog(req).Debug(RegisterKey)
+			utils.ReqLog(req).Debug(RegisterKeyExp.String())
 
 			_, err := c.UpdateOne(nil, map[string]interface{}{
 				"Nickname": nickname,
@@ -71,7 +71,7 @@ func UserResendInviteLink(w http.ResponseWriter, req *http.Request) {
 			})
 
 			if err != nil {
-				utils.Error("UserInvite: Error while updating user", err)
+				utils.ReqLog(req).Error("UserInvite: Error while updating user", err)
 				utils.HTTPError(w, "User Send Invite Error", http.StatusInternalServerError, "US001")
 				return
 			}
@@ -87,7 +87,7 @@ func UserResendInviteLink(w http.ResponseWriter, req *http.Request) {
 			})
 		}
 	} else {
-		utils.Error("UserInvite: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserInvite: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
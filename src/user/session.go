@@ -0,0 +1,270 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LastSeen is written at most once a minute per session
+const sessionTouchInterval = time.Minute
+
+var sessionCollection *mongo.Collection
+var sessionLock sync.Mutex
+
+// getSessionCollection creates the indexes on first use, expired sessions are dropped by the database
+func getSessionCollection() (*mongo.Collection, error) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+
+	if sessionCollection != nil {
+		return sessionCollection, nil
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "sessions")
+	if errCo != nil {
+		return nil, errCo
+	}
+
+	_, err := c.Indexes().CreateMany(nil, []mongo.IndexModel{
+		{
+			Keys: map[string]interface{}{"SessionID": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: map[string]interface{}{"Nickname": 1},
+		},
+		{
+			Keys: map[string]interface{}{"ExpiresAt": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sessionCollection = c
+	return c, nil
+}
+
+func sessionLifetime() time.Duration {
+	hours := utils.GetMainConfig().AuthConfig.SessionLifetime
+	if hours <= 0 {
+		hours = 72
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// sessionExpiration moves the end of the session forward, up to SessionMaxLifetime
+func sessionExpiration(session utils.Session) time.Time {
+	expiration := time.Now().Add(sessionLifetime())
+
+	if max := utils.GetMainConfig().AuthConfig.SessionMaxLifetime; max > 0 {
+		limit := session.CreatedAt.Add(time.Duration(max) * time.Hour)
+		if expiration.After(limit) {
+			expiration = limit
+		}
+	}
+
+	return expiration
+}
+
+func createSession(req *http.Request, user utils.User) (utils.Session, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return utils.Session{}, err
+	}
+
+	device := req.UserAgent()
+	if len(device) > 256 {
+		device = device[:256]
+	}
+
+	session := utils.Session{
+		SessionID: base64.RawURLEncoding.EncodeToString(random),
+		Nickname: user.Nickname,
+		Device: device,
+		IP: utils.GetClientIP(req),
+		CreatedAt: time.Now(),
+		LastSeen: time.Now(),
+	}
+	session.ExpiresAt = sessionExpiration(session)
+
+	c, errCo := getSessionCollection()
+	if errCo != nil {
+		return session, errCo
+	}
+
+	_, err := c.InsertOne(nil, map[string]interface{}{
+		"SessionID": session.SessionID,
+		"Nickname": session.Nickname,
+		"Device": session.Device,
+		"IP": session.IP,
+		"CreatedAt": session.CreatedAt,
+		"LastSeen": session.LastSeen,
+		"ExpiresAt": session.ExpiresAt,
+	})
+	return session, err
+}
+
+func getSession(nickname string, sessionID string) (utils.Session, error) {
+	session := utils.Session{}
+
+	c, errCo := getSessionCollection()
+	if errCo != nil {
+		return session, errCo
+	}
+
+	err := c.FindOne(nil, map[string]interface{}{
+		"SessionID": sessionID,
+		"Nickname": nickname,
+	}).Decode(&session)
+	if err != nil {
+		return session, err
+	}
+
+	// the database drops expired sessions about every minute
+	if time.Now().After(session.ExpiresAt) {
+		return session, mongo.ErrNoDocuments
+	}
+
+	return session, nil
+}
+
+// touchSession records the use of the session and moves its expiration forward
+func touchSession(req *http.Request, session utils.Session) (utils.Session, error) {
+	if time.Since(session.LastSeen) < sessionTouchInterval {
+		return session, nil
+	}
+
+	c, errCo := getSessionCollection()
+	if errCo != nil {
+		return session, errCo
+	}
+
+	session.LastSeen = time.Now()
+	session.IP = utils.GetClientIP(req)
+	session.ExpiresAt = sessionExpiration(session)
+
+	_, err := c.UpdateOne(nil, map[string]interface{}{
+		"SessionID": session.SessionID,
+	}, map[string]interface{}{
+		"$set": map[string]interface{}{
+			"LastSeen": session.LastSeen,
+			"IP": session.IP,
+			"ExpiresAt": session.ExpiresAt,
+		},
+	})
+
+	return session, err
+}
+
+func listSessions(nickname string) ([]utils.Session, error) {
+	sessions := []utils.Session{}
+
+	c, errCo := getSessionCollection()
+	if errCo != nil {
+		return sessions, errCo
+	}
+
+	cursor, err := c.Find(nil, map[string]interface{}{
+		"Nickname": nickname,
+		"ExpiresAt": map[string]interface{}{
+			"$gt": time.Now(),
+		},
+	}, options.Find().SetSort(map[string]interface{}{"LastSeen": -1}))
+	if err != nil {
+		return sessions, err
+	}
+	defer cursor.Close(nil)
+
+	err = cursor.All(nil, &sessions)
+	return sessions, err
+}
+
+// revokeSessions logs the user out of every device, except the session `except` when set
+func revokeSessions(nickname string, except string) (int64, error) {
+	c, errCo := getSessionCollection()
+	if errCo != nil {
+		return 0, errCo
+	}
+
+	filter := map[string]interface{}{
+		"Nickname": nickname,
+	}
+	if except != "" {
+		filter["SessionID"] = map[string]interface{}{
+			"$ne": except,
+		}
+	}
+
+	result, err := c.DeleteMany(nil, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
+
+func revokeSession(nickname string, sessionID string) (bool, error) {
+	c, errCo := getSessionCollection()
+	if errCo != nil {
+		return false, errCo
+	}
+
+	result, err := c.DeleteOne(nil, map[string]interface{}{
+		"SessionID": sessionID,
+		"Nickname": nickname,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
+
+// CurrentSession returns the session of the logged in user of the request
+func CurrentSession(req *http.Request) (utils.Session, error) {
+	sid := currentSessionID(req)
+	if sid == "" {
+		return utils.Session{}, mongo.ErrNoDocuments
+	}
+
+	return getSession(req.Header.Get("x-cosmos-user"), sid)
+}
+
+// currentSessionID reads the sid of the session cookie, once its signature is checked
+func currentSessionID(req *http.Request) string {
+	cookie, err := req.Cookie("jwttoken")
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+
+	claims := jwt.MapClaims{}
+
+	_, err = jwt.ParseWithClaims(cookie.Value, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, errors.New("Unexpected signing method")
+		}
+		return jwt.ParseEdPublicKeyFromPEM([]byte(utils.GetPublicAuthKey()))
+	})
+	if err != nil {
+		return ""
+	}
+
+	sid, _ := claims["sid"].(string)
+	if strings.TrimSpace(sid) == "" {
+		return ""
+	}
+
+	return sid
+}
@@ -0,0 +1,131 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/gorilla/mux"
+)
+
+// sessionsOwner is the user of /api/users/{nickname}/sessions, or the logged in
+// user for /api/sessions. Admins can manage the sessions of every user
+func sessionsOwner(w http.ResponseWriter, req *http.Request) (string, bool) {
+	nickname := utils.Sanitize(mux.Vars(req)["nickname"])
+
+	if nickname == "" {
+		if utils.LoggedInOnly(w, req) != nil {
+			return "", false
+		}
+		return req.Header.Get("x-cosmos-user"), true
+	}
+
+	if utils.AdminOrItselfOnly(w, req, nickname) != nil {
+		return "", false
+	}
+
+	return nickname, true
+}
+
+// SessionsRoute lists the sessions of a user, or logs it out everywhere
+func SessionsRoute(w http.ResponseWriter, req *http.Request) {
+	nickname, ok := sessionsOwner(w, req)
+	if !ok {
+		return
+	}
+
+	current := ""
+	if nickname == req.Header.Get("x-cosmos-user") {
+		current = currentSessionID(req)
+	}
+
+	if(req.Method == "GET") {
+		sessions, err := listSessions(nickname)
+		if err != nil {
+			utils.ReqLog(req).Error("SessionList: Error while listing sessions", err)
+			utils.HTTPError(w, "Session List Error", http.StatusInternalServerError, "SE001")
+			return
+		}
+
+		for i := range sessions {
+			sessions[i].Current = sessions[i].SessionID == current
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": sessions,
+		})
+	} else if(req.Method == "DELETE") {
+		// ?keepCurrent=true logs out every other device
+		keepCurrent, _ := strconv.ParseBool(req.URL.Query().Get("keepCurrent"))
+
+		except := ""
+		if keepCurrent {
+			except = current
+		}
+
+		count, err := revokeSessions(nickname, except)
+		if err != nil {
+			utils.ReqLog(req).Error("SessionRevoke: Error while revoking sessions", err)
+			utils.HTTPError(w, "Session Revoke Error", http.StatusInternalServerError, "SE001")
+			return
+		}
+
+		utils.ReqLog(req).Log("Sessions: " + strconv.FormatInt(count, 10) + " sessions of " + nickname + " revoked by " + req.Header.Get("x-cosmos-user"))
+
+		if current != "" && except == "" {
+			logOutUser(w)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": map[string]interface{}{
+				"revoked": count,
+			},
+		})
+	} else {
+		utils.ReqLog(req).Error("SessionRoute: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// SessionsIdRoute revokes one session of a user
+func SessionsIdRoute(w http.ResponseWriter, req *http.Request) {
+	nickname, ok := sessionsOwner(w, req)
+	if !ok {
+		return
+	}
+
+	if(req.Method == "DELETE") {
+		sessionID := mux.Vars(req)["id"]
+
+		found, err := revokeSession(nickname, sessionID)
+		if err != nil {
+			utils.ReqLog(req).Error("SessionRevoke: Error while revoking session", err)
+			utils.HTTPError(w, "Session Revoke Error", http.StatusInternalServerError, "SE001")
+			return
+		}
+
+		if !found {
+			utils.ReqLog(req).Error("SessionRevoke: Session not found", nil)
+			utils.HTTPError(w, "Session not found", http.StatusNotFound, "SE002")
+			return
+		}
+
+		utils.ReqLog(req).Log("Sessions: a session of " + nickname + " revoked by " + req.Header.Get("x-cosmos-user"))
+
+		if nickname == req.Header.Get("x-cosmos-user") && sessionID == currentSessionID(req) {
+			logOutUser(w)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.ReqLog(req).Error("SessionRoute: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
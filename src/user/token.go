@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 	"encoding/json"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func RefreshUserToken(w http.ResponseWriter, req *http.Request) (utils.User, error) {
@@ -46,7 +47,7 @@ func RefreshUserToken(w http.ResponseWriter, req *http.Request) (utils.User, err
 	ed25519Key, errK := jwt.ParseEdPublicKeyFromPEM([]byte(utils.GetPublicAuthKey()))
 
 	if errK != nil {
-		utils.Error("UserToken: Cannot read auth public key", errK)
+		utils.ReqLog(req).Error("UserToken: Cannot read auth public key", errK)
 		utils.HTTPError(w, "Authorization Error", http.StatusInternalServerError, "A001")
 		return utils.User{}, errors.New("Cannot read auth public key")
 	}
@@ -56,7 +57,7 @@ func RefreshUserToken(w http.ResponseWriter, req *http.Request) (utils.User, err
 	errT := jwt.SigningMethodEdDSA.Verify(strings.Join(parts[0:2], "."), parts[2], ed25519Key)
 
 	if errT != nil {
-		utils.Error("UserToken: Token likely falsified", errT)
+		utils.ReqLog(req).Error("UserToken: Token likely falsified", errT)
 		logOutUser(w)
 		redirectToReLogin(w, req)
 		return utils.User{}, errors.New("Token likely falsified")
@@ -73,20 +74,40 @@ func RefreshUserToken(w http.ResponseWriter, req *http.Request) (utils.User, err
 	})
 
 	if errP != nil {
-		utils.Error("UserToken: token is not valid", nil)
+		utils.ReqLog(req).Error("UserToken: token is not valid", nil)
 		logOutUser(w)
 		redirectToReLogin(w, req)
 		return utils.User{}, errors.New("Token not valid")
 	}
 
-	nickname := claims["nickname"].(string)
-	passwordCycle := int(claims["passwordCycle"].(float64))
+	// an mfatoken only proves the password
+	if _, pending := claims["mfaPending"]; pending {
+		utils.ReqLog(req).Error("UserToken: pending MFA token used as a session", nil)
+		logOutUser(w)
+		redirectToReLogin(w, req)
+		return utils.User{}, errors.New("Token not valid")
+	}
+
+	// app, ID and access tokens are signed with the same key but are not sessions
+	nickname, okN := claims["nickname"].(string)
+	passwordCycleClaim, okP := claims["passwordCycle"].(float64)
+	_, isApp := claims["route"]
+	_, isOAuth := claims["aud"]
+
+	if !okN || !okP || isApp || isOAuth {
+		utils.ReqLog(req).Error("UserToken: token is not a session", nil)
+		logOutUser(w)
+		redirectToReLogin(w, req)
+		return utils.User{}, errors.New("Token not valid")
+	}
+
+	passwordCycle := int(passwordCycleClaim)
 
 	userInBase := utils.User{}
 
 	c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
 		if errCo != nil {
-				utils.Error("Database Connect", errCo)
+				utils.ReqLog(req).Error("Database Connect", errCo)
 				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
 				return utils.User{}, errCo
 		}
@@ -96,19 +117,56 @@ func RefreshUserToken(w http.ResponseWriter, req *http.Request) (utils.User, err
 	}).Decode(&userInBase)
 	
 	if errDB != nil {
-		utils.Error("UserToken: User not found", errDB)
+		utils.ReqLog(req).Error("UserToken: User not found", errDB)
 		logOutUser(w)
 		redirectToReLogin(w, req)
 		return utils.User{}, errors.New("User not found")
 	}
 
 	if userInBase.PasswordCycle != passwordCycle {
-		utils.Error("UserToken: Password cycle changed, token is too old", nil)
+		utils.ReqLog(req).Error("UserToken: Password cycle changed, token is too old", nil)
 		logOutUser(w)
 		redirectToReLogin(w, req)
 		return utils.User{}, errors.New("Password cycle changed, token is too old")
 	}
 
+	// sessions opened before TOTP was enabled, or before it was required, are closed
+	mfa, _ := claims["mfa"].(bool)
+	if MFARequired(userInBase) && !(mfa && HasSecondFactor(userInBase)) {
+		utils.ReqLog(req).Error("UserToken: Session opened without second factor", nil)
+		logOutUser(w)
+		redirectToReLogin(w, req)
+		return utils.User{}, errors.New("Second factor required")
+	}
+
+	// the session can be revoked from another device, tokens without sid predate sessions
+	sid, _ := claims["sid"].(string)
+	session, errS := getSession(nickname, sid)
+
+	if errS == mongo.ErrNoDocuments || sid == "" {
+		utils.ReqLog(req).Error("UserToken: Session revoked or expired", nil)
+		logOutUser(w)
+		redirectToReLogin(w, req)
+		return utils.User{}, errors.New("Session revoked")
+	} else if errS != nil {
+		utils.ReqLog(req).Error("UserToken: Error while reading session", errS)
+		utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+		return utils.User{}, errS
+	}
+
+	session, errS = touchSession(req, session)
+	if errS != nil {
+		utils.ReqLog(req).Error("UserToken: Error while updating session", errS)
+	}
+
+	// sliding renewal, the cookie follows the session once half of it is used
+	if exp, _ := claims["exp"].(float64); errS == nil && time.Until(time.Unix(int64(exp), 0)) < sessionLifetime() / 2 &&
+		session.ExpiresAt.Unix() > int64(exp) {
+		if errT := setSessionCookie(w, userInBase, session, mfa); errT != nil {
+			utils.ReqLog(req).Error("UserToken: Error while renewing token", errT)
+		}
+	}
+
 	return userInBase, nil
 }
 
@@ -132,16 +190,38 @@ func logOutUser(w http.ResponseWriter) {
 	}
 
 	http.SetCookie(w, &cookie)
-
-	// TODO: logout every other device if asked by increasing passwordcycle
 }
 
 func redirectToReLogin(w http.ResponseWriter, req *http.Request) {
 	http.Redirect(w, req, "/ui/login?invalid=1&redirect=" + req.URL.Path + "&" + req.URL.RawQuery, http.StatusTemporaryRedirect)
 }
 
-func SendUserToken(w http.ResponseWriter, user utils.User) {
-	expiration := time.Now().Add(3 * 24 * time.Hour)
+// SendUserToken opens a session for the device of the request
+func SendUserToken(w http.ResponseWriter, req *http.Request, user utils.User) {
+	// a token reissued to the same browser replaces its session
+	if sid := currentSessionID(req); sid != "" {
+		if _, err := revokeSession(user.Nickname, sid); err != nil {
+			utils.ReqLog(req).Error("UserLogin: Error while closing previous session", err)
+		}
+	}
+
+	session, errS := createSession(req, user)
+
+	if errS != nil {
+		utils.ReqLog(req).Error("UserLogin: Error while creating session", errS)
+		utils.HTTPError(w, "User Logging Error", http.StatusInternalServerError, "UL001")
+		return
+	}
+
+	if err := setSessionCookie(w, user, session, HasSecondFactor(user)); err != nil {
+		utils.ReqLog(req).Error("UserLogin: Error while signing token", err)
+		utils.HTTPError(w, "User Logging Error", http.StatusInternalServerError, "UL001")
+		return
+	}
+}
+
+func setSessionCookie(w http.ResponseWriter, user utils.User, session utils.Session, mfa bool) error {
+	expiration := session.ExpiresAt
 
 	token := jwt.New(jwt.SigningMethodEdDSA)
 	claims := token.Claims.(jwt.MapClaims)
@@ -149,26 +229,24 @@ func SendUserToken(w http.ResponseWriter, user utils.User) {
 	claims["role"] = user.Role
 	claims["nickname"] = user.Nickname
 	claims["passwordCycle"] = user.PasswordCycle
+	claims["groups"] = user.Groups
+	claims["mfa"] = mfa
+	claims["sid"] = session.SessionID
 	claims["iat"] = time.Now().Unix()
 	claims["nbf"] = time.Now().Unix()
 
 	key, err5 := jwt.ParseEdPrivateKeyFromPEM([]byte(utils.GetPrivateAuthKey()))
 	
 	if err5 != nil {
-		utils.Error("UserLogin: Error while retrieving signing key", err5)
-		utils.HTTPError(w, "User Logging Error", http.StatusInternalServerError, "UL001")
-		return
+		return err5
 	}
 
 	tokenString, err4 := token.SignedString(key)
 
 	if err4 != nil {
-		utils.Error("UserLogin: Error while signing token", err4)
-		utils.HTTPError(w, "User Logging Error", http.StatusInternalServerError, "UL001")
-		return
+		return err4
 	}
 
-
 	cookie := http.Cookie{
 		Name: "jwttoken",
 		Value: tokenString,
@@ -184,5 +262,5 @@ func SendUserToken(w http.ResponseWriter, user utils.User) {
 	}
 
 	http.SetCookie(w, &cookie)
-	// http.SetCookie(w, &cookie2)
-}
\ No newline at end of file
+	return nil
+}
@@ -13,7 +13,7 @@ func UsersIdRoute(w http.ResponseWriter, req *http.Request) {
 	} else if (req.Method == "PATCH") {
 		UserEdit(w, req)
 	} else {
-		utils.Error("UserRoute: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserRoute: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -25,7 +25,7 @@ func UsersRoute(w http.ResponseWriter, req *http.Request) {
 	} else if (req.Method == "GET") {
 		UserList(w, req)
 	} else {
-		utils.Error("UserRoute: Method not allowed" + req.Method, nil)
+		utils.ReqLog(req).Error("UserRoute: Method not allowed" + req.Method, nil)
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
@@ -0,0 +1,423 @@
+package user
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+const webauthnTimeout = 5 * time.Minute
+const maxWebAuthnSessions = 10000
+const maxWebAuthnCredentials = 20
+
+// authenticator data flags
+const (
+	webauthnUserPresent = 0x01
+	webauthnUserVerified = 0x04
+	webauthnAttestedData = 0x40
+)
+
+// COSE algorithms offered to the authenticators: ES256, EdDSA and RS256
+var webauthnAlgorithms = []int64{-7, -8, -257}
+
+// purposes of a ceremony
+const (
+	webauthnRegister = "register"
+	webauthnSecondFactor = "mfa"
+	webauthnPasswordless = "passwordless"
+)
+
+type webauthnSession struct {
+	nickname string
+	purpose string
+	expires time.Time
+}
+
+var errCeremonyUser = errors.New("Ceremony of another user")
+
+var webauthnSessionsLock sync.Mutex
+var webauthnSessions = map[string]webauthnSession{}
+
+type webauthnCredentialJSON struct {
+	ID string `json:"id"`
+	RawID string `json:"rawId"`
+	Type string `json:"type"`
+	Response struct {
+		ClientDataJSON string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature string `json:"signature"`
+		UserHandle string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type webauthnClientData struct {
+	Type string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin string `json:"origin"`
+}
+
+type webauthnAuthData struct {
+	rpIDHash []byte
+	flags byte
+	signCount uint32
+	credentialID []byte
+	publicKey []byte
+}
+
+// WebAuthnRPID is the relying party of the passkeys, they are bound to the hostname
+func WebAuthnRPID() string {
+	return utils.GetMainConfig().HTTPConfig.Hostname
+}
+
+// browsers send base64url without padding, some libraries add it
+func decodeWebAuthnB64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func webauthnUserHandle(user utils.User) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(user.ID.Hex()))
+}
+
+// newWebAuthnChallenge starts a ceremony, a challenge can only be answered once
+func newWebAuthnChallenge(nickname string, purpose string) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(random)
+
+	webauthnSessionsLock.Lock()
+	defer webauthnSessionsLock.Unlock()
+
+	if len(webauthnSessions) >= maxWebAuthnSessions {
+		for key, session := range webauthnSessions {
+			if time.Now().After(session.expires) {
+				delete(webauthnSessions, key)
+			}
+		}
+		if len(webauthnSessions) >= maxWebAuthnSessions {
+			return "", errors.New("Too many pending WebAuthn ceremonies")
+		}
+	}
+
+	webauthnSessions[challenge] = webauthnSession{
+		nickname: nickname,
+		purpose: purpose,
+		expires: time.Now().Add(webauthnTimeout),
+	}
+
+	return challenge, nil
+}
+
+func takeWebAuthnSession(challenge string) (webauthnSession, bool) {
+	webauthnSessionsLock.Lock()
+	defer webauthnSessionsLock.Unlock()
+
+	session, ok := webauthnSessions[challenge]
+	delete(webauthnSessions, challenge)
+
+	if !ok || time.Now().After(session.expires) {
+		return webauthnSession{}, false
+	}
+
+	return session, true
+}
+
+// verifyClientData checks the type and origin of the ceremony and returns its session
+func verifyClientData(clientDataJSON []byte, ceremony string) (webauthnSession, error) {
+	clientData := webauthnClientData{}
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return webauthnSession{}, err
+	}
+
+	if clientData.Type != ceremony {
+		return webauthnSession{}, errors.New("Wrong ceremony type " + clientData.Type)
+	}
+
+	origin, err := url.Parse(clientData.Origin)
+	if err != nil || origin.Hostname() != WebAuthnRPID() {
+		return webauthnSession{}, errors.New("Wrong origin " + clientData.Origin)
+	}
+
+	// browsers only allow plain http on localhost
+	if origin.Scheme != "https" && !(origin.Scheme == "http" && origin.Hostname() == "localhost") {
+		return webauthnSession{}, errors.New("Wrong origin " + clientData.Origin)
+	}
+
+	session, ok := takeWebAuthnSession(strings.TrimRight(clientData.Challenge, "="))
+	if !ok {
+		return webauthnSession{}, errors.New("Unknown or expired challenge")
+	}
+
+	return session, nil
+}
+
+func parseAuthData(data []byte) (webauthnAuthData, error) {
+	authData := webauthnAuthData{}
+
+	if len(data) < 37 {
+		return authData, errors.New("Authenticator data too short")
+	}
+
+	authData.rpIDHash = data[:32]
+	authData.flags = data[32]
+	authData.signCount = binary.BigEndian.Uint32(data[33:37])
+
+	rpIDHash := sha256.Sum256([]byte(WebAuthnRPID()))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return authData, errors.New("Credential of another relying party")
+	}
+
+	if authData.flags & webauthnUserPresent == 0 {
+		return authData, errors.New("User not present")
+	}
+
+	if authData.flags & webauthnAttestedData == 0 {
+		return authData, nil
+	}
+
+	// aaguid, then the length of the credential id
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authData, errors.New("Attested credential data too short")
+	}
+
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength == 0 || idLength > 1023 || len(rest) < idLength {
+		return authData, errors.New("Invalid credential id")
+	}
+
+	authData.credentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	_, read, err := decodeCBOR(rest)
+	if err != nil {
+		return authData, err
+	}
+	authData.publicKey = rest[:read]
+
+	if _, err := parseCOSEKey(authData.publicKey); err != nil {
+		return authData, err
+	}
+
+	return authData, nil
+}
+
+func coseInt(key map[interface{}]interface{}, label int64) (int64, bool) {
+	value, ok := key[label].(int64)
+	return value, ok
+}
+
+func coseBytes(key map[interface{}]interface{}, label int64) []byte {
+	value, _ := key[label].([]byte)
+	return value
+}
+
+// parseCOSEKey reads the public key of a credential (RFC 9053)
+func parseCOSEKey(raw []byte) (crypto.PublicKey, error) {
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("COSE key is not a map")
+	}
+
+	kty, _ := coseInt(key, 1)
+	alg, _ := coseInt(key, 3)
+
+	switch {
+		case kty == 2 && alg == -7:
+			if crv, _ := coseInt(key, -1); crv != 1 {
+				return nil, errors.New("Unsupported EC2 curve")
+			}
+			x, y := coseBytes(key, -2), coseBytes(key, -3)
+			if len(x) != 32 || len(y) != 32 {
+				return nil, errors.New("Invalid EC2 key")
+			}
+			publicKey := &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X: new(big.Int).SetBytes(x),
+				Y: new(big.Int).SetBytes(y),
+			}
+			if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+				return nil, errors.New("Invalid EC2 key")
+			}
+			return publicKey, nil
+
+		case kty == 1 && alg == -8:
+			if crv, _ := coseInt(key, -1); crv != 6 {
+				return nil, errors.New("Unsupported OKP curve")
+			}
+			x := coseBytes(key, -2)
+			if len(x) != ed25519.PublicKeySize {
+				return nil, errors.New("Invalid OKP key")
+			}
+			return ed25519.PublicKey(x), nil
+
+		case kty == 3 && alg == -257:
+			n, e := coseBytes(key, -1), coseBytes(key, -2)
+			if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+				return nil, errors.New("Invalid RSA key")
+			}
+			return &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}, nil
+	}
+
+	return nil, errors.New("Unsupported COSE key")
+}
+
+// verifyAssertionSignature checks the signature of authenticatorData || SHA-256(clientDataJSON)
+func verifyAssertionSignature(rawKey []byte, authData []byte, clientDataJSON []byte, signature []byte) error {
+	publicKey, err := parseCOSEKey(rawKey)
+	if err != nil {
+		return err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	digest := sha256.Sum256(signed)
+
+	switch key := publicKey.(type) {
+		case *ecdsa.PublicKey:
+			if !ecdsa.VerifyASN1(key, digest[:], signature) {
+				return errors.New("Invalid signature")
+			}
+		case ed25519.PublicKey:
+			if !ed25519.Verify(key, signed, signature) {
+				return errors.New("Invalid signature")
+			}
+		case *rsa.PublicKey:
+			return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	}
+
+	return nil
+}
+
+// verifyRegistration checks a new credential and returns its id and COSE key
+func verifyRegistration(credential webauthnCredentialJSON) (webauthnSession, webauthnAuthData, error) {
+	clientDataJSON, err := decodeWebAuthnB64(credential.Response.ClientDataJSON)
+	if err != nil {
+		return webauthnSession{}, webauthnAuthData{}, err
+	}
+
+	session, err := verifyClientData(clientDataJSON, "webauthn.create")
+	if err != nil {
+		return session, webauthnAuthData{}, err
+	}
+
+	if session.purpose != webauthnRegister {
+		return session, webauthnAuthData{}, errors.New("Challenge of another ceremony")
+	}
+
+	rawAttestation, err := decodeWebAuthnB64(credential.Response.AttestationObject)
+	if err != nil {
+		return session, webauthnAuthData{}, err
+	}
+
+	decoded, _, err := decodeCBOR(rawAttestation)
+	if err != nil {
+		return session, webauthnAuthData{}, err
+	}
+
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return session, webauthnAuthData{}, errors.New("Invalid attestation object")
+	}
+
+	// the attestation is requested as "none", the statement is not checked
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return session, webauthnAuthData{}, errors.New("Missing authenticator data")
+	}
+
+	authData, err := parseAuthData(rawAuthData)
+	if err != nil {
+		return session, authData, err
+	}
+
+	if authData.publicKey == nil {
+		return session, authData, errors.New("Missing attested credential")
+	}
+
+	rawID, err := decodeWebAuthnB64(credential.RawID)
+	if err != nil || !bytes.Equal(rawID, authData.credentialID) {
+		return session, authData, errors.New("Credential id mismatch")
+	}
+
+	return session, authData, nil
+}
+
+// verifyAssertion checks a login against the credential of the user
+func verifyAssertion(credential webauthnCredentialJSON, stored utils.WebAuthnCredential) (webauthnSession, webauthnAuthData, error) {
+	clientDataJSON, err := decodeWebAuthnB64(credential.Response.ClientDataJSON)
+	if err != nil {
+		return webauthnSession{}, webauthnAuthData{}, err
+	}
+
+	session, err := verifyClientData(clientDataJSON, "webauthn.get")
+	if err != nil {
+		return session, webauthnAuthData{}, err
+	}
+
+	if session.purpose != webauthnSecondFactor && session.purpose != webauthnPasswordless {
+		return session, webauthnAuthData{}, errors.New("Challenge of another ceremony")
+	}
+
+	rawAuthData, err := decodeWebAuthnB64(credential.Response.AuthenticatorData)
+	if err != nil {
+		return session, webauthnAuthData{}, err
+	}
+
+	authData, err := parseAuthData(rawAuthData)
+	if err != nil {
+		return session, authData, err
+	}
+
+	signature, err := decodeWebAuthnB64(credential.Response.Signature)
+	if err != nil {
+		return session, authData, err
+	}
+
+	if err := verifyAssertionSignature(stored.PublicKey, rawAuthData, clientDataJSON, signature); err != nil {
+		return session, authData, err
+	}
+
+	if session.purpose == webauthnPasswordless && authData.flags & webauthnUserVerified == 0 {
+		return session, authData, errors.New("User not verified")
+	}
+
+	// a counter going back means the authenticator was cloned
+	if (authData.signCount != 0 || stored.SignCount != 0) && authData.signCount <= stored.SignCount {
+		return session, authData, errors.New("Signature counter did not increase")
+	}
+
+	return session, authData, nil
+}
+
+// HasSecondFactor tells if the user enrolled TOTP or a passkey
+func HasSecondFactor(user utils.User) bool {
+	return user.MFAEnabled || len(user.WebAuthnCredentials) > 0
+}
@@ -0,0 +1,461 @@
+package user
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type WebAuthnRegisterRequestJSON struct {
+	Name string `validate:"max=64"`
+	Credential webauthnCredentialJSON
+}
+
+type WebAuthnLoginBeginRequestJSON struct {
+	Nickname string `validate:"omitempty,max=32,alphanum"`
+}
+
+type WebAuthnLoginRequestJSON struct {
+	Credential webauthnCredentialJSON
+}
+
+func webauthnDescriptors(credentials []utils.WebAuthnCredential) []map[string]interface{} {
+	descriptors := []map[string]interface{}{}
+	for _, credential := range credentials {
+		descriptors = append(descriptors, map[string]interface{}{
+			"type": "public-key",
+			"id": credential.ID,
+		})
+	}
+	return descriptors
+}
+
+// WebAuthnRegisterBeginRoute returns the options of navigator.credentials.create()
+// to add a passkey to the logged in user, or to the one enrolling a second factor on login
+func WebAuthnRegisterBeginRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method == "POST") {
+		user, _, err := mfaSetupUser(w, req)
+		if err != nil {
+			return
+		}
+
+		if len(user.WebAuthnCredentials) >= maxWebAuthnCredentials {
+			utils.ReqLog(req).Error("WebAuthnRegister: Too many credentials for " + user.Nickname, nil)
+			utils.HTTPError(w, "Too many passkeys", http.StatusBadRequest, "WA001")
+			return
+		}
+
+		challenge, err := newWebAuthnChallenge(user.Nickname, webauthnRegister)
+		if err != nil {
+			utils.ReqLog(req).Error("WebAuthnRegister: Error while creating challenge", err)
+			utils.HTTPError(w, "WebAuthn Error", http.StatusInternalServerError, "WA001")
+			return
+		}
+
+		algorithms := []map[string]interface{}{}
+		for _, alg := range webauthnAlgorithms {
+			algorithms = append(algorithms, map[string]interface{}{
+				"type": "public-key",
+				"alg": alg,
+			})
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": map[string]interface{}{
+				"publicKey": map[string]interface{}{
+					"challenge": challenge,
+					"rp": map[string]interface{}{
+						"id": WebAuthnRPID(),
+						"name": "Cosmos",
+					},
+					"user": map[string]interface{}{
+						"id": webauthnUserHandle(user),
+						"name": user.Nickname,
+						"displayName": user.Nickname,
+					},
+					"pubKeyCredParams": algorithms,
+					"timeout": webauthnTimeout.Milliseconds(),
+					"attestation": "none",
+					"excludeCredentials": webauthnDescriptors(user.WebAuthnCredentials),
+					"authenticatorSelection": map[string]interface{}{
+						"residentKey": "preferred",
+						"userVerification": "preferred",
+					},
+				},
+			},
+		})
+	} else {
+		utils.ReqLog(req).Error("WebAuthnRegister: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// WebAuthnRegisterFinishRoute stores the credential returned by navigator.credentials.create()
+func WebAuthnRegisterFinishRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method == "POST") {
+		user, pending, err := mfaSetupUser(w, req)
+		if err != nil {
+			return
+		}
+
+		var request WebAuthnRegisterRequestJSON
+		err1 := json.NewDecoder(req.Body).Decode(&request)
+		if err1 != nil || utils.Validate.Struct(request) != nil {
+			utils.ReqLog(req).Error("WebAuthnRegister: Invalid WebAuthn Request", err1)
+			utils.HTTPError(w, "WebAuthn Request Error", http.StatusBadRequest, "WA001")
+			return
+		}
+
+		session, authData, errV := verifyRegistration(request.Credential)
+		if errV == nil && session.nickname != user.Nickname {
+			errV = errCeremonyUser
+		}
+		if errV != nil {
+			utils.ReqLog(req).Error("WebAuthnRegister: Invalid credential for " + user.Nickname, errV)
+			utils.HTTPError(w, "Passkey verification failed", http.StatusUnauthorized, "WA002")
+			return
+		}
+
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+		if errCo != nil {
+				utils.ReqLog(req).Error("Database Connect", errCo)
+				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+				return
+		}
+
+		credentialID := base64.RawURLEncoding.EncodeToString(authData.credentialID)
+
+		errF := c.FindOne(nil, map[string]interface{}{
+			"WebAuthnCredentials.ID": credentialID,
+		}).Err()
+		if errF != nil && errF != mongo.ErrNoDocuments {
+			utils.ReqLog(req).Error("WebAuthnRegister: Error while finding credential", errF)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+		}
+		if errF == nil {
+			utils.ReqLog(req).Error("WebAuthnRegister: Credential already registered", nil)
+			utils.HTTPError(w, "Passkey already registered", http.StatusConflict, "WA003")
+			return
+		}
+
+		name := utils.Sanitize(request.Name)
+		if name == "" {
+			name = "Passkey"
+		}
+
+		credential := utils.WebAuthnCredential{
+			ID: credentialID,
+			Name: name,
+			PublicKey: authData.publicKey,
+			SignCount: authData.signCount,
+			CreatedAt: time.Now(),
+		}
+
+		_, errDB := c.UpdateOne(nil, map[string]interface{}{
+			"Nickname": user.Nickname,
+		}, map[string]interface{}{
+			"$push": map[string]interface{}{
+				"WebAuthnCredentials": map[string]interface{}{
+					"ID": credential.ID,
+					"Name": credential.Name,
+					"PublicKey": credential.PublicKey,
+					"SignCount": int64(credential.SignCount),
+					"CreatedAt": credential.CreatedAt,
+				},
+			},
+		})
+		if errDB != nil {
+			utils.ReqLog(req).Error("WebAuthnRegister: Error while saving credential", errDB)
+			utils.HTTPError(w, "WebAuthn Error", http.StatusInternalServerError, "WA001")
+			return
+		}
+
+		utils.ReqLog(req).Log("WebAuthn: passkey " + name + " added by " + user.Nickname)
+
+		// the session is reissued, the ones opened without the second factor are closed
+		user.WebAuthnCredentials = append(user.WebAuthnCredentials, credential)
+		SendUserToken(w, req, user)
+
+		if pending {
+			clearMFAToken(w)
+			updateLastLogin(user.Nickname)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": credential,
+		})
+	} else {
+		utils.ReqLog(req).Error("WebAuthnRegister: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// WebAuthnLoginBeginRoute returns the options of navigator.credentials.get(). After the
+// password it asks for a second factor, otherwise for a passwordless login with user
+// verification, with the passkeys of the given nickname or any discoverable one
+func WebAuthnLoginBeginRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method == "POST") {
+		var request WebAuthnLoginBeginRequestJSON
+		err1 := json.NewDecoder(req.Body).Decode(&request)
+		if err1 != nil || utils.Validate.Struct(request) != nil {
+			utils.ReqLog(req).Error("WebAuthnLogin: Invalid WebAuthn Request", err1)
+			utils.HTTPError(w, "WebAuthn Request Error", http.StatusBadRequest, "WA001")
+			return
+		}
+
+		purpose := webauthnPasswordless
+		nickname := utils.Sanitize(request.Nickname)
+		userVerification := "required"
+
+		user, errM := readMFAToken(req, MFAPendingLogin)
+		if errM == nil {
+			purpose = webauthnSecondFactor
+			nickname = user.Nickname
+			userVerification = "preferred"
+		} else if nickname != "" {
+			// unknown users get an empty list, like the discoverable login
+			user, _ = GetUserByNickname(nickname)
+		}
+
+		challenge, err := newWebAuthnChallenge(nickname, purpose)
+		if err != nil {
+			utils.ReqLog(req).Error("WebAuthnLogin: Error while creating challenge", err)
+			utils.HTTPError(w, "WebAuthn Error", http.StatusInternalServerError, "WA001")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": map[string]interface{}{
+				"publicKey": map[string]interface{}{
+					"challenge": challenge,
+					"rpId": WebAuthnRPID(),
+					"timeout": webauthnTimeout.Milliseconds(),
+					"allowCredentials": webauthnDescriptors(user.WebAuthnCredentials),
+					"userVerification": userVerification,
+				},
+			},
+		})
+	} else {
+		utils.ReqLog(req).Error("WebAuthnLogin: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// WebAuthnLoginFinishRoute checks the assertion of navigator.credentials.get() and opens the session
+func WebAuthnLoginFinishRoute(w http.ResponseWriter, req *http.Request) {
+	if(req.Method == "POST") {
+		var request WebAuthnLoginRequestJSON
+		err1 := json.NewDecoder(req.Body).Decode(&request)
+		if err1 != nil {
+			utils.ReqLog(req).Error("WebAuthnLogin: Invalid WebAuthn Request", err1)
+			utils.HTTPError(w, "WebAuthn Request Error", http.StatusBadRequest, "WA001")
+			return
+		}
+
+		rawID, errID := decodeWebAuthnB64(request.Credential.RawID)
+		if errID != nil || len(rawID) == 0 {
+			utils.ReqLog(req).Error("WebAuthnLogin: Invalid credential id", errID)
+			utils.HTTPError(w, "WebAuthn Request Error", http.StatusBadRequest, "WA001")
+			return
+		}
+		credentialID := base64.RawURLEncoding.EncodeToString(rawID)
+
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+		if errCo != nil {
+				utils.ReqLog(req).Error("Database Connect", errCo)
+				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+				return
+		}
+
+		user := utils.User{}
+
+		errDB := c.FindOne(nil, map[string]interface{}{
+			"WebAuthnCredentials.ID": credentialID,
+		}).Decode(&user)
+		if errDB != nil {
+			utils.ReqLog(req).Error("WebAuthnLogin: Unknown credential", errDB)
+			utils.HTTPError(w, "Passkey verification failed", http.StatusUnauthorized, "WA002")
+			return
+		}
+
+		stored := utils.WebAuthnCredential{}
+		for _, credential := range user.WebAuthnCredentials {
+			if credential.ID == credentialID {
+				stored = credential
+			}
+		}
+
+		session, authData, errV := verifyAssertion(request.Credential, stored)
+
+		if errV == nil && session.nickname != "" && session.nickname != user.Nickname {
+			errV = errCeremonyUser
+		}
+
+		if errV == nil && request.Credential.Response.UserHandle != "" {
+			handle, _ := decodeWebAuthnB64(request.Credential.Response.UserHandle)
+			if base64.RawURLEncoding.EncodeToString(handle) != webauthnUserHandle(user) {
+				errV = errCeremonyUser
+			}
+		}
+
+		// a second factor needs the password checked by UserLogin
+		if errV == nil && session.purpose == webauthnSecondFactor {
+			pendingUser, errM := readMFAToken(req, MFAPendingLogin)
+			if errM != nil || pendingUser.Nickname != user.Nickname {
+				errV = errCeremonyUser
+			}
+		}
+
+		if errV != nil {
+			utils.ReqLog(req).Error("WebAuthnLogin: Invalid assertion for " + user.Nickname, errV)
+			utils.HTTPError(w, "Passkey verification failed", http.StatusUnauthorized, "WA002")
+			return
+		}
+
+		if user.Password == "" && len(user.OpenIDLinks) == 0 {
+			utils.ReqLog(req).Error("WebAuthnLogin: User not registered", nil)
+			utils.HTTPError(w, "User not registered", http.StatusUnauthorized, "UL002")
+			return
+		}
+
+		_, errU := c.UpdateOne(nil, map[string]interface{}{
+			"Nickname": user.Nickname,
+			"WebAuthnCredentials.ID": credentialID,
+		}, map[string]interface{}{
+			"$set": map[string]interface{}{
+				"WebAuthnCredentials.$.SignCount": int64(authData.signCount),
+				"WebAuthnCredentials.$.LastUsed": time.Now(),
+			},
+		})
+		if errU != nil {
+			utils.ReqLog(req).Error("WebAuthnLogin: Error while updating credential", errU)
+		}
+
+		utils.ReqLog(req).Debug("WebAuthnLogin: " + user.Nickname + " logged in with passkey " + stored.Name)
+
+		clearMFAToken(w)
+		SendUserToken(w, req, user)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+
+		updateLastLogin(user.Nickname)
+	} else {
+		utils.ReqLog(req).Error("WebAuthnLogin: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// WebAuthnCredentialsRoute lists the passkeys of the logged in user
+func WebAuthnCredentialsRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.LoggedInOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "GET") {
+		user, err := GetUserByNickname(req.Header.Get("x-cosmos-user"))
+		if err != nil {
+			utils.ReqLog(req).Error("WebAuthnCredentials: Error while getting user", err)
+			utils.HTTPError(w, "User not found", http.StatusInternalServerError, "WA001")
+			return
+		}
+
+		credentials := user.WebAuthnCredentials
+		if credentials == nil {
+			credentials = []utils.WebAuthnCredential{}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": credentials,
+		})
+	} else {
+		utils.ReqLog(req).Error("WebAuthnCredentials: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// WebAuthnCredentialIdRoute removes a passkey of the logged in user
+func WebAuthnCredentialIdRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.LoggedInOnly(w, req) != nil {
+		return
+	}
+
+	if(req.Method == "DELETE") {
+		id := mux.Vars(req)["id"]
+
+		user, err := GetUserByNickname(req.Header.Get("x-cosmos-user"))
+		if err != nil {
+			utils.ReqLog(req).Error("WebAuthnCredentials: Error while getting user", err)
+			utils.HTTPError(w, "User not found", http.StatusInternalServerError, "WA001")
+			return
+		}
+
+		found := false
+		for _, credential := range user.WebAuthnCredentials {
+			if credential.ID == id {
+				found = true
+			}
+		}
+
+		if !found {
+			utils.ReqLog(req).Error("WebAuthnCredentials: Unknown credential " + id, nil)
+			utils.HTTPError(w, "Passkey not found", http.StatusNotFound, "WA004")
+			return
+		}
+
+		if user.Role >= utils.ADMIN && utils.GetMainConfig().AuthConfig.RequireMFAForAdmins &&
+			!user.MFAEnabled && len(user.WebAuthnCredentials) == 1 {
+			utils.ReqLog(req).Error("WebAuthnCredentials: A second factor is required for admins", nil)
+			utils.HTTPError(w, "MFA is required for admins", http.StatusForbidden, "WA005")
+			return
+		}
+
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "users")
+		if errCo != nil {
+				utils.ReqLog(req).Error("Database Connect", errCo)
+				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+				return
+		}
+
+		_, errDB := c.UpdateOne(nil, map[string]interface{}{
+			"Nickname": user.Nickname,
+		}, map[string]interface{}{
+			"$pull": map[string]interface{}{
+				"WebAuthnCredentials": map[string]interface{}{
+					"ID": id,
+				},
+			},
+		})
+		if errDB != nil {
+			utils.ReqLog(req).Error("WebAuthnCredentials: Error while removing credential", errDB)
+			utils.HTTPError(w, "WebAuthn Error", http.StatusInternalServerError, "WA001")
+			return
+		}
+
+		utils.ReqLog(req).Log("WebAuthn: passkey removed by " + user.Nickname)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.ReqLog(req).Error("WebAuthnCredentials: Method not allowed" + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,574 @@
+package user
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+const testRPID = "cosmos.example.com"
+const testOrigin = "https://" + testRPID
+
+func setupWebAuthnTest(t *testing.T) {
+	previous := utils.GetBaseMainConfig()
+	t.Cleanup(func() {
+		utils.LoadBaseMainConfig(previous)
+	})
+
+	config := previous
+	config.LoggingLevel = "ERROR"
+	config.HTTPConfig.Hostname = testRPID
+	utils.LoadBaseMainConfig(config)
+}
+
+// cborPair keeps the order of the map entries, authenticators use the
+// CTAP2 canonical order
+type cborPair struct {
+	key interface{}
+	value interface{}
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+		case n < 24:
+			return []byte{major << 5 | byte(n)}
+		case n <= math.MaxUint8:
+			return []byte{major << 5 | 24, byte(n)}
+		case n <= math.MaxUint16:
+			return binary.BigEndian.AppendUint16([]byte{major << 5 | 25}, uint16(n))
+		case n <= math.MaxUint32:
+			return binary.BigEndian.AppendUint32([]byte{major << 5 | 26}, uint32(n))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major << 5 | 27}, n)
+}
+
+func encodeCBOR(value interface{}) []byte {
+	switch v := value.(type) {
+		case int:
+			if v < 0 {
+				return cborHead(1, uint64(-1 - v))
+			}
+			return cborHead(0, uint64(v))
+		case []byte:
+			return append(cborHead(2, uint64(len(v))), v...)
+		case string:
+			return append(cborHead(3, uint64(len(v))), v...)
+		case []interface{}:
+			out := cborHead(4, uint64(len(v)))
+			for _, item := range v {
+				out = append(out, encodeCBOR(item)...)
+			}
+			return out
+		case []cborPair:
+			out := cborHead(5, uint64(len(v)))
+			for _, pair := range v {
+				out = append(out, encodeCBOR(pair.key)...)
+				out = append(out, encodeCBOR(pair.value)...)
+			}
+			return out
+	}
+	panic("encodeCBOR: unsupported type")
+}
+
+// testAuthenticator is a software authenticator following the WebAuthn
+// Level 2 formats, with a "none" attestation like Cosmos requests
+type testAuthenticator struct {
+	name string
+	key crypto.Signer
+	credentialID []byte
+	signCount uint32
+}
+
+func newTestAuthenticator(t *testing.T, name string) *testAuthenticator {
+	var key crypto.Signer
+	var err error
+
+	switch name {
+		case "ES256":
+			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		case "EdDSA":
+			_, key, err = ed25519.GenerateKey(rand.Reader)
+		case "RS256":
+			key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialID := make([]byte, 32)
+	rand.Read(credentialID)
+
+	return &testAuthenticator{name: name, key: key, credentialID: credentialID}
+}
+
+func (a *testAuthenticator) coseKey() []byte {
+	switch key := a.key.Public().(type) {
+		case *ecdsa.PublicKey:
+			return encodeCBOR([]cborPair{
+				{1, 2}, {3, -7}, {-1, 1},
+				{-2, key.X.FillBytes(make([]byte, 32))},
+				{-3, key.Y.FillBytes(make([]byte, 32))},
+			})
+		case ed25519.PublicKey:
+			return encodeCBOR([]cborPair{
+				{1, 1}, {3, -8}, {-1, 6}, {-2, []byte(key)},
+			})
+		case *rsa.PublicKey:
+			return encodeCBOR([]cborPair{
+				{1, 3}, {3, -257},
+				{-1, key.N.Bytes()},
+				{-2, big.NewInt(int64(key.E)).Bytes()},
+			})
+	}
+	return nil
+}
+
+func (a *testAuthenticator) authData(rpID string, flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+
+	return data
+}
+
+func (a *testAuthenticator) sign(data []byte) []byte {
+	var signature []byte
+	var err error
+
+	switch key := a.key.(type) {
+		case *ecdsa.PrivateKey:
+			digest := sha256.Sum256(data)
+			signature, err = ecdsa.SignASN1(rand.Reader, key, digest[:])
+		case ed25519.PrivateKey:
+			signature = ed25519.Sign(key, data)
+		case *rsa.PrivateKey:
+			digest := sha256.Sum256(data)
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return signature
+}
+
+func clientDataJSON(ceremony string, challenge string, origin string) []byte {
+	data, _ := json.Marshal(webauthnClientData{
+		Type: ceremony,
+		Challenge: challenge,
+		Origin: origin,
+	})
+	return data
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ceremony describes what the browser and the authenticator send, the
+// rejection tests change one field at a time
+type ceremony struct {
+	ceremonyType string
+	challenge string
+	origin string
+	rpID string
+	flags byte
+	signCount uint32
+	tamper bool
+}
+
+func validCeremony(ceremonyType string, challenge string) ceremony {
+	return ceremony{
+		ceremonyType: ceremonyType,
+		challenge: challenge,
+		origin: testOrigin,
+		rpID: testRPID,
+		flags: webauthnUserPresent | webauthnUserVerified,
+	}
+}
+
+func (a *testAuthenticator) attestation(c ceremony) webauthnCredentialJSON {
+	a.signCount = c.signCount
+
+	credential := webauthnCredentialJSON{
+		ID: b64(a.credentialID),
+		RawID: b64(a.credentialID),
+		Type: "public-key",
+	}
+	credential.Response.ClientDataJSON = b64(clientDataJSON(c.ceremonyType, c.challenge, c.origin))
+	credential.Response.AttestationObject = b64(encodeCBOR([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authData(c.rpID, c.flags | webauthnAttestedData, true)},
+	}))
+
+	return credential
+}
+
+func (a *testAuthenticator) assertion(c ceremony) webauthnCredentialJSON {
+	a.signCount = c.signCount
+
+	authData := a.authData(c.rpID, c.flags, false)
+	clientData := clientDataJSON(c.ceremonyType, c.challenge, c.origin)
+	clientDataHash := sha256.Sum256(clientData)
+	signature := a.sign(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	if c.tamper {
+		signature[len(signature) / 2] ^= 0xff
+	}
+
+	credential := webauthnCredentialJSON{
+		ID: b64(a.credentialID),
+		RawID: b64(a.credentialID),
+		Type: "public-key",
+	}
+	credential.Response.ClientDataJSON = b64(clientData)
+	credential.Response.AuthenticatorData = b64(authData)
+	credential.Response.Signature = b64(signature)
+
+	return credential
+}
+
+func newTestChallenge(t *testing.T, purpose string) string {
+	challenge, err := newWebAuthnChallenge("alice", purpose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+// registerTestAuthenticator registers the authenticator and returns the stored credential
+func registerTestAuthenticator(t *testing.T, a *testAuthenticator) utils.WebAuthnCredential {
+	challenge := newTestChallenge(t, webauthnRegister)
+
+	session, authData, err := verifyRegistration(a.attestation(validCeremony("webauthn.create", challenge)))
+	if err != nil {
+		t.Fatalf("registration: %v", err)
+	}
+	if session.nickname != "alice" {
+		t.Fatalf("registration: session of %q", session.nickname)
+	}
+	if !bytes.Equal(authData.credentialID, a.credentialID) {
+		t.Fatalf("registration: credential id %x, expected %x", authData.credentialID, a.credentialID)
+	}
+
+	publicKey, err := parseCOSEKey(authData.publicKey)
+	if err != nil {
+		t.Fatalf("registration: %v", err)
+	}
+	if !publicKey.(interface{ Equal(crypto.PublicKey) bool }).Equal(a.key.Public()) {
+		t.Fatalf("registration: public key %#v, expected %#v", publicKey, a.key.Public())
+	}
+
+	return utils.WebAuthnCredential{
+		ID: b64(authData.credentialID),
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+	}
+}
+
+func TestWebAuthnCeremonies(t *testing.T) {
+	setupWebAuthnTest(t)
+
+	for _, name := range []string{"ES256", "EdDSA", "RS256"} {
+		t.Run(name, func(t *testing.T) {
+			a := newTestAuthenticator(t, name)
+			stored := registerTestAuthenticator(t, a)
+
+			for i, purpose := range []string{webauthnSecondFactor, webauthnPasswordless} {
+				c := validCeremony("webauthn.get", newTestChallenge(t, purpose))
+				c.signCount = uint32(i + 1)
+
+				session, authData, err := verifyAssertion(a.assertion(c), stored)
+				if err != nil {
+					t.Fatalf("%s assertion: %v", purpose, err)
+				}
+				if session.purpose != purpose {
+					t.Fatalf("%s assertion: session of %q", purpose, session.purpose)
+				}
+				if authData.signCount != c.signCount {
+					t.Fatalf("%s assertion: counter %d, expected %d", purpose, authData.signCount, c.signCount)
+				}
+
+				stored.SignCount = authData.signCount
+			}
+		})
+	}
+}
+
+func TestWebAuthnAssertionRejected(t *testing.T) {
+	setupWebAuthnTest(t)
+
+	authenticators := map[string]*testAuthenticator{}
+	credentials := map[string]utils.WebAuthnCredential{}
+	for _, name := range []string{"ES256", "EdDSA", "RS256"} {
+		authenticators[name] = newTestAuthenticator(t, name)
+		stored := registerTestAuthenticator(t, authenticators[name])
+		stored.SignCount = 5
+		credentials[name] = stored
+	}
+
+	tests := []struct {
+		name string
+		purpose string
+		change func(c *ceremony)
+		err string
+	}{
+		{"wrong rpIdHash", webauthnSecondFactor, func(c *ceremony) { c.rpID = "evil.example.com" }, "Credential of another relying party"},
+		{"wrong origin", webauthnSecondFactor, func(c *ceremony) { c.origin = "https://evil.example.com" }, "Wrong origin"},
+		{"plain http origin", webauthnSecondFactor, func(c *ceremony) { c.origin = "http://" + testRPID }, "Wrong origin"},
+		{"wrong type", webauthnSecondFactor, func(c *ceremony) { c.ceremonyType = "webauthn.create" }, "Wrong ceremony type"},
+		{"unknown challenge", webauthnSecondFactor, func(c *ceremony) { c.challenge = b64([]byte("not issued by cosmos")) }, "Unknown or expired challenge"},
+		{"registration challenge", webauthnRegister, func(c *ceremony) {}, "Challenge of another ceremony"},
+		{"user not present", webauthnSecondFactor, func(c *ceremony) { c.flags = webauthnUserVerified }, "User not present"},
+		{"passwordless without user verification", webauthnPasswordless, func(c *ceremony) { c.flags = webauthnUserPresent }, "User not verified"},
+		{"invalid signature", webauthnSecondFactor, func(c *ceremony) { c.tamper = true }, ""},
+		{"same counter", webauthnSecondFactor, func(c *ceremony) { c.signCount = 5 }, "Signature counter did not increase"},
+		{"counter going back", webauthnSecondFactor, func(c *ceremony) { c.signCount = 4 }, "Signature counter did not increase"},
+		{"counter reset to zero", webauthnSecondFactor, func(c *ceremony) { c.signCount = 0 }, "Signature counter did not increase"},
+	}
+
+	for _, name := range []string{"ES256", "EdDSA", "RS256"} {
+		for _, test := range tests {
+			t.Run(name + "/" + test.name, func(t *testing.T) {
+				c := validCeremony("webauthn.get", newTestChallenge(t, test.purpose))
+				c.signCount = 6
+				test.change(&c)
+
+				_, _, err := verifyAssertion(authenticators[name].assertion(c), credentials[name])
+				if err == nil {
+					t.Fatal("assertion accepted")
+				}
+				if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %q, expected %q", err, test.err)
+				}
+			})
+		}
+	}
+}
+
+func TestWebAuthnChallengeReused(t *testing.T) {
+	setupWebAuthnTest(t)
+
+	a := newTestAuthenticator(t, "ES256")
+	stored := registerTestAuthenticator(t, a)
+
+	c := validCeremony("webauthn.get", newTestChallenge(t, webauthnSecondFactor))
+	c.signCount = 1
+	credential := a.assertion(c)
+
+	if _, _, err := verifyAssertion(credential, stored); err != nil {
+		t.Fatalf("first assertion: %v", err)
+	}
+
+	// even before the counter is saved, the challenge is gone
+	if _, _, err := verifyAssertion(credential, stored); err == nil || !strings.Contains(err.Error(), "Unknown or expired challenge") {
+		t.Fatalf("replayed assertion: %v", err)
+	}
+
+	// an assertion with a bad signature uses its challenge too
+	c = validCeremony("webauthn.get", newTestChallenge(t, webauthnSecondFactor))
+	c.signCount = 2
+	c.tamper = true
+	if _, _, err := verifyAssertion(a.assertion(c), stored); err == nil {
+		t.Fatal("tampered assertion accepted")
+	}
+
+	c.tamper = false
+	if _, _, err := verifyAssertion(a.assertion(c), stored); err == nil || !strings.Contains(err.Error(), "Unknown or expired challenge") {
+		t.Fatalf("challenge of a failed assertion: %v", err)
+	}
+}
+
+func TestWebAuthnRegistrationRejected(t *testing.T) {
+	setupWebAuthnTest(t)
+
+	a := newTestAuthenticator(t, "ES256")
+
+	tests := []struct {
+		name string
+		purpose string
+		change func(c *ceremony, credential *webauthnCredentialJSON)
+		err string
+	}{
+		{"wrong rpIdHash", webauthnRegister, func(c *ceremony, credential *webauthnCredentialJSON) {
+			*credential = a.attestation(ceremony{c.ceremonyType, c.challenge, c.origin, "evil.example.com", c.flags, 0, false})
+		}, "Credential of another relying party"},
+		{"wrong origin", webauthnRegister, func(c *ceremony, credential *webauthnCredentialJSON) {
+			*credential = a.attestation(ceremony{c.ceremonyType, c.challenge, "https://evil.example.com", c.rpID, c.flags, 0, false})
+		}, "Wrong origin"},
+		{"wrong type", webauthnRegister, func(c *ceremony, credential *webauthnCredentialJSON) {
+			*credential = a.attestation(ceremony{"webauthn.get", c.challenge, c.origin, c.rpID, c.flags, 0, false})
+		}, "Wrong ceremony type"},
+		{"login challenge", webauthnPasswordless, func(c *ceremony, credential *webauthnCredentialJSON) {}, "Challenge of another ceremony"},
+		{"credential id mismatch", webauthnRegister, func(c *ceremony, credential *webauthnCredentialJSON) {
+			credential.RawID = b64([]byte("another credential"))
+		}, "Credential id mismatch"},
+		{"truncated attestation", webauthnRegister, func(c *ceremony, credential *webauthnCredentialJSON) {
+			raw, _ := decodeWebAuthnB64(credential.Response.AttestationObject)
+			credential.Response.AttestationObject = b64(raw[:len(raw) - 10])
+		}, "cbor: truncated data"},
+		{"missing attested credential", webauthnRegister, func(c *ceremony, credential *webauthnCredentialJSON) {
+			credential.Response.AttestationObject = b64(encodeCBOR([]cborPair{
+				{"fmt", "none"},
+				{"attStmt", []cborPair{}},
+				{"authData", a.authData(testRPID, webauthnUserPresent, false)},
+			}))
+		}, "Missing attested credential"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := validCeremony("webauthn.create", newTestChallenge(t, test.purpose))
+			credential := a.attestation(c)
+			test.change(&c, &credential)
+
+			_, _, err := verifyRegistration(credential)
+			if err == nil {
+				t.Fatal("registration accepted")
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("error %q, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		value interface{}
+	}{
+		{"small integer", []byte{0x17}, int64(23)},
+		{"one byte integer", []byte{0x18, 0x18}, int64(24)},
+		{"eight bytes integer", []byte{0x1b, 0, 0, 0, 1, 0, 0, 0, 0}, int64(1 << 32)},
+		{"negative integer", []byte{0x38, 0x63}, int64(-100)},
+		{"byte string", []byte{0x43, 1, 2, 3}, []byte{1, 2, 3}},
+		{"text string", []byte{0x64, 'I', 'E', 'T', 'F'}, "IETF"},
+		{"array", []byte{0x82, 0x01, 0x20}, []interface{}{int64(1), int64(-1)}},
+		{"map", []byte{0xa2, 0x01, 0x02, 0x61, 'a', 0xf5}, map[interface{}]interface{}{int64(1): int64(2), "a": true}},
+		{"false", []byte{0xf4}, false},
+		{"null", []byte{0xf6}, nil},
+		{"float", []byte{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}, 1.1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, read, err := decodeCBOR(append(test.data, 0xff))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if read != len(test.data) {
+				t.Fatalf("read %d bytes, expected %d", read, len(test.data))
+			}
+			if !reflect.DeepEqual(value, test.value) {
+				t.Fatalf("decoded %#v, expected %#v", value, test.value)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORRejected(t *testing.T) {
+	nested := func(depth int) []byte {
+		return append(bytes.Repeat([]byte{0x81}, depth), 0x00)
+	}
+
+	if _, _, err := decodeCBOR(nested(cborMaxDepth)); err != nil {
+		t.Fatalf("nesting of %d: %v", cborMaxDepth, err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err string
+	}{
+		{"empty", []byte{}, "cbor: truncated data"},
+		{"truncated argument", []byte{0x19, 0x01}, "cbor: truncated data"},
+		{"truncated byte string", []byte{0x45, 1, 2}, "cbor: truncated data"},
+		{"huge byte string", []byte{0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "cbor: truncated data"},
+		{"huge array", []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "cbor: truncated data"},
+		{"huge map", []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "cbor: truncated data"},
+		{"missing map value", []byte{0xa1, 0x01}, "cbor: truncated data"},
+		{"nested too deep", nested(cborMaxDepth + 1), "cbor: nested too deep"},
+		{"deeply nested maps", append(bytes.Repeat([]byte{0xa1, 0x01}, 1000), 0x00), "cbor: nested too deep"},
+		{"indefinite length", []byte{0x5f, 0x41, 0x01, 0xff}, "cbor: indefinite lengths are not supported"},
+		{"tag", []byte{0xc0, 0x00}, "cbor: tags are not supported"},
+		{"integer overflow", []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "cbor: integer overflow"},
+		{"byte string map key", []byte{0xa1, 0x41, 0x01, 0x00}, "cbor: unsupported map key"},
+		{"undefined simple value", []byte{0xf0}, "cbor: unsupported simple value"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := decodeCBOR(test.data)
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("error %v, expected %q", err, test.err)
+			}
+		})
+	}
+
+	// every truncation of a COSE key fails cleanly
+	key := newTestAuthenticator(t, "ES256").coseKey()
+	for i := 0; i < len(key); i++ {
+		if _, _, err := decodeCBOR(key[:i]); err == nil {
+			t.Fatalf("COSE key truncated to %d bytes accepted", i)
+		}
+	}
+}
+
+func TestParseCOSEKeyRejected(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	x := ecKey.X.FillBytes(make([]byte, 32))
+	y := ecKey.Y.FillBytes(make([]byte, 32))
+	offCurve := append([]byte{}, y...)
+	offCurve[31] ^= 0x01
+
+	tests := []struct {
+		name string
+		key interface{}
+		err string
+	}{
+		{"not a map", []interface{}{1}, "COSE key is not a map"},
+		{"EC2 point off the curve", []cborPair{{1, 2}, {3, -7}, {-1, 1}, {-2, x}, {-3, offCurve}}, "Invalid EC2 key"},
+		{"EC2 short coordinate", []cborPair{{1, 2}, {3, -7}, {-1, 1}, {-2, x[1:]}, {-3, y}}, "Invalid EC2 key"},
+		{"EC2 P-384 curve", []cborPair{{1, 2}, {3, -7}, {-1, 2}, {-2, x}, {-3, y}}, "Unsupported EC2 curve"},
+		{"OKP X25519 curve", []cborPair{{1, 1}, {3, -8}, {-1, 4}, {-2, x}}, "Unsupported OKP curve"},
+		{"OKP short key", []cborPair{{1, 1}, {3, -8}, {-1, 6}, {-2, x[1:]}}, "Invalid OKP key"},
+		{"RSA 1024 bits modulus", []cborPair{{1, 3}, {3, -257}, {-1, make([]byte, 128)}, {-2, []byte{1, 0, 1}}}, "Invalid RSA key"},
+		{"RSA huge exponent", []cborPair{{1, 3}, {3, -257}, {-1, make([]byte, 256)}, {-2, make([]byte, 5)}}, "Invalid RSA key"},
+		{"unsupported algorithm", []cborPair{{1, 2}, {3, -35}, {-1, 2}, {-2, x}, {-3, y}}, "Unsupported COSE key"},
+		{"algorithm of another key type", []cborPair{{1, 2}, {3, -8}, {-1, 1}, {-2, x}, {-3, y}}, "Unsupported COSE key"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseCOSEKey(encodeCBOR(test.key))
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseIPList reads a list of IPs and CIDRs, skipping the invalid ones
+func ParseIPList(list []string) []*net.IPNet {
+	nets := []*net.IPNet{}
+
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+
+		_, cidr, err := net.ParseCIDR(entry)
+		if err != nil {
+			Error("Invalid IP or CIDR: " + entry, err)
+			continue
+		}
+
+		nets = append(nets, cidr)
+	}
+
+	return nets
+}
+
+// HTTPConfig.TrustedProxies, parsed by LoadBaseMainConfig
+var trustedProxies []*net.IPNet
+
+// IsTrustedProxy tells if the IP belongs to HTTPConfig.TrustedProxies
+func IsTrustedProxy(ip string) bool {
+	configLock.RLock()
+	proxies := trustedProxies
+	configLock.RUnlock()
+
+	return IPInList(ip, proxies)
+}
+
+func IPInList(ip string, list []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, cidr := range list {
+		if cidr.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetClientIP returns the IP of the client making the request. Forwarding
+// headers are only read when the peer is a trusted proxy, X-Forwarded-For
+// is walked from the right so a client can't spoof it by prepending values
+func GetClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !IsTrustedProxy(ip) {
+		return ip
+	}
+
+	if forwarded := strings.Join(r.Header.Values("X-Forwarded-For"), ","); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+
+			ip = hop
+
+			if !IsTrustedProxy(hop) {
+				return ip
+			}
+		}
+
+		return ip
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return ip
+}
@@ -0,0 +1,317 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+var DefaultCompressedTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/manifest+json",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// text/event-stream is excluded even when text/* is allowed, clients expect every event as soon as it is sent
+var neverCompressedTypes = map[string]bool{
+	"text/event-stream": true,
+}
+
+const defaultCompressionMinSize = 1024
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var compressorPools = map[string]*sync.Pool{
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	"zstd": {New: func() interface{} {
+		encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return encoder
+	}},
+	"gzip": {New: func() interface{} {
+		writer, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return writer
+	}},
+}
+
+// negotiateEncoding picks the encoding with the best q-value in Accept-Encoding,
+// preferring brotli, then zstd (when allowed), then gzip. Empty means identity
+func negotiateEncoding(acceptEncoding string, allowZstd bool) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		qualities[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+
+	candidates := []string{"br", "gzip"}
+	if allowZstd {
+		candidates = []string{"br", "zstd", "gzip"}
+	}
+
+	best := ""
+	bestQ := 0.0
+	for _, encoding := range candidates {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best = encoding
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+func isCompressedType(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || neverCompressedTypes[mediaType] {
+		return false
+	}
+
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if strings.HasSuffix(pattern, "/*") {
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressionWriter holds the response back until it knows if it is worth
+// compressing: from the headers when they tell, otherwise once MinSize bytes
+// were written, the handler flushed, or the response ended
+type compressionWriter struct {
+	http.ResponseWriter
+	config CompressionConfig
+	encoding string
+	head bool
+
+	status int
+	decided bool
+	buffer bytes.Buffer
+	compressor compressor
+}
+
+func (w *compressionWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+
+	header := w.ResponseWriter.Header()
+
+	switch {
+		case status < 200 || status == http.StatusNoContent || status == http.StatusNotModified ||
+			status == http.StatusPartialContent || w.head:
+			w.decide(false)
+		case header.Get("Content-Encoding") != "":
+			w.decide(false)
+		case header.Get("Content-Type") != "" && !isCompressedType(header.Get("Content-Type"), w.config.ContentTypes):
+			w.decide(false)
+		case header.Get("Content-Type") != "" && header.Get("Content-Length") != "":
+			length, _ := strconv.Atoi(header.Get("Content-Length"))
+			w.decide(length >= w.minSize())
+	}
+}
+
+func (w *compressionWriter) minSize() int {
+	if w.config.MinSize > 0 {
+		return w.config.MinSize
+	}
+	return defaultCompressionMinSize
+}
+
+// decide sends the headers, compressing the rest of the response or not
+func (w *compressionWriter) decide(compress bool) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	header := w.ResponseWriter.Header()
+
+	if compress {
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		header.Set("Content-Encoding", w.encoding)
+		// the compressed representation is not byte for byte the one of the upstream
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/" + etag)
+		}
+
+		w.compressor = compressorPools[w.encoding].Get().(compressor)
+		w.compressor.Reset(w.ResponseWriter)
+	}
+
+	if header.Get("Content-Type") == "" || isCompressedType(header.Get("Content-Type"), w.config.ContentTypes) {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if w.buffer.Len() > 0 {
+		buffered := w.buffer.Bytes()
+		w.buffer = bytes.Buffer{}
+		w.write(buffered)
+	}
+}
+
+// decideFromBody is used when the headers did not tell, the type is sniffed if missing
+func (w *compressionWriter) decideFromBody(complete bool) {
+	header := w.ResponseWriter.Header()
+	if header.Get("Content-Type") == "" && w.buffer.Len() > 0 {
+		header.Set("Content-Type", http.DetectContentType(w.buffer.Bytes()))
+	}
+
+	if !isCompressedType(header.Get("Content-Type"), w.config.ContentTypes) {
+		w.decide(false)
+		return
+	}
+
+	w.decide(!complete || w.buffer.Len() >= w.minSize())
+}
+
+func (w *compressionWriter) write(b []byte) (int, error) {
+	if w.compressor != nil {
+		return w.compressor.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressionWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.decided {
+		return w.write(b)
+	}
+
+	w.buffer.Write(b)
+	if w.buffer.Len() >= w.minSize() {
+		w.decideFromBody(false)
+	}
+	return len(b), nil
+}
+
+// Flush sends what was written so far. Streams are compressed when their type allows it
+func (w *compressionWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.decideFromBody(false)
+	}
+	if w.compressor != nil {
+		w.compressor.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressionWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func (w *compressionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish ends the compressed stream, or sends a response that never reached MinSize
+func (w *compressionWriter) finish() {
+	if w.status == 0 {
+		return
+	}
+
+	if !w.decided {
+		w.decideFromBody(true)
+	}
+
+	if w.compressor != nil {
+		if err := w.compressor.Close(); err != nil {
+			Debug("Compression: closing " + w.encoding + " stream: " + err.Error())
+		}
+		w.compressor.Reset(nil)
+		compressorPools[w.encoding].Put(w.compressor)
+		w.compressor = nil
+	}
+}
+
+// CompressionMiddleware compresses the responses with the encoding negotiated
+// with the client, when the route has compression enabled
+func CompressionMiddleware(config CompressionConfig) func(next http.Handler) http.Handler {
+	if len(config.ContentTypes) == 0 {
+		config.ContentTypes = DefaultCompressedTypes
+	}
+
+	return func(next http.Handler) http.Handler {
+		if !config.Enabled {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), config.Zstd)
+
+			if encoding == "" || IsUpgradeRequest(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			writer := &compressionWriter{
+				ResponseWriter: w,
+				config: config,
+				encoding: encoding,
+				head: r.Method == "HEAD",
+			}
+			defer writer.finish()
+
+			next.ServeHTTP(writer, r)
+		})
+	}
+}
@@ -17,7 +17,7 @@ func DB() error {
 		return errors.New("User Management is disabled")
 	}
 
-	uri := MainConfig.MongoDB + "/?retryWrites=true&w=majority"
+	uri := GetMainConfig().MongoDB + "/?retryWrites=true&w=majority"
 
 	if(client != nil && client.Ping(context.TODO(), readpref.Primary()) == nil) {
 		return nil
@@ -44,9 +44,13 @@ func DB() error {
 }
 
 func Disconnect() {
+	if client == nil {
+		return
+	}
 	if err := client.Disconnect(context.TODO()); err != nil {
-		Fatal("DB", err)
+		Error("DB Disconnect", err)
 	}
+	client = nil
 }
 
 func GetCollection(applicationId string, collection string) (*mongo.Collection, error) {
@@ -1,7 +1,15 @@
 package utils
 
 import (
+	"encoding/json"
 	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var Reset  = "\033[0m"
@@ -14,45 +22,184 @@ var Cyan   = "\033[36m"
 var Gray   = "\033[37m"
 var White  = "\033[97m"
 
+const (
+	LogFormatText = "TEXT"
+	LogFormatJSON = "JSON"
+	LogFormatLogfmt = "LOGFMT"
+)
+
+// escape codes corrupt the output when logs go to a file or a log shipper
+func init() {
+	if !isTerminal(log.Writer()) {
+		Reset, Red, Green, Yellow, Blue, Purple, Cyan, Gray, White = "", "", "", "", "", "", "", "", ""
+	}
+}
+
+func isTerminal(w interface{}) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode() & os.ModeCharDevice != 0
+}
+
+var structuredLog = log.New(log.Writer(), "", 0)
+
+var componentNames = map[string]string{
+	"src": "main",
+	"configapi": "config",
+}
+
+// callerComponent names the package that called the exported log function
+func callerComponent(skip int) string {
+	_, file, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return ""
+	}
+	dir := filepath.Base(filepath.Dir(file))
+	if name, ok := componentNames[dir]; ok {
+		return name
+	}
+	return dir
+}
+
+type logEntry struct {
+	level string
+	color string
+	component string
+	message string
+	err error
+	info *RequestInfo
+	// extra key, value pairs
+	fields []string
+}
+
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\n\t") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func writeLog(entry logEntry) {
+	format := strings.ToUpper(GetMainConfig().LoggingFormat)
+
+	pairs := []string{
+		"level", strings.ToLower(entry.level),
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"component", entry.component,
+		"msg", entry.message,
+	}
+	if entry.err != nil {
+		pairs = append(pairs, "error", entry.err.Error())
+	}
+	if entry.info != nil {
+		pairs = append(pairs, "request_id", entry.info.ID, "route", entry.info.Route, "client", entry.info.ClientID)
+	}
+	pairs = append(pairs, entry.fields...)
+
+	switch format {
+		case LogFormatJSON:
+			line := map[string]string{}
+			for i := 0; i + 1 < len(pairs); i += 2 {
+				if pairs[i+1] != "" {
+					line[pairs[i]] = pairs[i+1]
+				}
+			}
+			out, _ := json.Marshal(line)
+			structuredLog.Println(string(out))
+		case LogFormatLogfmt:
+			line := []string{}
+			for i := 0; i + 1 < len(pairs); i += 2 {
+				if pairs[i+1] != "" || pairs[i] == "msg" {
+					line = append(line, pairs[i] + "=" + logfmtValue(pairs[i+1]))
+				}
+			}
+			structuredLog.Println(strings.Join(line, " "))
+		default:
+			message := entry.color + "[" + entry.level + "] " + entry.message
+			if entry.level == "ERROR" || entry.level == "FATAL" {
+				errStr := ""
+				if entry.err != nil {
+					errStr = entry.err.Error()
+				}
+				message += " : " + errStr
+			}
+			if entry.info != nil {
+				message += " (request " + entry.info.ID + ")"
+			}
+			log.Println(message + Reset)
+	}
+}
+
+func logLevel() int {
+	return LoggingLevelLabels[GetMainConfig().LoggingLevel]
+}
+
 func Debug(message string) {
-	ll := LoggingLevelLabels[GetMainConfig().LoggingLevel]
-	if ll <= DEBUG {
-		log.Println(Purple + "[DEBUG] " + message + Reset)
+	if logLevel() <= DEBUG {
+		writeLog(logEntry{level: "DEBUG", color: Purple, component: callerComponent(1), message: message})
 	}
 }
 
 func Log(message string) {
-	ll := LoggingLevelLabels[GetMainConfig().LoggingLevel]
-	if ll <= INFO {
-		log.Println(Blue + "[INFO] " + message + Reset)
+	if logLevel() <= INFO {
+		writeLog(logEntry{level: "INFO", color: Blue, component: callerComponent(1), message: message})
 	}
 }
 
 func Warn(message string) {
-	ll := LoggingLevelLabels[GetMainConfig().LoggingLevel]
-	if ll <= WARNING {
-		log.Println(Yellow + "[WARN] " + message + Reset)
+	if logLevel() <= WARNING {
+		writeLog(logEntry{level: "WARN", color: Yellow, component: callerComponent(1), message: message})
 	}
 }
 
 func Error(message string, err error) {
-	ll := LoggingLevelLabels[GetMainConfig().LoggingLevel]
-	errStr := ""
-	if err != nil {
-		errStr = err.Error()
-	}
-	if ll <= ERROR {
-		log.Println(Red + "[ERROR] " + message + " : " + errStr + Reset)
+	if logLevel() <= ERROR {
+		writeLog(logEntry{level: "ERROR", color: Red, component: callerComponent(1), message: message, err: err})
 	}
 }
 
 func Fatal(message string, err error) {
-	ll := LoggingLevelLabels[GetMainConfig().LoggingLevel]
-	errStr := ""
-	if err != nil {
-		errStr = err.Error()
+	if logLevel() <= ERROR {
+		writeLog(logEntry{level: "FATAL", color: Red, component: callerComponent(1), message: message, err: err})
 	}
-	if ll <= ERROR {
-		log.Fatal(Red + "[FATAL] " + message + " : " + errStr + Reset)
+	os.Exit(1)
+}
+
+// RequestLogger logs with the request ID, route and client of a request
+type RequestLogger struct {
+	info *RequestInfo
+}
+
+func ReqLog(r *http.Request) RequestLogger {
+	return RequestLogger{GetRequestInfo(r)}
+}
+
+func (l RequestLogger) Debug(message string) {
+	if logLevel() <= DEBUG {
+		writeLog(logEntry{level: "DEBUG", color: Purple, component: callerComponent(1), message: message, info: l.info})
+	}
+}
+
+func (l RequestLogger) Log(message string) {
+	if logLevel() <= INFO {
+		writeLog(logEntry{level: "INFO", color: Blue, component: callerComponent(1), message: message, info: l.info})
+	}
+}
+
+func (l RequestLogger) Warn(message string) {
+	if logLevel() <= WARNING {
+		writeLog(logEntry{level: "WARN", color: Yellow, component: callerComponent(1), message: message, info: l.info})
+	}
+}
+
+func (l RequestLogger) Error(message string, err error) {
+	if logLevel() <= ERROR {
+		writeLog(logEntry{level: "ERROR", color: Red, component: callerComponent(1), message: message, err: err, info: l.info})
 	}
 }
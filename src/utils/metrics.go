@@ -0,0 +1,349 @@
+package utils
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal Prometheus registry, written in the text exposition format
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var metricsLock sync.Mutex
+var metrics = []metric{}
+var metricsScrapeHooks = []func(){}
+
+func registerMetric(m metric) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metrics = append(metrics, m)
+}
+
+// OnMetricsScrape runs hook before every scrape, to refresh gauges
+func OnMetricsScrape(hook func()) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metricsScrapeHooks = append(metricsScrapeHooks, hook)
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, name + `="` + escapeLabelValue(values[i]) + `"`)
+	}
+	for i := 0; i + 1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i] + `="` + escapeLabelValue(extra[i+1]) + `"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name string, help string, metricType string) {
+	io.WriteString(w, "# HELP " + name + " " + help + "\n")
+	io.WriteString(w, "# TYPE " + name + " " + metricType + "\n")
+}
+
+type metricSeries struct {
+	labels []string
+	value float64
+}
+
+// vector holds one value per combination of label values
+type vector struct {
+	sync.Mutex
+	name string
+	help string
+	labels []string
+	series map[string]*metricSeries
+}
+
+func newVector(name string, help string, labels []string) vector {
+	return vector{
+		name: name,
+		help: help,
+		labels: labels,
+		series: map[string]*metricSeries{},
+	}
+}
+
+// getSeries must hold the vector lock
+func (v *vector) getSeries(values []string) *metricSeries {
+	if len(values) != len(v.labels) {
+		panic("metric " + v.name + ": expected " + strconv.Itoa(len(v.labels)) + " label values")
+	}
+
+	key := strings.Join(values, "\xff")
+	series, ok := v.series[key]
+	if !ok {
+		series = &metricSeries{labels: append([]string{}, values...)}
+		v.series[key] = series
+	}
+	return series
+}
+
+func (v *vector) writeType(w io.Writer, metricType string) {
+	v.Lock()
+	defer v.Unlock()
+
+	writeHeader(w, v.name, v.help, metricType)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := v.series[key]
+		io.WriteString(w, v.name + formatLabels(v.labels, series.labels) + " " + formatFloat(series.value) + "\n")
+	}
+}
+
+type Counter struct {
+	vector
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{newVector(name, help, labels)}
+	registerMetric(c)
+	return c
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.getSeries(labelValues).value += value
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeType(w, "counter")
+}
+
+type Gauge struct {
+	vector
+}
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{newVector(name, help, labels)}
+	registerMetric(g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+	g.getSeries(labelValues).value = value
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.writeType(w, "gauge")
+}
+
+var DefaultHistogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	count uint64
+	sum float64
+}
+
+type Histogram struct {
+	sync.Mutex
+	name string
+	help string
+	labels []string
+	buckets []float64
+	series map[string]*histogramSeries
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		name: name,
+		help: help,
+		labels: labels,
+		buckets: buckets,
+		series: map[string]*histogramSeries{},
+	}
+	registerMetric(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic("metric " + h.name + ": expected " + strconv.Itoa(len(h.labels)) + " label values")
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{
+			labels: append([]string{}, labelValues...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = series
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := h.series[key]
+		for i, bound := range h.buckets {
+			io.WriteString(w, h.name + "_bucket" + formatLabels(h.labels, series.labels, "le", formatFloat(bound)) + " " + strconv.FormatUint(series.counts[i], 10) + "\n")
+		}
+		io.WriteString(w, h.name + "_bucket" + formatLabels(h.labels, series.labels, "le", "+Inf") + " " + strconv.FormatUint(series.count, 10) + "\n")
+		io.WriteString(w, h.name + "_sum" + formatLabels(h.labels, series.labels) + " " + formatFloat(series.sum) + "\n")
+		io.WriteString(w, h.name + "_count" + formatLabels(h.labels, series.labels) + " " + strconv.FormatUint(series.count, 10) + "\n")
+	}
+}
+
+// WriteMetrics runs the scrape hooks then writes every registered metric
+func WriteMetrics(w io.Writer) {
+	metricsLock.Lock()
+	hooks := append([]func(){}, metricsScrapeHooks...)
+	registered := append([]metric{}, metrics...)
+	metricsLock.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+
+	for _, m := range registered {
+		m.write(w)
+	}
+}
+
+var MetricHTTPRequests = NewCounter("cosmos_http_requests_total",
+	"Requests served, by route and status code", "route", "status")
+var MetricHTTPDuration = NewHistogram("cosmos_http_request_duration_seconds",
+	"Time to serve a request, by route", DefaultHistogramBuckets, "route")
+var MetricHTTPBytesSent = NewCounter("cosmos_http_response_bytes_total",
+	"Bytes of response bodies sent, by route", "route")
+var MetricHTTPTimeouts = NewCounter("cosmos_http_timeouts_total",
+	"Requests cancelled by the route timeout", "route")
+var MetricHTTPThrottled = NewCounter("cosmos_http_throttled_total",
+	"Requests rejected by the route throttling (429)", "route")
+
+// ResponseRecorder keeps the status and the size of the response
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes int64
+}
+
+// Status returns the status code sent, 200 if the handler did not set one
+func (w *ResponseRecorder) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *ResponseRecorder) Bytes() int64 {
+	return w.bytes
+}
+
+func (w *ResponseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *ResponseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *ResponseRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (w *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// MetricsMiddleware records the requests of a route, and sets its name in the
+// RequestInfo for the inner middlewares and the logs
+func MetricsMiddleware(route string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			mw := &ResponseRecorder{ResponseWriter: w}
+
+			r = withRequestInfo(r)
+			GetRequestInfo(r).Route = route
+
+			defer func() {
+				MetricHTTPRequests.Inc(route, strconv.Itoa(mw.Status()))
+				MetricHTTPDuration.Observe(time.Since(start).Seconds(), route)
+				MetricHTTPBytesSent.Add(float64(mw.bytes), route)
+			}()
+
+			next.ServeHTTP(mw, r)
+		})
+	}
+}
@@ -1,22 +1,46 @@
 package utils
 
 import (
+	"bufio"
 	"context"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 	"github.com/mxk/go-flowrate/flowrate"
 )
 
+// IsUpgradeRequest tells if the client asks to switch protocol (websockets)
+func IsUpgradeRequest(r *http.Request) bool {
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return r.Header.Get("Upgrade") != ""
+			}
+		}
+	}
+	return false
+}
+
 // https://github.com/go-chi/chi/blob/master/middleware/timeout.go
 
 func MiddlewareTimeout(timeout time.Duration) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
+			// the reverse proxy closes upgraded connections when the context ends,
+			// a websocket session is not a request that can time out
+			if IsUpgradeRequest(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			ctx, cancel := context.WithTimeout(r.Context(), timeout)
 			defer func() {
 				cancel()
 				if ctx.Err() == context.DeadlineExceeded {
-					Error("Request Timeout. Cancelling.", ctx.Err())
+					ReqLog(r).Error("Request Timeout. Cancelling.", ctx.Err())
+					MetricHTTPTimeouts.Inc(GetRouteName(r))
 					HTTPError(w, "Gateway Timeout", 
 						http.StatusGatewayTimeout, "HTTP002")
 					return 
@@ -41,6 +65,25 @@ func (w *responseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands over the raw connection, upgraded connections are not limited
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func BandwithLimiterMiddleware(max int64) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -95,3 +138,94 @@ func AcceptHeader(accept string) func(next http.Handler) http.Handler {
 		})
 	}
 }
+
+// RequestInfo follows a request through the middlewares, for the logs and metrics
+type RequestInfo struct {
+	ID string
+	Route string
+	ClientID string
+}
+
+type requestInfoKey struct{}
+
+func GetRequestInfo(r *http.Request) *RequestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// withRequestInfo makes sure the request carries a RequestInfo
+func withRequestInfo(r *http.Request) *http.Request {
+	if GetRequestInfo(r) != nil {
+		return r
+	}
+	info := &RequestInfo{
+		ID: r.Header.Get("X-Request-ID"),
+		ClientID: GetClientIP(r),
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+}
+
+func GetRouteName(r *http.Request) string {
+	if info := GetRequestInfo(r); info != nil {
+		return info.Route
+	}
+	return ""
+}
+
+// RequestIDMiddleware gives an ID to every request, sent back to the client and
+// forwarded to the backends as X-Request-ID. Only trusted proxies can provide it
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		peer, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+		if id == "" || len(id) > 128 || !IsTrustedProxy(peer) {
+			id = GenerateRandomString(20)
+		}
+
+		r.Header.Set("X-Request-ID", id)
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, withRequestInfo(r))
+	})
+}
+
+// LogRequests logs one line per request, replacing chi's middleware.Logger
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &ResponseRecorder{ResponseWriter: w}
+		r = withRequestInfo(r)
+
+		next.ServeHTTP(rec, r)
+
+		if logLevel() > INFO {
+			return
+		}
+
+		status := rec.Status()
+		duration := time.Since(start)
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+
+		writeLog(logEntry{
+			level: "INFO",
+			color: Blue,
+			component: "http",
+			message: "\"" + r.Method + " " + scheme + "://" + r.Host + r.RequestURI + " " + r.Proto + "\" from " + GetRequestInfo(r).ClientID + " - " +
+				strconv.Itoa(status) + " " + strconv.FormatInt(rec.bytes, 10) + "B in " + duration.String(),
+			info: GetRequestInfo(r),
+			fields: []string{
+				"method", r.Method,
+				"host", r.Host,
+				"path", r.URL.Path,
+				"status", strconv.Itoa(status),
+				"bytes", strconv.FormatInt(rec.bytes, 10),
+				"duration_ms", strconv.FormatFloat(float64(duration.Microseconds()) / 1000, 'f', 3, 64),
+			},
+		})
+	})
+}
@@ -16,6 +16,12 @@ const (
 	ADMIN        = 2
 )
 
+var RoleNames = map[Role]string{
+	GUEST: "GUEST",
+	USER: "USER",
+	ADMIN: "ADMIN",
+}
+
 const (
 	DEBUG = 0
 	INFO = 1
@@ -38,6 +44,24 @@ var ProxyModeList = map[string]string{
 	"REDIRECT": "REDIRECT",
 }
 
+var UpstreamProtocolList = map[string]string{
+	"HTTP": "HTTP",
+	"H2C": "H2C",
+	"GRPC": "GRPC",
+}
+
+var HeaderActionList = map[string]string{
+	"ADD": "ADD",
+	"SET": "SET",
+	"REMOVE": "REMOVE",
+}
+
+var LoadBalancingList = map[string]string{
+	"ROUND_ROBIN": "ROUND_ROBIN",
+	"LEAST_CONN": "LEAST_CONN",
+	"IP_HASH": "IP_HASH",
+}
+
 var HTTPSCertModeList = map[string]string{
 	"DISABLED": "DISABLED",
 	"PROVIDED": "PROVIDED",
@@ -68,15 +92,120 @@ type User struct {
 	LastPasswordChangedAt time.Time   `json:"lastPasswordChangedAt"`
 	CreatedAt time.Time   `json:"createdAt"`
 	LastLogin time.Time   `json:"lastLogin"`
+	Groups []string `json:"groups"`
+	MFAEnabled bool `json:"mfaEnabled"`
+	// TOTP secret, kept while the enrollment is pending
+	MFAKey string `json:"-"`
+	// last TOTP time step accepted, a code can't be used twice
+	MFALastCounter int64 `json:"-"`
+	// SHA-256 of the unused recovery codes
+	MFARecoveryCodes []string `json:"-"`
+	WebAuthnCredentials []WebAuthnCredential `json:"webauthnCredentials"`
+	OpenIDLinks []OpenIDLink `json:"openidLinks"`
+}
+
+// OpenIDLink ties a user to an account of an external OpenID provider
+type OpenIDLink struct {
+	Provider string `json:"provider"`
+	Subject string `json:"subject"`
+}
+
+type OpenIDClient struct {
+	ID       primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	ClientID string `json:"clientId"`
+	Name string `json:"name"`
+	// SHA-256 of the secret, which is only shown on creation
+	SecretHash string `json:"-"`
+	RedirectURIs []string `json:"redirectUris"`
+	// public clients (SPAs, mobile apps) have no secret and must use PKCE
+	Public bool `json:"public"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type WebAuthnCredential struct {
+	// base64url of the raw id
+	ID string `json:"id"`
+	Name string `json:"name"`
+	// COSE_Key of the credential
+	PublicKey []byte `json:"-"`
+	SignCount uint32 `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// Session is a login of a user on a device, the sid claim of its token
+type Session struct {
+	ID       primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	SessionID string `json:"id"`
+	Nickname string `json:"nickname"`
+	// User-Agent of the browser which logged in
+	Device string `json:"device"`
+	IP string `json:"ip"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen time.Time `json:"lastSeen"`
+	// moved forward on use, the database drops the session once passed
+	ExpiresAt time.Time `json:"expiresAt"`
+	// filled when listing, for the session of the request
+	Current bool `json:"current" bson:"-"`
+}
+
+type Group struct {
+	ID       primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	Name string `validate:"required" json:"name"`
+	Description string `json:"description"`
+	CreatedAt time.Time `json:"createdAt"`
+	// filled when a single group is read
+	Members []string `json:"members,omitempty" bson:"-"`
 }
 
 type Config struct {
 	LoggingLevel LoggingLevel `required,validate:"oneof=DEBUG INFO WARNING ERROR"`
+	// TEXT (default), or one JSON object / logfmt line per log for log shippers
+	LoggingFormat string `validate:"omitempty,oneof=TEXT JSON LOGFMT"`
 	MongoDB string
 	DisableUserManagement bool
 	NewInstall bool `validate:"boolean"`
 	HTTPConfig HTTPConfig `validate:"required,dive,required"`
 	DockerConfig DockerConfig
+	SmartShieldConfig SmartShieldConfig
+	AccessLogConfig AccessLogConfig
+	CacheConfig CacheConfig
+	AuthConfig AuthConfig
+}
+
+type AuthConfig struct {
+	// admins without TOTP have to enroll on their next login
+	RequireMFAForAdmins bool
+	// external identity providers users can log in with
+	OpenIDProviders []OpenIDProviderConfig
+	// hours a session stays open after its last use, default 72
+	SessionLifetime int
+	// hours after the login when the session ends even if used, unlimited when 0
+	SessionMaxLifetime int
+}
+
+type OpenIDProviderConfig struct {
+	// used in the callback URL, /cosmos/api/oidc/{Name}/callback
+	Name string `validate:"required,alphanum"`
+	DisplayName string
+	// the discovery document is read from Issuer + /.well-known/openid-configuration
+	Issuer string `validate:"required,url"`
+	ClientID string `validate:"required"`
+	ClientSecret string
+	// openid, profile and email by default
+	Scopes []string
+	// claim used as nickname of the provisioned users, preferred_username by default
+	UsernameClaim string
+	// claim holding the roles or groups of the user, for the role mapping
+	RoleClaim string
+	// values of RoleClaim giving the ADMIN role
+	AdminValues []string
+	// values of RoleClaim giving the USER role, when set the other users are refused
+	UserValues []string
+	// create the unknown users, otherwise they need an existing account
+	AutoProvision bool
+	// link the first login to the account with the same verified email
+	LinkByEmail bool
 }
 
 type HTTPConfig struct {
@@ -91,6 +220,18 @@ type HTTPConfig struct {
 	ProxyConfig ProxyConfig
 	Hostname string `validate:"required,excludesall=0x2C/ "`
 	SSLEmail string `validate:"omitempty,email"`
+	// seconds given to open requests to finish on shutdown, keep it below
+	// the stop timeout of your orchestrator
+	ShutdownDrainTimeout int
+	// IPs or CIDRs of the reverse proxies / load balancers in front of Cosmos,
+	// their X-Forwarded-For, X-Real-IP and PROXY protocol headers are trusted
+	TrustedProxies []string
+	// accept PROXY protocol v1/v2 headers from the trusted proxies
+	ProxyProtocol bool
+	// identify logged in users by nickname instead of IP in SmartShield and throttling
+	IdentifyUsersByNickname bool
+	// bearer token allowing Prometheus to scrape /cosmos/api/metrics without an admin session
+	MetricsToken string
 } 
 
 const (
@@ -104,6 +245,45 @@ type SmartShieldPolicy struct {
 	PerUserTimeBudget float64
 	PerUserRequestLimit int
 	PerUserByteLimit int64
+	// IPs, CIDRs or client IDs bypassing the shield on this route
+	AllowList []string
+	// overrides by role name (GUEST, USER, ADMIN) and by nickname
+	RolePolicies map[string]SmartShieldPolicyOverride
+	UserPolicies map[string]SmartShieldPolicyOverride
+}
+
+// SmartShieldPolicyOverride replaces the non-zero limits of a policy
+type SmartShieldPolicyOverride struct {
+	PolicyStrictness int
+	PerUserTimeBudget float64
+	PerUserRequestLimit int
+	PerUserByteLimit int64
+}
+
+type SmartShieldConfig struct {
+	// IPs, CIDRs or client IDs bypassing the shield on every route
+	AllowList []string
+	// overrides applied on every route, the route ones take precedence
+	RolePolicies map[string]SmartShieldPolicyOverride
+	UserPolicies map[string]SmartShieldPolicyOverride
+}
+
+type AccessLogConfig struct {
+	// record every proxied request in the database
+	Enabled bool
+	// size of the capped collection in MB, the oldest entries are dropped first
+	MaxSize int
+}
+
+type CacheConfig struct {
+	// memory tier in MB, shared by every cached route, default 64
+	MemorySize int
+	// directory of the disk tier, where entries evicted from memory go. Disabled when empty
+	DiskPath string
+	// disk tier in MB, default 1024
+	DiskSize int
+	// larger responses are never cached, in MB, default 8
+	MaxObjectSize int
 }
 
 type DockerConfig struct {
@@ -130,4 +310,109 @@ type ProxyRouteConfig struct {
 	Target  string `validate:"required"`
 	SmartShield SmartShieldPolicy
 	Mode ProxyMode
+	// HTTP (default, HTTP/1.1 or HTTP/2 over TLS), H2C for cleartext HTTP/2 backends,
+	// GRPC for gRPC backends (h2c, or HTTP/2 if the target is https)
+	UpstreamProtocol string `validate:"omitempty,oneof=HTTP H2C GRPC"`
+	// milliseconds between flushes of the response, -1 flushes after every write.
+	// Server-sent events and responses of unknown length are always flushed immediately
+	FlushInterval int
+	// more upstreams balanced with Target (PROXY and SERVAPP)
+	Targets []string
+	// SERVAPP: balance over every running container with this label (key=value),
+	// reached with the scheme and port of Target
+	TargetLabel string
+	// ROUND_ROBIN (default), LEAST_CONN or IP_HASH
+	LoadBalancing string `validate:"omitempty,oneof=ROUND_ROBIN LEAST_CONN IP_HASH"`
+	HealthCheck HealthCheckConfig
+	Cache RouteCacheConfig
+	Compression CompressionConfig
+	// rules applied in order to the headers of the request, before it reaches the target
+	RequestHeaders []HeaderRule
+	// rules applied in order to the headers of the response, Cosmos headers (CORS...) included
+	ResponseHeaders []HeaderRule
+	// rewrite the Location and Content-Location headers pointing at the target to the public URL of the route
+	RewriteLocation bool
+	PathRewrite PathRewriteRule
+	// aud of the JWT sent to the target in x-cosmos-token, defaults to the route name
+	TokenAudience string
+	ForwardAuth ForwardAuthConfig
+	AccessPolicy RouteAccessPolicy
+}
+
+// RouteAccessPolicy conditions are combined, a user must be in AllowedUsers
+// or in one of the AllowedGroups when either is set
+type RouteAccessPolicy struct {
+	// minimum role, 1 for users and 2 for admins. Anonymous requests are allowed when 0
+	MinRole int
+	// nicknames allowed
+	AllowedUsers []string
+	// groups allowed, read from x-cosmos-groups
+	AllowedGroups []string
+	// IPs and CIDRs the clients must come from
+	AllowedSources []string
+}
+
+type ForwardAuthConfig struct {
+	// ask before every request if it is allowed
+	Enabled bool
+	// endpoint called with the metadata of the request (X-Forwarded-Method, -Proto, -Host, -Uri, -For).
+	// A 2xx lets the request through, any other answer is sent back to the client.
+	// When empty, the request must come from a Cosmos user
+	URL string
+	// headers of the request sent to the endpoint, all of them when empty
+	AuthRequestHeaders []string
+	// headers of a 2xx answer copied to the request (user id, groups...)
+	AuthResponseHeaders []string
+	// seconds before the endpoint is considered down and the request denied, default 5
+	Timeout int
+}
+
+type HeaderRule struct {
+	// ADD a value, SET (replace) every value, or REMOVE the header
+	Action string `validate:"oneof=ADD SET REMOVE"`
+	Name string `validate:"required"`
+	Value string
+}
+
+type PathRewriteRule struct {
+	// regexp matched against the path, after StripPathPrefix. Disabled when empty
+	Match string
+	// replacement of the match, $1 or ${name} for the capture groups
+	Replace string
+}
+
+type CompressionConfig struct {
+	// compress the responses with brotli or gzip, as negotiated with the client
+	Enabled bool
+	// also offer zstd
+	Zstd bool
+	// media types compressed, type/* matches every subtype. Defaults to text, JSON, JavaScript, XML and SVG
+	ContentTypes []string
+	// smaller responses are sent as is, in bytes, default 1024
+	MinSize int
+}
+
+type RouteCacheConfig struct {
+	// cache the GET and HEAD responses of the route, following Cache-Control, ETag
+	// and Vary. Responses to logged in users are only cached when marked public
+	Enabled bool
+	// seconds a response without Cache-Control or Expires is kept, not cached when 0
+	DefaultTTL int
+}
+
+type HealthCheckConfig struct {
+	// PROXY and SERVAPP routes are checked unless disabled
+	Disabled bool
+	// path requested on the target. When set, upstreams of balanced routes are
+	// checked too and taken out of rotation when failing
+	Path string
+	// status expected from the check, by default 2xx/3xx when Path is set,
+	// anything below 500 otherwise
+	ExpectedStatus int
+	// seconds between checks, default 10
+	Interval int
+	// seconds before a check fails, default 5
+	Timeout int
+	// HTML file served with a 503, instead of the 502, when the target is down
+	MaintenancePage string
 }
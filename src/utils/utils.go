@@ -6,19 +6,29 @@ import (
 	"math/rand"
 	"regexp"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/shirou/gopsutil/v3/mem"
 )
 
+// read through GetMainConfig and GetBaseMainConfig, the routes can be
+// reloaded while requests are served
 var BaseMainConfig Config
 var MainConfig Config
+var configLock sync.RWMutex
 var IsHTTPS = false
 
 var NeedsRestart = false
 
+// set by the HTTP server, rebuilds the router from MainConfig
+var ReloadRoutesHandler func()
+
+var ShutdownRequested = make(chan bool, 1)
+
 var DefaultConfig = Config{
 	LoggingLevel: "INFO",
 	NewInstall:   true,
@@ -48,11 +58,11 @@ func GetRootAppId() string {
 }
 
 func GetPrivateAuthKey() string {
-	return MainConfig.HTTPConfig.AuthPrivateKey
+	return GetMainConfig().HTTPConfig.AuthPrivateKey
 }
 
 func GetPublicAuthKey() string {
-	return MainConfig.HTTPConfig.AuthPublicKey
+	return GetMainConfig().HTTPConfig.AuthPublicKey
 }
 
 var AlphaNumRunes = []rune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -81,7 +91,26 @@ func HTTPError(w http.ResponseWriter, message string, code int, userCode string)
 	Error("HTTP Request returned Error "+strconv.Itoa(code)+" : "+message, nil)
 }
 
+// ConfigUpdateLock is held while the config is read, changed and saved,
+// so concurrent updates don't overwrite each other
+var ConfigUpdateLock sync.Mutex
+
 func SetBaseMainConfig(config Config) {
+	ConfigUpdateLock.Lock()
+	defer ConfigUpdateLock.Unlock()
+
+	LoadBaseMainConfig(config)
+	SaveConfigTofile(config)
+}
+
+// UpdateBaseMainConfig changes the config in memory and in the config file
+func UpdateBaseMainConfig(update func(config *Config)) {
+	ConfigUpdateLock.Lock()
+	defer ConfigUpdateLock.Unlock()
+
+	config := GetBaseMainConfig()
+	update(&config)
+
 	LoadBaseMainConfig(config)
 	SaveConfigTofile(config)
 }
@@ -123,52 +152,89 @@ func ReadConfigFromFile() Config {
 	return config
 }
 
+// LoadBaseMainConfig swaps the config read by GetMainConfig, the env
+// overrides are applied to a copy before the swap
 func LoadBaseMainConfig(config Config){
-	BaseMainConfig = config
-	MainConfig = config
+	mainConfig := config
 
 	// use ENV to overwrite configs
 
 	if os.Getenv("COSMOS_HTTP_PORT") != "" {
-		MainConfig.HTTPConfig.HTTPPort = os.Getenv("COSMOS_HTTP_PORT")
+		mainConfig.HTTPConfig.HTTPPort = os.Getenv("COSMOS_HTTP_PORT")
 	}
 	if os.Getenv("COSMOS_HTTPS_PORT") != "" {
-		MainConfig.HTTPConfig.HTTPSPort = os.Getenv("COSMOS_HTTPS_PORT")
+		mainConfig.HTTPConfig.HTTPSPort = os.Getenv("COSMOS_HTTPS_PORT")
 	}
 	if os.Getenv("COSMOS_HOSTNAME") != "" {
-		MainConfig.HTTPConfig.Hostname = os.Getenv("COSMOS_HOSTNAME")
+		mainConfig.HTTPConfig.Hostname = os.Getenv("COSMOS_HOSTNAME")
 	}
 	if os.Getenv("COSMOS_HTTPS_MODE") != "" {
-		MainConfig.HTTPConfig.HTTPSCertificateMode = os.Getenv("COSMOS_HTTPS_MODE")
+		mainConfig.HTTPConfig.HTTPSCertificateMode = os.Getenv("COSMOS_HTTPS_MODE")
 	}
 	if os.Getenv("COSMOS_GENERATE_MISSING_AUTH_CERT") != "" {
-		MainConfig.HTTPConfig.GenerateMissingAuthCert = os.Getenv("COSMOS_GENERATE_MISSING_AUTH_CERT") == "true"
+		mainConfig.HTTPConfig.GenerateMissingAuthCert = os.Getenv("COSMOS_GENERATE_MISSING_AUTH_CERT") == "true"
 	}
 	if os.Getenv("COSMOS_TLS_CERT") != "" {
-		MainConfig.HTTPConfig.TLSCert = os.Getenv("COSMOS_TLS_CERT")
+		mainConfig.HTTPConfig.TLSCert = os.Getenv("COSMOS_TLS_CERT")
 	}
 	if os.Getenv("COSMOS_TLS_KEY") != "" {
-		MainConfig.HTTPConfig.TLSKey = os.Getenv("COSMOS_TLS_KEY")
+		mainConfig.HTTPConfig.TLSKey = os.Getenv("COSMOS_TLS_KEY")
 	}
 	if os.Getenv("COSMOS_AUTH_PRIV_KEY") != "" {
-		MainConfig.HTTPConfig.AuthPrivateKey = os.Getenv("COSMOS_AUTH_PRIVATE_KEY")
+		mainConfig.HTTPConfig.AuthPrivateKey = os.Getenv("COSMOS_AUTH_PRIVATE_KEY")
 	}
 	if os.Getenv("COSMOS_AUTH_PUBLIC_KEY") != "" {
-		MainConfig.HTTPConfig.AuthPublicKey = os.Getenv("COSMOS_AUTH_PUBLIC_KEY")
+		mainConfig.HTTPConfig.AuthPublicKey = os.Getenv("COSMOS_AUTH_PUBLIC_KEY")
 	}
 	if os.Getenv("COSMOS_LOG_LEVEL") != "" {
-		MainConfig.LoggingLevel = (LoggingLevel)(os.Getenv("COSMOS_LOG_LEVEL"))
+		mainConfig.LoggingLevel = (LoggingLevel)(os.Getenv("COSMOS_LOG_LEVEL"))
+	}
+	if os.Getenv("COSMOS_LOG_FORMAT") != "" {
+		mainConfig.LoggingFormat = os.Getenv("COSMOS_LOG_FORMAT")
 	}
 	if os.Getenv("COSMOS_MONGODB") != "" {
-		MainConfig.MongoDB = os.Getenv("COSMOS_MONGODB")
+		mainConfig.MongoDB = os.Getenv("COSMOS_MONGODB")
+	}
+	if os.Getenv("COSMOS_SMARTSHIELD_ALLOWLIST") != "" {
+		allowList := append([]string{}, mainConfig.SmartShieldConfig.AllowList...)
+		mainConfig.SmartShieldConfig.AllowList = append(allowList, strings.Split(os.Getenv("COSMOS_SMARTSHIELD_ALLOWLIST"), ",")...)
 	}
+	if os.Getenv("COSMOS_SHUTDOWN_DRAIN_TIMEOUT") != "" {
+		mainConfig.HTTPConfig.ShutdownDrainTimeout, _ = strconv.Atoi(os.Getenv("COSMOS_SHUTDOWN_DRAIN_TIMEOUT"))
+	}
+	if os.Getenv("COSMOS_TRUSTED_PROXIES") != "" {
+		proxies := append([]string{}, mainConfig.HTTPConfig.TrustedProxies...)
+		mainConfig.HTTPConfig.TrustedProxies = append(proxies, strings.Split(os.Getenv("COSMOS_TRUSTED_PROXIES"), ",")...)
+	}
+	if os.Getenv("COSMOS_ACCESS_LOG") != "" {
+		mainConfig.AccessLogConfig.Enabled = os.Getenv("COSMOS_ACCESS_LOG") == "true"
+	}
+	if os.Getenv("COSMOS_METRICS_TOKEN") != "" {
+		mainConfig.HTTPConfig.MetricsToken = os.Getenv("COSMOS_METRICS_TOKEN")
+	}
+	if os.Getenv("COSMOS_PROXY_PROTOCOL") != "" {
+		mainConfig.HTTPConfig.ProxyProtocol = os.Getenv("COSMOS_PROXY_PROTOCOL") == "true"
+	}
+
+	// parsed once, IsTrustedProxy runs on every forwarded hop of every request
+	proxies := ParseIPList(mainConfig.HTTPConfig.TrustedProxies)
+
+	configLock.Lock()
+	BaseMainConfig = config
+	MainConfig = mainConfig
+	trustedProxies = proxies
+	configLock.Unlock()
 }
 
 func GetMainConfig() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
 	return MainConfig
 }
 
 func GetBaseMainConfig() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
 	return BaseMainConfig
 }
 
@@ -235,9 +301,23 @@ func SaveConfigTofile(config Config) {
 	Log("Config file saved.")
 }
 
+func ReloadRoutes() {
+	if ReloadRoutesHandler == nil {
+		NeedsRestart = true
+		return
+	}
+	Log("Reloading routes...")
+	ReloadRoutesHandler()
+}
+
+// RestartServer asks the main process to shutdown gracefully,
+// the container restart policy then brings Cosmos back up
 func RestartServer() {
 	Log("Restarting server...")
-	os.Exit(0)
+	select {
+		case ShutdownRequested <- true:
+		default:
+	}
 }
 
 func LoggedInOnlyWithRedirect(w http.ResponseWriter, req *http.Request) error {
@@ -246,8 +326,9 @@ func LoggedInOnlyWithRedirect(w http.ResponseWriter, req *http.Request) error {
 	isUserLoggedIn := role > 0
 
 	if !isUserLoggedIn || userNickname == "" {
-		Error("LoggedInOnlyWithRedirect: User is not logged in", nil)
-		http.Redirect(w, req, "/ui/login?notlogged=1&redirect="+req.URL.Path, http.StatusFound)
+		ReqLog(req).Error("LoggedInOnlyWithRedirect: User is not logged in", nil)
+		http.Redirect(w, req, "/ui/login?notlogged=1&redirect="+url.QueryEscape(req.URL.RequestURI()), http.StatusFound)
+		return errors.New("User not logged in")
 	}
 
 	return nil
@@ -259,7 +340,7 @@ func LoggedInOnly(w http.ResponseWriter, req *http.Request) error {
 	isUserLoggedIn := role > 0
 
 	if !isUserLoggedIn || userNickname == "" {
-		Error("LoggedInOnly: User is not logged in", nil)
+		ReqLog(req).Error("LoggedInOnly: User is not logged in", nil)
 		//http.Redirect(w, req, "/login?notlogged=1&redirect=" + req.URL.Path, http.StatusFound)
 		HTTPError(w, "User not logged in", http.StatusUnauthorized, "HTTP004")
 		return errors.New("User not logged in")
@@ -275,14 +356,14 @@ func AdminOnly(w http.ResponseWriter, req *http.Request) error {
 	isUserAdmin := role > 1
 
 	if !isUserLoggedIn || userNickname == "" {
-		Error("AdminOnly: User is not logged in", nil)
+		ReqLog(req).Error("AdminOnly: User is not logged in", nil)
 		//http.Redirect(w, req, "/login?notlogged=1&redirect=" + req.URL.Path, http.StatusFound)
 		HTTPError(w, "User not logged in", http.StatusUnauthorized, "HTTP004")
 		return errors.New("User not logged in")
 	}
 
 	if isUserLoggedIn && !isUserAdmin {
-		Error("AdminOnly: User is not admin", nil)
+		ReqLog(req).Error("AdminOnly: User is not admin", nil)
 		HTTPError(w, "User unauthorized", http.StatusUnauthorized, "HTTP005")
 		return errors.New("User not Admin")
 	}
@@ -297,13 +378,13 @@ func AdminOrItselfOnly(w http.ResponseWriter, req *http.Request, nickname string
 	isUserAdmin := role > 1
 
 	if !isUserLoggedIn || userNickname == "" {
-		Error("AdminOrItselfOnly: User is not logged in", nil)
+		ReqLog(req).Error("AdminOrItselfOnly: User is not logged in", nil)
 		HTTPError(w, "User not logged in", http.StatusUnauthorized, "HTTP004")
 		return errors.New("User not logged in")
 	}
 
 	if nickname != userNickname && !isUserAdmin {
-		Error("AdminOrItselfOnly: User is not admin", nil)
+		ReqLog(req).Error("AdminOrItselfOnly: User is not admin", nil)
 		HTTPError(w, "User unauthorized", http.StatusUnauthorized, "HTTP005")
 		return errors.New("User not Admin")
 	}